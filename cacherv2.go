@@ -0,0 +1,157 @@
+package rc
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/2manymws/rc/rfc9111"
+)
+
+// Entry is the stored request/response cache with the metadata (see CacherV2).
+type Entry struct {
+	// Key is the cache key of the entry (see CacheKey).
+	Key string
+	// Request is the request of the stored response.
+	Request *http.Request
+	// Response is the stored response.
+	Response *http.Response
+	// Expires is the expiration time of the stored response.
+	Expires time.Time
+	// StoredAt is the time when the entry is stored.
+	StoredAt time.Time
+	// RequestTime is the time when the request that resulted in the stored response was made (request_time in https://www.rfc-editor.org/rfc/rfc9111#section-4.2.3).
+	RequestTime time.Time
+	// ResponseTime is the time when the stored response was received (response_time in https://www.rfc-editor.org/rfc/rfc9111#section-4.2.3).
+	ResponseTime time.Time
+}
+
+// CacherV2 is the cache storage that takes the context of the request and the cache key, and stores the entry with the metadata.
+// Use FromCacherV2 to pass it to New and NewTransport.
+type CacherV2 interface {
+	// Load loads the entry of key for req.
+	// ctx is the context of req, so the deadline of the request can be honored.
+	// The errors are the same as Cacher.Load.
+	Load(ctx context.Context, key string, req *http.Request) (*Entry, error)
+	// Store stores the entry of key.
+	// ctx is not cancelled when the response is written because the entry is stored in the background.
+	Store(ctx context.Context, key string, e *Entry) error
+}
+
+// NewCacherV2 returns the CacherV2 that uses the Cacher.
+// The metadata other than Key and Expires is not stored, so the loaded entry does not have it.
+func NewCacherV2(c Cacher) CacherV2 {
+	return &cacherV2Adapter{c: c}
+}
+
+type cacherV2Adapter struct {
+	c Cacher
+}
+
+func (a *cacherV2Adapter) Load(ctx context.Context, key string, req *http.Request) (*Entry, error) {
+	cachedReq, cachedRes, err := a.c.Load(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{
+		Key:      key,
+		Request:  cachedReq,
+		Response: cachedRes,
+	}, nil
+}
+
+func (a *cacherV2Adapter) Store(ctx context.Context, key string, e *Entry) error {
+	return a.c.Store(e.Request.WithContext(ctx), e.Response, e.Expires)
+}
+
+// FromCacherV2 returns the Cacher that uses the CacherV2.
+// The middleware detects it and uses the CacherV2 directly with the context of the request, the cache key and the metadata.
+// The optional interfaces are detected on c by their methods other than Load and Store (e.g. Invalidate of Invalidator and StoreStream of StreamingCacher) because c cannot implement Cacher.
+// Handler and VaryNormalizingHandler implemented by c are also used.
+func FromCacherV2(c CacherV2) Cacher {
+	return &cacherV2Wrapper{v2: c}
+}
+
+type cacherV2Wrapper struct {
+	v2 CacherV2
+}
+
+func (w *cacherV2Wrapper) Load(req *http.Request) (*http.Request, *http.Response, error) {
+	e, err := loadEntry(w.v2, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e.Request, e.Response, nil
+}
+
+func (w *cacherV2Wrapper) Store(req *http.Request, res *http.Response, expires time.Time) error {
+	return storeEntry(w.v2, req, res, expires)
+}
+
+// loadEntry loads the entry for req with the context and the cache key of req.
+// The times of the entry are set to the context of the stored request (see rfc9111.ContextWithResponseTimes).
+func loadEntry(c CacherV2, req *http.Request) (*Entry, error) {
+	e, err := c.Load(req.Context(), cacheKeyOf(req), req)
+	if err != nil {
+		return nil, err
+	}
+	if e == nil || e.Response == nil {
+		return nil, ErrCacheNotFound
+	}
+	if e.Request != nil && !e.RequestTime.IsZero() && !e.ResponseTime.IsZero() {
+		// The Handler calculates the exact age of the stored response with the times.
+		e.Request = e.Request.WithContext(rfc9111.ContextWithResponseTimes(e.Request.Context(), e.RequestTime, e.ResponseTime))
+	}
+	return e, nil
+}
+
+// storeEntry stores the response for req with the metadata.
+func storeEntry(c CacherV2, req *http.Request, res *http.Response, expires time.Time) error {
+	key := cacheKeyOf(req)
+	e := &Entry{
+		Key:      key,
+		Request:  req,
+		Response: res,
+		Expires:  expires,
+		StoredAt: time.Now(),
+	}
+	if requestTime, responseTime, ok := ExchangeTimes(req); ok {
+		e.RequestTime, e.ResponseTime = requestTime, responseTime
+	}
+	return c.Store(context.WithoutCancel(req.Context()), key, e)
+}
+
+// cacheKeyOf returns the cache key of req.
+// If the KeyFunc is not set (see WithKeyFunc), the key is the method and the target URI.
+func cacheKeyOf(req *http.Request) string {
+	if key, ok := CacheKey(req); ok {
+		return key
+	}
+	const sep = "|"
+	return req.Method + sep + req.Host + sep + req.URL.Path + sep + req.URL.RawQuery
+}
+
+type exchangeTimesKey struct{}
+
+// exchangeTimes are the times of the request to the origin and its response.
+type exchangeTimes struct {
+	request  time.Time
+	response time.Time
+}
+
+// ExchangeTimes returns the time when the request to the origin was made and the time when its response was received (request_time and response_time in https://www.rfc-editor.org/rfc/rfc9111#section-4.2.3).
+// The times are set to req given to the store methods of the Cacher (e.g. Store, StoreVariant and StoreSlice).
+// Cacher implementations can store them with the response and set them to the context of the loaded request with rfc9111.ContextWithResponseTimes so that the Handler calculates the exact age of the stored response.
+// It returns false if the times are not set.
+func ExchangeTimes(req *http.Request) (requestTime, responseTime time.Time, ok bool) {
+	t, ok := req.Context().Value(exchangeTimesKey{}).(exchangeTimes)
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	return t.request, t.response, true
+}
+
+// withExchangeTimes returns a copy of reqc in which the times of the request to the origin and its response are set to be stored with the response.
+func withExchangeTimes(reqc *http.Request, requestTime, responseTime time.Time) *http.Request {
+	return reqc.WithContext(context.WithValue(reqc.Context(), exchangeTimesKey{}, exchangeTimes{request: requestTime, response: responseTime}))
+}
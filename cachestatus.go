@@ -0,0 +1,93 @@
+package rc
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/2manymws/rc/rfc9111"
+)
+
+const (
+	cacheStatusFieldName   = "Cache-Status"
+	defaultCacheIdentifier = "rc"
+)
+
+// tokenRe is the pattern of sf-token (https://www.rfc-editor.org/rfc/rfc9651#section-3.3.4).
+var tokenRe = regexp.MustCompile("^[A-Za-z*][A-Za-z0-9!#$%&'*+\\-.^_`|~:/]*$")
+
+// withCacheStatus returns a copy of req in which the CacheStatus is set if the Cache-Status header field is enabled.
+func (m *cacheMw) withCacheStatus(req *http.Request) (*http.Request, *rfc9111.CacheStatus) {
+	if m.cacheStatusName == "" {
+		return req, nil
+	}
+	cs := &rfc9111.CacheStatus{}
+	return req.WithContext(rfc9111.ContextWithCacheStatus(req.Context(), cs)), cs
+}
+
+// addCacheStatus adds the member of the cache of the middleware to the Cache-Status header field (https://www.rfc-editor.org/rfc/rfc9211).
+// The member is appended so that the members of the upstream caches come first.
+func (m *cacheMw) addCacheStatus(h http.Header, cs *rfc9111.CacheStatus, cacheUsed, hasStored bool, now time.Time) {
+	if m.cacheStatusName == "" || cs == nil {
+		return
+	}
+	params := []string{cacheIdentifier(m.cacheStatusName)}
+	fwd := cs.Forward
+	if cacheUsed && fwd == "" {
+		params = append(params, "hit")
+	} else {
+		if fwd == "" {
+			// The Handler did not report the reason.
+			fwd = rfc9111.ForwardURIMiss
+			if hasStored {
+				fwd = rfc9111.ForwardMiss
+			}
+		}
+		params = append(params, "fwd="+string(fwd))
+		if cs.ForwardStatus != 0 {
+			params = append(params, "fwd-status="+strconv.Itoa(cs.ForwardStatus))
+		}
+	}
+	if !cs.Expires.IsZero() {
+		params = append(params, "ttl="+strconv.Itoa(int(cs.Expires.Sub(now)/time.Second)))
+	}
+	if cs.Stored {
+		params = append(params, "stored")
+	}
+	if cs.Collapsed {
+		params = append(params, "collapsed")
+	}
+	h.Add(cacheStatusFieldName, strings.Join(params, "; "))
+}
+
+// cacheIdentifier returns the cache identifier as sf-token or sf-string (https://www.rfc-editor.org/rfc/rfc9211#section-2).
+func cacheIdentifier(name string) string {
+	if tokenRe.MatchString(name) {
+		return name
+	}
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + r.Replace(name) + `"`
+}
+
+// recordStored reports that the response from the origin is stored to the CacheStatus of the request.
+func recordStored(req *http.Request, expires time.Time) {
+	if isBackground(req) {
+		return
+	}
+	if cs, ok := rfc9111.CacheStatusFromContext(req.Context()); ok {
+		cs.Stored = true
+		cs.Expires = expires
+	}
+}
+
+// recordCollapsed reports that the request is collapsed with another request to the CacheStatus of the request.
+func recordCollapsed(req *http.Request) {
+	if isBackground(req) {
+		return
+	}
+	if cs, ok := rfc9111.CacheStatusFromContext(req.Context()); ok {
+		cs.Collapsed = true
+	}
+}
@@ -0,0 +1,185 @@
+package rc
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/2manymws/rc/rfc9111"
+)
+
+// testHookCoalescerWait is called when a request starts waiting for the in-flight request with the same key.
+var testHookCoalescerWait = func() {}
+
+// coalescer collapses concurrent origin requests for the same key into one (like proxy_cache_lock of NGINX).
+type coalescer struct {
+	calls map[string]*coalescedCall
+	// normalizeVary normalizes the request header fields nominated by the Vary header field to match the requests.
+	normalizeVary func(name string, values []string) (string, bool)
+	// capture enables to capture the response body while it is read by the leader (for streaming).
+	// Otherwise, the response body is read at once.
+	capture     bool
+	maxBodySize int64
+	mu          sync.Mutex
+}
+
+// coalescedCall is an in-flight origin request shared by the requests with the same key.
+type coalescedCall struct {
+	done chan struct{}
+	// req is the request of the leader.
+	req *http.Request
+	// shareable reports whether the response can be shared with the waiters (the response is storable).
+	shareable  bool
+	statusCode int
+	header     http.Header
+	body       []byte
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{
+		calls: map[string]*coalescedCall{},
+	}
+}
+
+// do calls fn only once for concurrent requests with the same key.
+// The first request (leader) calls fn, and the others (waiters) wait for it and receive a copy of the response.
+// If the response of the leader is not storable or fn returns an error, the waiters call fn by themselves.
+// If the request header fields nominated by Vary do not match, the waiters are coalesced again among themselves.
+// The waiter stops waiting when the context of its request is done.
+func (c *coalescer) do(req *http.Request, key string, fn func() (res *http.Response, shareable bool, err error)) (*http.Response, error) {
+	c.mu.Lock()
+	for {
+		cl, ok := c.calls[key]
+		if !ok {
+			break
+		}
+		c.mu.Unlock()
+		testHookCoalescerWait()
+		select {
+		case <-cl.done:
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if !cl.shareable {
+			res, _, err := fn()
+			return res, err
+		}
+		if varyMatched(c.normalizeVary, cl.header, req, cl.req) {
+			return cl.response(), nil
+		}
+		c.mu.Lock()
+	}
+	cl := &coalescedCall{
+		done: make(chan struct{}),
+		req:  req,
+	}
+	c.calls[key] = cl
+	c.mu.Unlock()
+
+	release := func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(cl.done)
+	}
+	released := false
+	defer func() {
+		// Waiters are released even if fn panics.
+		if !released {
+			release()
+		}
+	}()
+
+	res, shareable, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	if !shareable || !varyMatched(c.normalizeVary, res.Header, req, req) {
+		// Vary: * never matches.
+		return res, nil
+	}
+	cl.statusCode = res.StatusCode
+	cl.header = res.Header.Clone()
+	if c.capture {
+		// The waiters are released when the leader finishes reading the response body.
+		released = true
+		res.Body = &captureBody{
+			body:    res.Body,
+			maxSize: c.maxBodySize,
+			done: func(b []byte, ok bool) {
+				cl.body = b
+				cl.shareable = ok
+				release()
+			},
+		}
+		return res, nil
+	}
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := res.Body.Close(); err != nil {
+		return nil, err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(b))
+	cl.body = b
+	cl.shareable = true
+	return res, nil
+}
+
+// response returns a copy of the response of the leader.
+func (cl *coalescedCall) response() *http.Response {
+	return &http.Response{
+		Status:        http.StatusText(cl.statusCode),
+		StatusCode:    cl.statusCode,
+		Header:        cl.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(cl.body)),
+		ContentLength: int64(len(cl.body)),
+	}
+}
+
+// requestKey returns the key that identifies the resource requested.
+func requestKey(req *http.Request) string {
+	const sep = "|"
+	key := req.Method + sep + req.Host + sep + req.URL.Path + sep + req.URL.RawQuery
+	if k, ok := CacheKey(req); ok {
+		// The KeyFunc may not distinguish the methods.
+		key = req.Method + sep + k
+	}
+	if index, ok := sliceIndex(req); ok {
+		key += sep + strconv.FormatInt(index, 10)
+	}
+	return key
+}
+
+// varyMatched returns true if the request header fields nominated by the Vary header field of the response match after the normalization (see VaryNormalizingHandler).
+func varyMatched(normalize func(name string, values []string) (string, bool), resHeader http.Header, req, otherReq *http.Request) bool {
+	for _, v := range resHeader.Values("Vary") {
+		for _, h := range strings.Split(v, ",") {
+			h = strings.TrimSpace(h)
+			if h == "" {
+				continue
+			}
+			if h == "*" {
+				return false
+			}
+			v1, ok1 := normalize(h, req.Header.Values(h))
+			v2, ok2 := normalize(h, otherReq.Header.Values(h))
+			if ok1 != ok2 || v1 != v2 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// normalizeVaryField is the normalization of the request header field nominated by the Vary header field used when the Handler does not implement VaryNormalizingHandler.
+func normalizeVaryField(name string, values []string) (string, bool) {
+	if len(values) == 0 {
+		return "", false
+	}
+	return rfc9111.NormalizeFieldValues(values), true
+}
@@ -0,0 +1,61 @@
+package rc
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/2manymws/rc/rfc9111"
+)
+
+// decisionRecorder records the decisions of the Handler for a request.
+type decisionRecorder struct {
+	decisions []rfc9111.Decision
+	mu        sync.Mutex
+}
+
+// withDecisionHook returns copies of req and reqc in which the hook that receives the decisions of the Handler is set.
+// The decisions are logged, passed to the hook of the middleware and recorded for the debug header field.
+func (m *cacheMw) withDecisionHook(req, reqc *http.Request) (*http.Request, *http.Request, *decisionRecorder) {
+	rec := &decisionRecorder{}
+	hook := func(d rfc9111.Decision) {
+		m.logger.Debug("cache decision", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.String("reason", string(d.Reason)), slog.String("section", d.Section), slog.Duration("lifetime", d.Lifetime))
+		if m.decisionHook != nil {
+			m.decisionHook(reqc, d)
+		}
+		if m.decisionHeaderName != "" {
+			rec.mu.Lock()
+			rec.decisions = append(rec.decisions, d)
+			rec.mu.Unlock()
+		}
+	}
+	return req.WithContext(rfc9111.ContextWithDecisionHook(req.Context(), hook)), reqc.WithContext(rfc9111.ContextWithDecisionHook(reqc.Context(), hook)), rec
+}
+
+// setDecisionHeader sets the debug header field that lists the decisions of the Handler.
+// e.g. `fresh; section="RFC 9111 Section 4.2"; lifetime=60`
+func (m *cacheMw) setDecisionHeader(h http.Header, rec *decisionRecorder) {
+	if m.decisionHeaderName == "" {
+		return
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.decisions) == 0 {
+		return
+	}
+	members := make([]string, 0, len(rec.decisions))
+	for _, d := range rec.decisions {
+		params := []string{string(d.Reason)}
+		if d.Section != "" {
+			params = append(params, "section="+strconv.Quote(d.Section))
+		}
+		if d.Lifetime > 0 {
+			params = append(params, "lifetime="+strconv.Itoa(int(d.Lifetime/time.Second)))
+		}
+		members = append(members, strings.Join(params, "; "))
+	}
+	h.Set(m.decisionHeaderName, strings.Join(members, ", "))
+}
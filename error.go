@@ -12,3 +12,6 @@ var ErrShouldNotUseCache error = errors.New("should not use cache")
 
 // ErrCacheExpired is returned if the cache is expired.
 var ErrCacheExpired error = errors.New("cache expired")
+
+// ErrObjectTooLarge is returned if the response body exceeds the maximum object size.
+var ErrObjectTooLarge error = errors.New("object too large")
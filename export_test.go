@@ -0,0 +1,10 @@
+package rc
+
+// SetTestHookCoalescerWait sets the hook called when a request starts waiting for the coalesced request and returns the function to restore it.
+func SetTestHookCoalescerWait(f func()) (restore func()) {
+	prev := testHookCoalescerWait
+	testHookCoalescerWait = f
+	return func() {
+		testHookCoalescerWait = prev
+	}
+}
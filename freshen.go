@@ -0,0 +1,100 @@
+package rc
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/2manymws/rc/rfc9111"
+)
+
+// headAsGet returns a copy of the HEAD request as GET to load and store the response to GET.
+// The stored response to GET can be used for HEAD (https://www.rfc-editor.org/rfc/rfc9110#section-9.3.2).
+func headAsGet(req *http.Request) *http.Request {
+	r := req.Clone(req.Context())
+	r.Method = http.MethodGet
+	return r
+}
+
+// usesStoredGet reports whether the stored response to GET is used for the HEAD request.
+func usesStoredGet(reqc, cachedReq *http.Request) bool {
+	return reqc.Method == http.MethodHead && cachedReq != nil && cachedReq.Method == http.MethodGet
+}
+
+// storedForHead returns the request to store the stored response again (e.g. freshened).
+// If the stored response to GET is used for the HEAD request, it is the request as GET.
+func storedForHead(reqc, cachedReq *http.Request) *http.Request {
+	if usesStoredGet(reqc, cachedReq) {
+		return headAsGet(reqc)
+	}
+	return reqc
+}
+
+// notModifiedRecorder returns the origin requester that records the header of the 304 (Not Modified) response to the validation of the stored response.
+func notModifiedRecorder(do func(*http.Request) (*http.Response, error), notModified *http.Header) func(*http.Request) (*http.Response, error) {
+	return func(req *http.Request) (*http.Response, error) {
+		res, err := do(req)
+		if err == nil && res != nil && res.StatusCode == http.StatusNotModified && !isBackground(req) {
+			*notModified = res.Header.Clone()
+		}
+		return res, err
+	}
+}
+
+// freshen stores the stored response again with the header fields updated by the 304 response of the validation (https://www.rfc-editor.org/rfc/rfc9111#section-4.3.4).
+// storedHeader is the header of the stored response before it is handled.
+// If res is the stored response, it is stored while it is written to the client.
+func (m *cacheMw) freshen(reqc *http.Request, cachedRes *http.Response, storedHeader, notModified http.Header, res *http.Response, now time.Time) {
+	if !rfc9111.FreshenHeader(storedHeader, notModified) {
+		m.logger.Debug("cache not freshened", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Any("response_headers", m.maskHeader(notModified)))
+		return
+	}
+	m.storeFreshened(reqc, cachedRes, storedHeader, res, now)
+}
+
+// freshenWithHead updates the stored response to GET with the 200 response to HEAD (https://www.rfc-editor.org/rfc/rfc9111#section-4.3.5).
+// If the stored response does not match the response to HEAD (e.g. ETag or Content-Length differs), it is invalidated as stale.
+// reqc is the request to GET (see headAsGet).
+func (m *cacheMw) freshenWithHead(reqc *http.Request, cachedRes *http.Response, storedHeader http.Header, head *http.Response, now time.Time) {
+	if !rfc9111.FreshenHeaderWithHead(storedHeader, head.Header, cachedRes.ContentLength) {
+		if m.cacher.Invalidate == nil {
+			m.logger.Debug("cache not freshened", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Any("response_headers", m.maskHeader(head.Header)))
+			return
+		}
+		m.invalidate(reqc, head.StatusCode, http.Header{})
+		return
+	}
+	m.storeFreshened(reqc, cachedRes, storedHeader, head, now)
+}
+
+// storeFreshened stores the stored response again with the updated header.
+func (m *cacheMw) storeFreshened(reqc *http.Request, cachedRes *http.Response, storedHeader http.Header, res *http.Response, now time.Time) {
+	resc := &http.Response{
+		Status:        cachedRes.Status,
+		StatusCode:    cachedRes.StatusCode,
+		Header:        storedHeader,
+		Body:          http.NoBody,
+		ContentLength: cachedRes.ContentLength,
+		Trailer:       cachedRes.Trailer,
+	}
+	ok, expires := m.cacher.Storable(reqc, resc, now)
+	if !ok {
+		m.logger.Debug("cache not storable", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", resc.StatusCode), slog.Any("response_headers", m.maskHeader(resc.Header)))
+		return
+	}
+	resc.Header = m.cacher.StoredHeader(resc)
+	body := &teeBody{
+		body:      cachedRes.Body,
+		sink:      m.storeSink(withExchangeTimes(reqc, now, time.Now()), resc, expires),
+		maxSize:   m.maxObjectSize,
+		cacheable: func() bool { return true },
+	}
+	if res == cachedRes {
+		res.Body = body
+		return
+	}
+	// The response to the client does not contain the stored body (e.g. 304 to the conditional request).
+	_, _ = io.Copy(io.Discard, body) //nostyle:handlerrors
+	_ = body.Close()                 //nostyle:handlerrors
+}
@@ -1,13 +1,22 @@
 package rc
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/2manymws/rc/rfc9111"
+	"github.com/google/go-cmp/cmp"
 )
 
 func TestDuplicateRequest(t *testing.T) {
@@ -149,3 +158,419 @@ func TestMaskHeader(t *testing.T) {
 		})
 	}
 }
+
+func TestRevalidator(t *testing.T) {
+	r := newRevalidator()
+	r.workers = 1
+	r.queueSize = 1
+	var (
+		mu      sync.Mutex
+		results = map[string]RevalidationResult{}
+		wg      sync.WaitGroup
+	)
+	r.done = func(req *http.Request, result RevalidationResult, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		results[req.URL.Path] = result
+		wg.Done()
+	}
+	release := make(chan struct{})
+	var calls atomic.Int64
+	do := func(req *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		<-release
+		if req.Context().Err() != nil {
+			return nil, req.Context().Err()
+		}
+		if req.URL.Path == "/error" {
+			return &http.Response{StatusCode: http.StatusInternalServerError, Body: http.NoBody}, nil
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	wg.Add(3)
+	r.Revalidate(httptest.NewRequest(http.MethodGet, "http://example.com/a", nil).WithContext(ctx), do)
+	// Deduplicated
+	r.Revalidate(httptest.NewRequest(http.MethodGet, "http://example.com/a", nil), do)
+	// Queued
+	r.Revalidate(httptest.NewRequest(http.MethodGet, "http://example.com/error", nil), do)
+	// Dropped
+	r.Revalidate(httptest.NewRequest(http.MethodGet, "http://example.com/c", nil), do)
+	// The revalidation is detached from the request context.
+	cancel()
+	close(release)
+	wg.Wait()
+
+	want := map[string]RevalidationResult{
+		"/a":     RevalidationSucceeded,
+		"/error": RevalidationFailed,
+		"/c":     RevalidationDropped,
+	}
+	if diff := cmp.Diff(want, results); diff != "" {
+		t.Error(diff)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("got %v want %v", got, 2)
+	}
+}
+
+func TestWithRevalidation(t *testing.T) {
+	tests := []struct {
+		name          string
+		workers       int
+		queueSize     int
+		timeout       time.Duration
+		wantWorkers   int
+		wantQueueSize int
+		wantTimeout   time.Duration
+	}{
+		{"valid", 2, 10, time.Second, 2, 10, time.Second},
+		{"zero workers", 0, 10, time.Second, defaultRevalidationWorkers, 10, time.Second},
+		{"negative workers", -1, 10, time.Second, defaultRevalidationWorkers, 10, time.Second},
+		{"zero queue size", 2, 0, time.Second, 2, 0, time.Second},
+		{"negative queue size", 2, -1, time.Second, 2, defaultRevalidationQueueSize, time.Second},
+		{"zero timeout", 2, 10, 0, 2, 10, defaultRevalidationTimeout},
+		{"negative timeout", 2, 10, -time.Second, 2, 10, defaultRevalidationTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &cacheMw{revalidator: newRevalidator()}
+			WithRevalidation(tt.workers, tt.queueSize, tt.timeout)(m)
+			if got := m.revalidator.workers; got != tt.wantWorkers {
+				t.Errorf("got %v workers want %v", got, tt.wantWorkers)
+			}
+			if got := m.revalidator.queueSize; got != tt.wantQueueSize {
+				t.Errorf("got %v queue size want %v", got, tt.wantQueueSize)
+			}
+			if got := m.revalidator.timeout; got != tt.wantTimeout {
+				t.Errorf("got %v timeout want %v", got, tt.wantTimeout)
+			}
+		})
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	tests := []struct {
+		name          string
+		h             http.HandlerFunc
+		wantStatus    int
+		wantHeader    http.Header
+		wantBody      string
+		wantTrailer   http.Header
+		wantCacheable bool
+	}{
+		{
+			"implicit 200",
+			func(w http.ResponseWriter, r *http.Request) {},
+			http.StatusOK,
+			http.Header{},
+			"",
+			nil,
+			true,
+		},
+		{
+			"implicit 200 with Write and sniffed Content-Type",
+			func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("<html><body>hello</body></html>"))
+			},
+			http.StatusOK,
+			http.Header{"Content-Type": []string{"text/html; charset=utf-8"}},
+			"<html><body>hello</body></html>",
+			nil,
+			true,
+		},
+		{
+			"Content-Type: nil suppresses sniffing",
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header()["Content-Type"] = nil
+				_, _ = w.Write([]byte("<html><body>hello</body></html>"))
+			},
+			http.StatusOK,
+			http.Header{"Content-Type": nil},
+			"<html><body>hello</body></html>",
+			nil,
+			true,
+		},
+		{
+			"header after WriteHeader is ignored",
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(http.StatusNotFound)
+				w.Header().Set("X-After", "ignored")
+				_, _ = w.Write([]byte("not found"))
+			},
+			http.StatusNotFound,
+			http.Header{"Content-Type": []string{"text/plain"}},
+			"not found",
+			nil,
+			true,
+		},
+		{
+			"trailers",
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Trailer", "X-Checksum")
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write([]byte("hello"))
+				w.Header().Set("X-Checksum", "abc")
+				w.Header().Set(http.TrailerPrefix+"X-Extra", "def")
+			},
+			http.StatusOK,
+			http.Header{"Content-Type": []string{"text/plain"}, "Trailer": []string{"X-Checksum"}},
+			"hello",
+			http.Header{"X-Checksum": []string{"abc"}, "X-Extra": []string{"def"}},
+			true,
+		},
+		{
+			"informational response is not recorded",
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				w.WriteHeader(http.StatusEarlyHints)
+				w.WriteHeader(http.StatusCreated)
+				_, _ = w.Write([]byte("created"))
+			},
+			http.StatusCreated,
+			http.Header{"Content-Type": []string{"text/plain"}},
+			"created",
+			nil,
+			true,
+		},
+		{
+			"ReadFrom",
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain")
+				_, _ = io.Copy(w, strings.NewReader("hello"))
+			},
+			http.StatusOK,
+			http.Header{"Content-Type": []string{"text/plain"}},
+			"hello",
+			nil,
+			true,
+		},
+		{
+			"flushed",
+			func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				_, _ = w.Write([]byte("data: hello\n\n"))
+				if err := http.NewResponseController(w).Flush(); err != nil {
+					t.Error(err)
+				}
+			},
+			http.StatusOK,
+			http.Header{"Content-Type": []string{"text/event-stream"}},
+			"",
+			nil,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cw := &clientWriter{ResponseWriter: httptest.NewRecorder()}
+			rec := newRecorder(cw)
+			tt.h(rec, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+			rec.finish()
+			got := rec.Result()
+			if got.StatusCode != tt.wantStatus {
+				t.Errorf("got %v want %v", got.StatusCode, tt.wantStatus)
+			}
+			if diff := cmp.Diff(tt.wantHeader, got.Header); diff != "" {
+				t.Error(diff)
+			}
+			b, err := io.ReadAll(got.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.wantBody {
+				t.Errorf("got %q want %q", b, tt.wantBody)
+			}
+			if diff := cmp.Diff(tt.wantTrailer, got.Trailer); diff != "" {
+				t.Error(diff)
+			}
+			if rec.cacheable() != tt.wantCacheable {
+				t.Errorf("got %v want %v", rec.cacheable(), tt.wantCacheable)
+			}
+			if cw.written == tt.wantCacheable {
+				t.Errorf("got %v want %v", cw.written, !tt.wantCacheable)
+			}
+		})
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		v       string
+		size    int64
+		want    []byteRange
+		wantErr error
+	}{
+		{"bytes=0-499", 1000, []byteRange{{0, 500}}, nil},
+		{"bytes=500-999", 1000, []byteRange{{500, 500}}, nil},
+		{"bytes=500-", 1000, []byteRange{{500, 500}}, nil},
+		{"bytes=-500", 1000, []byteRange{{500, 500}}, nil},
+		{"bytes=-5000", 1000, []byteRange{{0, 1000}}, nil},
+		{"bytes=900-5000", 1000, []byteRange{{900, 100}}, nil},
+		{"bytes=0-0, -1", 1000, []byteRange{{0, 1}, {999, 1}}, nil},
+		{"Bytes = 0-9 , 20-29", 1000, []byteRange{{0, 10}, {20, 10}}, nil},
+		{"bytes=1000-, 0-9", 1000, []byteRange{{0, 10}}, nil},
+		{"bytes=1000-", 1000, nil, errUnsatisfiableRange},
+		{"bytes=-0", 1000, nil, errUnsatisfiableRange},
+		{"bytes=0-", 0, nil, errUnsatisfiableRange},
+		{"bytes=10-0", 1000, nil, errInvalidRange},
+		{"bytes=a-b", 1000, nil, errInvalidRange},
+		{"bytes=10", 1000, nil, errInvalidRange},
+		{"items=0-9", 1000, nil, errInvalidRange},
+		{"bytes=0-999, 0-999", 1000, nil, errInvalidRange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.v, func(t *testing.T) {
+			got, err := parseRange(tt.v, tt.size)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %v want %v", err, tt.wantErr)
+			}
+			if diff := cmp.Diff(tt.want, got, cmp.AllowUnexported(byteRange{})); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestReadRanges(t *testing.T) {
+	const data = "0123456789abcdefghij"
+	tests := []struct {
+		name     string
+		ranges   []byteRange
+		want     []string
+		wantRest string
+	}{
+		{"in order", []byteRange{{0, 2}, {5, 3}}, []string{"01", "567"}, "89abcdefghij"},
+		{"out of order", []byteRange{{10, 2}, {1, 2}}, []string{"ab", "12"}, "cdefghij"},
+		{"overlapping", []byteRange{{2, 4}, {4, 4}, {3, 1}}, []string{"2345", "4567", "3"}, "89abcdefghij"},
+		{"adjoining", []byteRange{{0, 2}, {2, 2}}, []string{"01", "23"}, "456789abcdefghij"},
+		{"to the end", []byteRange{{18, 2}, {0, 1}}, []string{"ij", "0"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := strings.NewReader(data)
+			parts, err := readRanges(body, tt.ranges)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, p := range parts {
+				got = append(got, string(p))
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Error(diff)
+			}
+			// The data after the last range is not read.
+			rest, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(rest) != tt.wantRest {
+				t.Errorf("got %q want %q", rest, tt.wantRest)
+			}
+		})
+	}
+}
+
+func TestVariantKey(t *testing.T) {
+	s, err := rfc9111.NewShared(rfc9111.VaryNormalizers(map[string]rfc9111.VaryNormalizer{"Accept-Encoding": rfc9111.AcceptEncodingNormalizer("br", "gzip")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		normalize func(name string, values []string) (string, bool)
+		vary      []string
+		reqHeader http.Header
+		want      string
+		wantOK    bool
+	}{
+		{"no Vary", normalizeVaryField, nil, http.Header{}, "", false},
+		{"wildcard", normalizeVaryField, []string{"Accept-Encoding, *"}, http.Header{}, "", false},
+		{"single field", normalizeVaryField, []string{"accept-encoding"}, http.Header{"Accept-Encoding": []string{"gzip,  br"}}, "Accept-Encoding: gzip, br", true},
+		{"absent field", normalizeVaryField, []string{"Accept-Encoding"}, http.Header{}, "Accept-Encoding", true},
+		{"empty field", normalizeVaryField, []string{"Accept-Encoding"}, http.Header{"Accept-Encoding": []string{""}}, "Accept-Encoding: ", true},
+		{"multiple fields", normalizeVaryField, []string{"Accept-Encoding", "Accept-Language, accept-encoding"}, http.Header{"Accept-Language": []string{"ja"}}, "Accept-Encoding\nAccept-Language: ja", true},
+		{"normalizer", s.NormalizeVaryField, []string{"Accept-Encoding, Accept-Language"}, http.Header{"Accept-Encoding": []string{"gzip, deflate"}, "Accept-Language": []string{"ja"}}, "Accept-Encoding: gzip\nAccept-Language: ja", true},
+		{"absent field with normalizer", s.NormalizeVaryField, []string{"Accept-Encoding"}, http.Header{}, "Accept-Encoding: identity", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			req.Header = tt.reqHeader
+			got, ok := variantKey(tt.normalize, http.Header{"Vary": tt.vary}, req)
+			if ok != tt.wantOK {
+				t.Errorf("got %v want %v", ok, tt.wantOK)
+			}
+			if got != tt.want {
+				t.Errorf("got %q want %q", got, tt.want)
+			}
+			if ok {
+				if diff := cmp.Diff(variantKeyOf(tt.normalize, variantNames(got), req), got); diff != "" {
+					t.Error(diff)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreVariantConcurrently(t *testing.T) {
+	const maxVariants = 2
+	var (
+		variants []string
+		mu       sync.Mutex
+	)
+	m := &cacheMw{
+		cacher: &cacher{
+			Variants: func(req *http.Request) ([]string, error) {
+				mu.Lock()
+				vs := append([]string(nil), variants...)
+				mu.Unlock()
+				// Widen the window between listing and storing the variants.
+				time.Sleep(time.Millisecond)
+				return vs, nil
+			},
+			StoreVariant: func(req *http.Request, res *http.Response, variant string, expires time.Time) error {
+				mu.Lock()
+				defer mu.Unlock()
+				variants = append(variants, variant)
+				return nil
+			},
+			DeleteVariant: func(req *http.Request, variant string) error {
+				mu.Lock()
+				defer mu.Unlock()
+				for i, v := range variants {
+					if v == variant {
+						variants = append(variants[:i], variants[i+1:]...)
+						break
+					}
+				}
+				return nil
+			},
+		},
+		logger:      slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		maxVariants: maxVariants,
+	}
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}
+	var wg sync.WaitGroup
+	for i := range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := m.storeVariant(req, res, fmt.Sprintf("Accept-Encoding: %d", i), time.Now().Add(time.Minute)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := len(variants); got != maxVariants {
+		t.Errorf("got %d variants want %d", got, maxVariants)
+	}
+	if got := len(m.variantLocks.locks); got != 0 {
+		t.Errorf("got %d locks want 0", got)
+	}
+}
@@ -0,0 +1,94 @@
+package rc
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+)
+
+// isSafeMethod reports whether the method is safe (https://www.rfc-editor.org/rfc/rfc9110#section-9.2.1).
+// Methods whose safety is unknown are unsafe.
+func isSafeMethod(method string) bool {
+	return contains([]string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace}, method)
+}
+
+// invalidate invalidates the stored responses when the response to the unsafe request has a non-error status code (https://www.rfc-editor.org/rfc/rfc9111#section-4.4).
+// The target URI and the URIs in the Location and Content-Location header fields on the same host are invalidated.
+func (m *cacheMw) invalidate(reqc *http.Request, statusCode int, h http.Header) {
+	// A non-error status code is 2xx or 3xx.
+	if statusCode < http.StatusOK || statusCode >= http.StatusBadRequest {
+		return
+	}
+	reqs := []*http.Request{reqc}
+	for _, k := range []string{"Location", "Content-Location"} {
+		v := h.Get(k)
+		if v == "" {
+			continue
+		}
+		u, err := url.Parse(v)
+		if err != nil {
+			continue
+		}
+		// A cache MUST NOT invalidate a URI from a Location or Content-Location response header field if the host part of that URI differs from the host part in the target URI.
+		if u.Host != "" && u.Host != reqc.Host {
+			continue
+		}
+		u = reqc.URL.ResolveReference(u)
+		if u.Path == reqc.URL.Path && u.RawQuery == reqc.URL.RawQuery {
+			continue
+		}
+		r := reqc.Clone(reqc.Context())
+		r.URL = u
+		reqs = append(reqs, r)
+	}
+	for _, r := range reqs {
+		if err := m.cacher.Invalidate(r); err != nil {
+			m.logger.Error("failed to invalidate cache", slog.String("error", err.Error()), slog.String("host", r.Host), slog.String("method", r.Method), slog.String("url", r.URL.String()), slog.Any("headers", m.maskHeader(r.Header)), slog.Int("status", statusCode))
+			continue
+		}
+		m.logger.Debug("cache invalidated", slog.String("host", r.Host), slog.String("method", r.Method), slog.String("url", r.URL.String()), slog.Any("headers", m.maskHeader(r.Header)), slog.Int("status", statusCode))
+	}
+}
+
+// invalidatingWriter is a http.ResponseWriter that invalidates the stored responses when the final status code is written.
+// It is used when the response is not handled by the cache (ErrShouldNotUseCache).
+type invalidatingWriter struct {
+	http.ResponseWriter
+	invalidate  func(statusCode int, h http.Header)
+	wroteHeader bool
+}
+
+func (w *invalidatingWriter) WriteHeader(statusCode int) {
+	if !w.wroteHeader && !isInformational(statusCode) {
+		w.wroteHeader = true
+		w.invalidate(statusCode, w.Header())
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *invalidatingWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *invalidatingWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	_ = http.NewResponseController(w.ResponseWriter).Flush() //nostyle:handlerrors
+}
+
+// finish invalidates the stored responses if the handler returned without writing the response (the status code is 200 implicitly).
+func (w *invalidatingWriter) finish() {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.invalidate(http.StatusOK, w.Header())
+	}
+}
+
+// Unwrap returns the response writer of the client for http.ResponseController.
+func (w *invalidatingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,262 @@
+package rc
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/2manymws/rc/rfc9111"
+)
+
+// KeyFunc returns the cache key of the request.
+// Requests with the same key are for the same resource (see WithKeyFunc).
+type KeyFunc func(req *http.Request) string
+
+// KeyPart returns a part of the cache key of the request (see KeyBuilder).
+type KeyPart func(req *http.Request) string
+
+// KeyBuilder returns the KeyFunc that composes the cache key from the parts in order.
+// e.g. KeyBuilder(KeyMethod(), KeyHost(), KeyPath(), KeyQuery("utm_*", "fbclid"))
+func KeyBuilder(parts ...KeyPart) KeyFunc {
+	return func(req *http.Request) string {
+		var b strings.Builder
+		for _, p := range parts {
+			v := p(req)
+			// Each part is prefixed with its length so that the parts are not ambiguous.
+			b.WriteString(strconv.Itoa(len(v)))
+			b.WriteByte(':')
+			b.WriteString(v)
+		}
+		return b.String()
+	}
+}
+
+// KeyMethod returns the KeyPart of the request method.
+func KeyMethod() KeyPart {
+	return func(req *http.Request) string {
+		return req.Method
+	}
+}
+
+// KeyScheme returns the KeyPart of the scheme of the target URI ("http" or "https").
+func KeyScheme() KeyPart {
+	return requestScheme
+}
+
+// KeyHost returns the KeyPart of the normalized host of the target URI.
+// The host is lowercased, and the trailing dot and the default port of the scheme are removed.
+func KeyHost() KeyPart {
+	return func(req *http.Request) string {
+		host := req.Host
+		if host == "" {
+			host = req.URL.Host
+		}
+		host = strings.ToLower(host)
+		h, port, err := net.SplitHostPort(host)
+		if err != nil {
+			h, port = host, ""
+		}
+		h = strings.TrimSuffix(h, ".")
+		scheme := requestScheme(req)
+		if port == "" || (scheme == "http" && port == "80") || (scheme == "https" && port == "443") {
+			return h
+		}
+		return net.JoinHostPort(h, port)
+	}
+}
+
+// KeyPath returns the KeyPart of the path of the target URI.
+func KeyPath() KeyPart {
+	return func(req *http.Request) string {
+		return req.URL.Path
+	}
+}
+
+// KeyQuery returns the KeyPart of the query of the target URI.
+// The query parameters are sorted by name, and the parameters whose names match ignore are removed.
+// A name in ignore that ends with "*" matches the names with the prefix (e.g. "utm_*").
+func KeyQuery(ignore ...string) KeyPart {
+	return func(req *http.Request) string {
+		var params []rfc9111.QueryParam
+		for _, p := range rfc9111.ParseQueryParams(req.URL.RawQuery) {
+			if matchName(p.Name, ignore) {
+				continue
+			}
+			params = append(params, p)
+		}
+		// The order of the values of the same name is kept.
+		sort.SliceStable(params, func(i, j int) bool {
+			return params[i].Name < params[j].Name
+		})
+		s := make([]string, 0, len(params))
+		for _, p := range params {
+			s = append(s, url.QueryEscape(p.Name)+"="+url.QueryEscape(p.Value))
+		}
+		return strings.Join(s, "&")
+	}
+}
+
+// KeyHeaders returns the KeyPart of the request header fields.
+// The values are normalized by rfc9111.NormalizeFieldValues, and the absent fields are distinguished from the empty fields.
+func KeyHeaders(names ...string) KeyPart {
+	return func(req *http.Request) string {
+		var s []string
+		for _, n := range names {
+			n = http.CanonicalHeaderKey(n)
+			v := req.Header.Values(n)
+			if len(v) == 0 {
+				continue
+			}
+			s = append(s, n+":"+rfc9111.NormalizeFieldValues(v))
+		}
+		return strings.Join(s, "\n")
+	}
+}
+
+// KeyCookies returns the KeyPart of the cookies of the request.
+// The cookies that are not listed in names are not a part of the key.
+func KeyCookies(names ...string) KeyPart {
+	return func(req *http.Request) string {
+		var s []string
+		for _, n := range names {
+			c, err := req.Cookie(n)
+			if err != nil {
+				continue
+			}
+			s = append(s, c.Name+"="+c.Value)
+		}
+		return strings.Join(s, "; ")
+	}
+}
+
+// KeyBody returns the KeyPart of the SHA-256 hash of the request body.
+// If req.GetBody is set, the body is read from the copy returned by it.
+// Otherwise, the request body is read and replaced with a copy, and req.GetBody is set to return another copy.
+// The middleware gives the handler (or the origin) the copy, so UseRequestBody is not required.
+func KeyBody() KeyPart {
+	return func(req *http.Request) string {
+		if req.Body == nil || req.Body == http.NoBody {
+			return ""
+		}
+		b, err := readBody(req)
+		if err != nil {
+			// The body that cannot be read does not match any body.
+			return "error"
+		}
+		sum := sha256.Sum256(b)
+		return hex.EncodeToString(sum[:])
+	}
+}
+
+// readBody reads the request body without consuming it for the other readers (see KeyBody).
+func readBody(req *http.Request) ([]byte, error) {
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(body)
+		_ = body.Close() //nostyle:handlerrors
+		return b, err
+	}
+	b, err := io.ReadAll(req.Body)
+	_ = req.Body.Close() //nostyle:handlerrors
+	req.Body = io.NopCloser(bytes.NewReader(b))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(b)), nil
+	}
+	return b, err
+}
+
+// requestScheme returns the scheme of the target URI of the request.
+func requestScheme(req *http.Request) string {
+	if req.URL.Scheme != "" {
+		return strings.ToLower(req.URL.Scheme)
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// matchName returns true if name matches one of the patterns.
+func matchName(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+			continue
+		}
+		if name == p {
+			return true
+		}
+	}
+	return false
+}
+
+type cacheKeyKey struct{}
+
+// cacheKey is the cache key computed for the request (method and URL).
+type cacheKey struct {
+	fn     KeyFunc
+	key    string
+	method string
+	url    string
+}
+
+// CacheKey returns the cache key of req computed by the KeyFunc of the middleware (see WithKeyFunc).
+// Cacher implementations can use it as the key of Load, Store and the other methods.
+// The key is computed once for the request, and it is computed again for the copy of the request whose method or URL is changed (e.g. the request as GET to load the stored response for HEAD).
+// It returns false if the KeyFunc is not set.
+func CacheKey(req *http.Request) (string, bool) {
+	k, ok := req.Context().Value(cacheKeyKey{}).(*cacheKey)
+	if !ok {
+		return "", false
+	}
+	if req.Method == k.method && req.URL.String() == k.url {
+		return k.key, true
+	}
+	return k.fn(req), true
+}
+
+// withCacheKey returns copies of req and reqc in which the cache key of reqc is set.
+// The Handler of the Cacher is also given the KeyFunc to check that the stored response is for the same resource.
+func (m *cacheMw) withCacheKey(req, reqc *http.Request) (*http.Request, *http.Request) {
+	if m.keyFunc == nil {
+		return req, reqc
+	}
+	body := reqc.Body
+	k := &cacheKey{
+		fn:     m.keyFunc,
+		key:    m.keyFunc(reqc),
+		method: reqc.Method,
+		url:    reqc.URL.String(),
+	}
+	if reqc.Body != body && req.Body == body {
+		// The KeyFunc read the request body shared with req (e.g. KeyBody without UseRequestBody), so req is given the copy of the body.
+		req.Body = reqc.Body
+		if reqc.GetBody != nil {
+			if b, err := reqc.GetBody(); err == nil {
+				req.Body = b
+			}
+		}
+	}
+	keyFunc := func(r *http.Request) string {
+		if key, ok := CacheKey(r); ok {
+			return key
+		}
+		return m.keyFunc(r)
+	}
+	ctx := rfc9111.ContextWithKeyFunc(context.WithValue(req.Context(), cacheKeyKey{}, k), keyFunc)
+	ctxc := context.WithValue(reqc.Context(), cacheKeyKey{}, k)
+	return req.WithContext(ctx), reqc.WithContext(ctxc)
+}
@@ -0,0 +1,364 @@
+package rc
+
+import (
+	"bytes"
+	"cmp"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// errInvalidRange is the error for the Range header field that is ignored (https://www.rfc-editor.org/rfc/rfc9110#section-14.2).
+	errInvalidRange = errors.New("invalid range")
+	// errUnsatisfiableRange is the error for the Range header field that none of the ranges is satisfiable (https://www.rfc-editor.org/rfc/rfc9110#section-14.1.1).
+	errUnsatisfiableRange = errors.New("unsatisfiable range")
+)
+
+// rangeRequest is the Range request of the client that is served from the full (200) response.
+type rangeRequest struct {
+	// rangeValue is the value of the Range header field (https://www.rfc-editor.org/rfc/rfc9110#section-14.2).
+	rangeValue string
+	// ifRange is the value of the If-Range header field (https://www.rfc-editor.org/rfc/rfc9110#section-13.1.5).
+	ifRange string
+}
+
+// byteRange is the satisfiable range of the representation data.
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// newRangeRequest returns the Range request of req or nil if req is not a Range request.
+func newRangeRequest(req *http.Request) *rangeRequest {
+	// A server MUST ignore a Range header field received with a request method that is unrecognized or for which range handling is not defined. For this specification, GET is the only method for which range handling is defined (https://www.rfc-editor.org/rfc/rfc9110#section-14.2).
+	if req.Method != http.MethodGet {
+		return nil
+	}
+	v := req.Header.Get("Range")
+	if v == "" {
+		return nil
+	}
+	return &rangeRequest{
+		rangeValue: v,
+		ifRange:    req.Header.Get("If-Range"),
+	}
+}
+
+// firstPos returns the first-pos of the first range of the Range request.
+// It returns 0 if the first range is a suffix-range or the Range request is invalid.
+func (rr *rangeRequest) firstPos() int64 {
+	_, set, _ := strings.Cut(rr.rangeValue, "=")
+	spec, _, _ := strings.Cut(set, ",")
+	first, _, _ := strings.Cut(strings.TrimSpace(spec), "-")
+	pos, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || pos < 0 {
+		return 0
+	}
+	return pos
+}
+
+// strip removes the Range and If-Range header fields from req so that the full response is requested and stored.
+func (rr *rangeRequest) strip(req *http.Request) {
+	req.Header.Del("Range")
+	req.Header.Del("If-Range")
+}
+
+// response returns the response to the Range request made from the full response res.
+// If the Range request is ignored (e.g. res is not 200 or If-Range does not match), res is returned as it is.
+// If the body of res is being stored as cache (see storingBody), the rest of it is read on close so that the storing is completed.
+// If an error is returned, the body of res is closed.
+func (rr *rangeRequest) response(res *http.Response) (*http.Response, error) {
+	if res.StatusCode != http.StatusOK || !rr.matchIfRange(res.Header) {
+		return res, nil
+	}
+	body := res.Body
+	drain := isStoring(body)
+	size := res.ContentLength
+	if size < 0 {
+		b, err := io.ReadAll(body)
+		if err != nil {
+			_ = body.Close() //nostyle:handlerrors
+			return nil, err
+		}
+		_ = body.Close() //nostyle:handlerrors
+		body = io.NopCloser(bytes.NewReader(b))
+		size = int64(len(b))
+	}
+	ranges, err := parseRange(rr.rangeValue, size)
+	switch {
+	case errors.Is(err, errInvalidRange):
+		// An origin server MUST ignore a Range header field that contains a range unit it does not understand. A proxy MAY discard a Range header field that contains a range unit it does not understand (https://www.rfc-editor.org/rfc/rfc9110#section-14.2).
+		res.Body = body
+		return res, nil
+	case errors.Is(err, errUnsatisfiableRange):
+		// For byte ranges, failing to overlap the current extent means that the first-pos of all of the range-spec values were greater than or equal to the current length (https://www.rfc-editor.org/rfc/rfc9110#section-15.5.17).
+		if err := closeBody(body, drain); err != nil {
+			return nil, err
+		}
+		pres := partialResponse(res, http.StatusRequestedRangeNotSatisfiable)
+		pres.Header.Del("Content-Type")
+		pres.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		pres.Header.Set("Content-Length", "0")
+		pres.ContentLength = 0
+		pres.Body = http.NoBody
+		return pres, nil
+	}
+
+	pres := partialResponse(res, http.StatusPartialContent)
+	if len(ranges) == 1 {
+		r := ranges[0]
+		pres.Header.Set("Content-Range", r.contentRange(size))
+		pres.Header.Set("Content-Length", strconv.FormatInt(r.length, 10))
+		pres.ContentLength = r.length
+		pres.Body = &rangeBody{body: body, skip: r.start, r: io.LimitReader(body, r.length), drain: drain}
+		return pres, nil
+	}
+
+	// multipart/byteranges (https://www.rfc-editor.org/rfc/rfc9110#section-14.6)
+	parts, err := readRanges(body, ranges)
+	if err != nil {
+		_ = body.Close() //nostyle:handlerrors
+		return nil, err
+	}
+	if err := closeBody(body, drain); err != nil {
+		return nil, err
+	}
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	for i, r := range ranges {
+		h := textproto.MIMEHeader{}
+		if ct := res.Header.Get("Content-Type"); ct != "" {
+			h.Set("Content-Type", ct)
+		}
+		h.Set("Content-Range", r.contentRange(size))
+		pw, err := mw.CreatePart(h)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := pw.Write(parts[i]); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	pres.Header.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	pres.Header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	pres.ContentLength = int64(buf.Len())
+	pres.Body = io.NopCloser(buf)
+	return pres, nil
+}
+
+// readRanges reads the data of the ranges from body in one pass and returns them in the order of ranges.
+// Only the data of the ranges is kept, and the data between them is skipped.
+func readRanges(body io.Reader, ranges []byteRange) ([][]byte, error) {
+	sorted := slices.Clone(ranges)
+	slices.SortFunc(sorted, func(a, b byteRange) int {
+		return cmp.Compare(a.start, b.start)
+	})
+	// spans are the data of the merged ranges that overlap or adjoin.
+	type span struct {
+		start int64
+		b     []byte
+	}
+	var (
+		spans []*span
+		pos   int64
+	)
+	for _, r := range sorted {
+		end := r.start + r.length
+		if len(spans) != 0 && r.start <= pos {
+			// The range overlaps or adjoins the last span.
+			if end > pos {
+				b := make([]byte, end-pos)
+				if _, err := io.ReadFull(body, b); err != nil {
+					return nil, err
+				}
+				last := spans[len(spans)-1]
+				last.b = append(last.b, b...)
+				pos = end
+			}
+			continue
+		}
+		if _, err := io.CopyN(io.Discard, body, r.start-pos); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		b := make([]byte, r.length)
+		if _, err := io.ReadFull(body, b); err != nil {
+			return nil, err
+		}
+		spans = append(spans, &span{start: r.start, b: b})
+		pos = end
+	}
+	parts := make([][]byte, 0, len(ranges))
+	for _, r := range ranges {
+		for _, s := range spans {
+			if r.start >= s.start && r.start+r.length <= s.start+int64(len(s.b)) {
+				parts = append(parts, s.b[r.start-s.start:r.start-s.start+r.length])
+				break
+			}
+		}
+	}
+	return parts, nil
+}
+
+// matchIfRange returns true if the condition of the If-Range header field is true for the full response header h (https://www.rfc-editor.org/rfc/rfc9110#section-13.1.5).
+func (rr *rangeRequest) matchIfRange(h http.Header) bool {
+	if rr.ifRange == "" {
+		return true
+	}
+	// If the field-value is an entity-tag, the condition is true if the entity-tag is strongly equal to the ETag of the selected representation.
+	if strings.HasPrefix(rr.ifRange, `"`) || strings.HasPrefix(rr.ifRange, "W/") {
+		etag := h.Get("ETag")
+		return !strings.HasPrefix(rr.ifRange, "W/") && etag == rr.ifRange
+	}
+	// If the field-value is an HTTP-date, the condition is true if the HTTP-date is an exact match for the Last-Modified of the selected representation and it is a strong validator.
+	t, err := http.ParseTime(rr.ifRange)
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(h.Get("Last-Modified"))
+	if err != nil || !lm.Equal(t) {
+		return false
+	}
+	// A Last-Modified time is strong if the origin server's Date is at least one second after the Last-Modified time (https://www.rfc-editor.org/rfc/rfc9110#section-8.8.2.2).
+	d, err := http.ParseTime(h.Get("Date"))
+	if err != nil {
+		return false
+	}
+	return !lm.After(d.Add(-time.Second))
+}
+
+// parseRange parses the value of the Range header field for the representation of size bytes (https://www.rfc-editor.org/rfc/rfc9110#section-14.1.2).
+// It returns the satisfiable ranges in the order of the request.
+func parseRange(v string, size int64) ([]byteRange, error) {
+	unit, set, ok := strings.Cut(v, "=")
+	if !ok || !strings.EqualFold(strings.TrimSpace(unit), "bytes") {
+		return nil, errInvalidRange
+	}
+	var (
+		ranges []byteRange
+		sum    int64
+	)
+	for _, spec := range strings.Split(set, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, errInvalidRange
+		}
+		var r byteRange
+		if first == "" {
+			// suffix-range
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errInvalidRange
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			r = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, errInvalidRange
+			}
+			end := size - 1
+			if last != "" {
+				e, err := strconv.ParseInt(last, 10, 64)
+				// A int-range is invalid if the last-pos value is present and less than the first-pos.
+				if err != nil || e < start {
+					return nil, errInvalidRange
+				}
+				end = min(e, size-1)
+			}
+			if start >= size {
+				continue
+			}
+			r = byteRange{start: start, length: end - start + 1}
+		}
+		ranges = append(ranges, r)
+		sum += r.length
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiableRange
+	}
+	// A server that supports range requests MAY ignore or reject a Range header field that contains ... many small ranges or overlapping ranges (https://www.rfc-editor.org/rfc/rfc9110#section-14.2).
+	// The ranges that are larger than the representation in total are ignored.
+	if sum > size {
+		return nil, errInvalidRange
+	}
+	return ranges, nil
+}
+
+// partialResponse returns the copy of res with statusCode.
+func partialResponse(res *http.Response, statusCode int) *http.Response {
+	return &http.Response{
+		StatusCode: statusCode,
+		Proto:      res.Proto,
+		ProtoMajor: res.ProtoMajor,
+		ProtoMinor: res.ProtoMinor,
+		Header:     res.Header.Clone(),
+		Trailer:    res.Trailer,
+		Request:    res.Request,
+	}
+}
+
+// closeBody closes body after reading the rest of it if drain is true.
+func closeBody(body io.ReadCloser, drain bool) error {
+	if drain {
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			_ = body.Close() //nostyle:handlerrors
+			return err
+		}
+	}
+	return body.Close()
+}
+
+// rangeBody is the body of the range of the full response body.
+type rangeBody struct {
+	body io.ReadCloser
+	// skip is the number of bytes to be skipped before reading r.
+	skip  int64
+	r     io.Reader
+	drain bool
+}
+
+func (b *rangeBody) Read(p []byte) (int, error) {
+	if b.skip > 0 {
+		if s, ok := b.body.(io.Seeker); ok && !b.drain {
+			if _, err := s.Seek(b.skip, io.SeekCurrent); err != nil {
+				return 0, err
+			}
+		} else if _, err := io.CopyN(io.Discard, b.body, b.skip); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		b.skip = 0
+	}
+	return b.r.Read(p)
+}
+
+func (b *rangeBody) Close() error {
+	return closeBody(b.body, b.drain)
+}
@@ -2,6 +2,7 @@ package rc
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"log/slog"
@@ -30,51 +31,179 @@ type Cacher interface {
 	Store(req *http.Request, res *http.Response, expires time.Time) error
 }
 
+// StreamingCacher is a Cacher that can store the response cache while the response body is streamed to the client.
+// It is used when streaming is enabled (see WithStreaming).
+type StreamingCacher interface {
+	Cacher
+	// StoreStream stores the response cache reading the response body from body (res.Body is empty).
+	// If reading body returns an error other than io.EOF (e.g. ErrObjectTooLarge or the client disconnected), the cache must not be stored.
+	// The client is blocked while StoreStream does not read body.
+	StoreStream(req *http.Request, res *http.Response, body io.Reader, expires time.Time) error
+}
+
+// Invalidator is a Cacher that can invalidate the stored responses (https://www.rfc-editor.org/rfc/rfc9111#section-4.4).
+// Invalidate is called when the response to the unsafe request (e.g. POST, PUT, PATCH and DELETE) has a non-error status code.
+type Invalidator interface {
+	Cacher
+	// Invalidate invalidates the stored responses for the URI of req (req.Host and req.URL).
+	// The method of req is the unsafe method, so the stored responses of any method for the URI should be invalidated.
+	Invalidate(req *http.Request) error
+}
+
 type Handler interface {
 	// Handle handles the request/response cache.
+	// If the response of originRequester is not returned, Handle must close its body.
 	Handle(req *http.Request, cachedReq *http.Request, cachedRes *http.Response, originRequester func(*http.Request) (*http.Response, error), now time.Time) (cacheUsed bool, res *http.Response, err error)
 	// Storable returns whether the response is storable and the expiration time.
 	Storable(req *http.Request, res *http.Response, now time.Time) (ok bool, expires time.Time)
 }
 
-var _ Handler = (*rfc9111.Shared)(nil)
+// VaryNormalizingHandler is a Handler that normalizes the request header fields nominated by the Vary header field (https://www.rfc-editor.org/rfc/rfc9111#section-4.1).
+// The normalization is also used to match the coalesced requests and to select the variants (see VariantCacher) so that they agree with Handle.
+type VaryNormalizingHandler interface {
+	Handler
+	// NormalizeVaryField returns the normalized value of the field name with the field lines values (nil if the field is absent).
+	// Two requests match for the field if the results (including ok) are the same.
+	NormalizeVaryField(name string, values []string) (v string, ok bool)
+}
+
+// HeaderStoringHandler is a Handler that selects the header fields of the response to be stored.
+// StoredHeader is called once Storable returns true, so that Storable does not need to modify the response.
+type HeaderStoringHandler interface {
+	Handler
+	// StoredHeader returns the header fields of res to be stored (e.g. without the fields listed by the qualified form of the no-cache response directive).
+	// It must not modify res.
+	StoredHeader(res *http.Response) http.Header
+}
+
+var (
+	_ Handler                = (*rfc9111.Shared)(nil)
+	_ Handler                = (*rfc9111.Private)(nil)
+	_ VaryNormalizingHandler = (*rfc9111.Shared)(nil)
+	_ VaryNormalizingHandler = (*rfc9111.Private)(nil)
+	_ HeaderStoringHandler   = (*rfc9111.Shared)(nil)
+	_ HeaderStoringHandler   = (*rfc9111.Private)(nil)
+)
 
 type cacher struct {
 	Cacher
-	Handle   func(req *http.Request, cachedReq *http.Request, cachedRes *http.Response, originRequester func(*http.Request) (*http.Response, error), now time.Time) (cacheUsed bool, res *http.Response, err error)
-	Storable func(req *http.Request, res *http.Response, now time.Time) (ok bool, expires time.Time)
+	v2                 CacherV2
+	Handle             func(req *http.Request, cachedReq *http.Request, cachedRes *http.Response, originRequester func(*http.Request) (*http.Response, error), now time.Time) (cacheUsed bool, res *http.Response, err error)
+	Storable           func(req *http.Request, res *http.Response, now time.Time) (ok bool, expires time.Time)
+	NormalizeVaryField func(name string, values []string) (v string, ok bool)
+	StoredHeader       func(res *http.Response) http.Header
+	StoreStream        func(req *http.Request, res *http.Response, body io.Reader, expires time.Time) error
+	Invalidate         func(req *http.Request) error
+	LoadSlice          func(req *http.Request, index int64) (cachedReq *http.Request, cachedRes *http.Response, err error)
+	StoreSlice         func(req *http.Request, res *http.Response, index int64, expires time.Time) error
+	Variants           func(req *http.Request) ([]string, error)
+	LoadVariant        func(req *http.Request, variant string) (cachedReq *http.Request, cachedRes *http.Response, err error)
+	StoreVariant       func(req *http.Request, res *http.Response, variant string, expires time.Time) error
+	DeleteVariant      func(req *http.Request, variant string) error
 }
 
-func newCacher(c Cacher) *cacher {
+// The methods of the optional interfaces other than those of Cacher.
+// They are detected on the CacherV2 of FromCacherV2 too, which cannot implement Cacher.
+type (
+	streamStorer interface {
+		StoreStream(req *http.Request, res *http.Response, body io.Reader, expires time.Time) error
+	}
+	invalidator interface {
+		Invalidate(req *http.Request) error
+	}
+	sliceCacher interface {
+		LoadSlice(req *http.Request, index int64) (cachedReq *http.Request, cachedRes *http.Response, err error)
+		StoreSlice(req *http.Request, res *http.Response, index int64, expires time.Time) error
+	}
+	variantCacher interface {
+		Variants(req *http.Request) ([]string, error)
+		LoadVariant(req *http.Request, variant string) (cachedReq *http.Request, cachedRes *http.Response, err error)
+		StoreVariant(req *http.Request, res *http.Response, variant string, expires time.Time) error
+		DeleteVariant(req *http.Request, variant string) error
+	}
+)
+
+// newCacher returns the cacher that uses c with its optional interfaces.
+// If c does not implement Handler, the Handler h is used.
+func newCacher(c Cacher, h VaryNormalizingHandler) *cacher {
 	cc := &cacher{
 		Cacher: c,
+		v2:     NewCacherV2(c),
 	}
-	if v, ok := c.(Handler); ok {
+	// ext is the value that implements the optional interfaces.
+	var ext any = c
+	if v, ok := c.(*cacherV2Wrapper); ok {
+		// The CacherV2 is preferred.
+		cc.v2 = v.v2
+		ext = v.v2
+	}
+	// handler is the value that implements the optional interfaces of Handler.
+	var handler any = h
+	if v, ok := ext.(Handler); ok {
 		cc.Handle = v.Handle
 		cc.Storable = v.Storable
-	} else {
-		s, err := rfc9111.NewShared()
-		if err != nil {
-			panic(err) //nostyle:dontpanic
+		cc.NormalizeVaryField = normalizeVaryField
+		if v, ok := ext.(VaryNormalizingHandler); ok {
+			cc.NormalizeVaryField = v.NormalizeVaryField
 		}
-		cc.Handle = s.Handle
-		cc.Storable = s.Storable
+		handler = ext
+	} else {
+		cc.Handle = h.Handle
+		cc.Storable = h.Storable
+		cc.NormalizeVaryField = h.NormalizeVaryField
+	}
+	cc.StoredHeader = storedHeader
+	if v, ok := handler.(HeaderStoringHandler); ok {
+		cc.StoredHeader = v.StoredHeader
+	}
+	if v, ok := ext.(streamStorer); ok {
+		cc.StoreStream = v.StoreStream
+	}
+	if v, ok := ext.(invalidator); ok {
+		cc.Invalidate = v.Invalidate
+	}
+	if v, ok := ext.(sliceCacher); ok {
+		cc.LoadSlice = v.LoadSlice
+		cc.StoreSlice = v.StoreSlice
+	}
+	if v, ok := ext.(variantCacher); ok {
+		cc.Variants = v.Variants
+		cc.LoadVariant = v.LoadVariant
+		cc.StoreVariant = v.StoreVariant
+		cc.DeleteVariant = v.DeleteVariant
 	}
 	return cc
 }
 
 type cacheMw struct {
-	cacher            *cacher
-	useRequestBody    bool
-	logger            *slog.Logger
-	headerNamesToMask []string
+	cacher             *cacher
+	useRequestBody     bool
+	logger             *slog.Logger
+	headerNamesToMask  []string
+	coalescer          *coalescer
+	revalidator        *revalidator
+	revalidationHook   func(req *http.Request, result RevalidationResult, err error)
+	streaming          bool
+	maxObjectSize      int64
+	cacheStatusName    string
+	decisionHook       func(req *http.Request, d rfc9111.Decision)
+	decisionHeaderName string
+	rangeRequests      bool
+	sliceSize          int64
+	keyFunc            KeyFunc
+	maxVariants        int
+	// variantLocks serializes the stores of the variants of a resource so that the number of the variants does not exceed maxVariants.
+	variantLocks keyedMutex
 }
 
-func newCacheMw(c Cacher, opts ...Option) *cacheMw {
-	cc := newCacher(c)
+// newCacheMw returns the cacheMw that uses c, or the Handler h if c does not implement Handler.
+func newCacheMw(c Cacher, h VaryNormalizingHandler, opts ...Option) *cacheMw {
+	cc := newCacher(c, h)
 	m := &cacheMw{
 		cacher:            cc,
 		headerNamesToMask: defaultHeaderNamesToMask,
+		revalidator:       newRevalidator(),
+		maxVariants:       defaultMaxVariants,
 	}
 	for _, opt := range opts {
 		opt(m)
@@ -82,6 +211,15 @@ func newCacheMw(c Cacher, opts ...Option) *cacheMw {
 	if m.logger == nil {
 		m.logger = slog.New(slog.NewJSONHandler(io.Discard, nil))
 	}
+	m.revalidator.done = m.revalidated
+	if m.coalescer != nil {
+		m.coalescer.normalizeVary = cc.NormalizeVaryField
+	}
+	if m.coalescer != nil && m.streaming {
+		// The response body is shared with the waiters after it is streamed to the leader.
+		m.coalescer.capture = true
+		m.coalescer.maxBodySize = m.maxObjectSize
+	}
 	return m
 }
 
@@ -97,81 +235,230 @@ func (m *cacheMw) Handler(next http.Handler) http.Handler {
 		// Copy the request so that it is not affected by the next handler.
 		// reqc is the request to be used for caching.
 		req, reqc := m.duplicateRequest(req)
+		req, reqc, decisions := m.withDecisionHook(req, reqc)
+		req, reqc = m.withCacheKey(req, reqc)
+		if m.sliceSize > 0 && m.cacher.LoadSlice != nil && reqc.Method == http.MethodGet {
+			m.serveSlices(w, next, req, reqc, decisions, now)
+			return
+		}
+		var rr *rangeRequest
+		if m.rangeRequests {
+			if rr = newRangeRequest(reqc); rr != nil {
+				// The full response is loaded so that the Range request is served from it.
+				reqc = reqc.Clone(reqc.Context())
+				rr.strip(reqc)
+			}
+		}
 
-		cachedReq, cachedRes, err := m.cacher.Load(reqc) //nostyle:handlerrors
-		if err != nil {
-			switch {
-			case errors.Is(err, ErrCacheNotFound):
-				m.logger.Debug("cache not found", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)))
-			case errors.Is(err, ErrCacheExpired):
-				m.logger.Debug("cache expired", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)))
-			case errors.Is(err, ErrShouldNotUseCache):
-				m.logger.Debug("should not use cache", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)))
-				// Skip caching
-				next.ServeHTTP(w, req)
+		cachedReq, cachedRes, ok := m.load(reqc)
+		if !ok {
+			// Skip caching
+			m.addCacheStatus(w.Header(), &rfc9111.CacheStatus{Forward: rfc9111.ForwardBypass}, false, false, now)
+			if m.cacher.Invalidate != nil && !isSafeMethod(reqc.Method) {
+				// The stored responses are invalidated before the response is written to the client.
+				iw := &invalidatingWriter{ResponseWriter: w, invalidate: func(statusCode int, h http.Header) {
+					m.invalidate(reqc, statusCode, h)
+				}}
+				next.ServeHTTP(iw, req)
+				iw.finish()
 				return
-			default:
-				m.logger.Error("failed to load cache", slog.String("error", err.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)))
 			}
-		} else {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if cachedRes != nil {
 			defer func() {
 				cachedReq.Body.Close()
 				cachedRes.Body.Close()
 			}()
 		}
-		cacheUsed, res, err := m.cacher.Handle(req, cachedReq, cachedRes, m.handlerToRequester(next, reqc, now), now) //nostyle:handlerrors
+		if rr != nil {
+			// The full response is requested from the origin so that it is stored.
+			rr.strip(req)
+		}
+		// cw is used to pass the origin response through to the client (e.g. flushed or hijacked).
+		cw := &clientWriter{ResponseWriter: w}
+		requester := m.handlerToRequester(next, cw, reqc, now)
+		if m.coalescer != nil && cachedRes == nil && (reqc.Method == http.MethodGet || reqc.Method == http.MethodHead) {
+			requester = m.coalescedRequester(next, cw, reqc, now)
+		}
+		// notModified is the header of the 304 response when the stored response is validated.
+		var (
+			storedHeader http.Header
+			notModified  http.Header
+		)
+		if cachedRes != nil {
+			storedHeader = cachedRes.Header.Clone()
+			requester = notModifiedRecorder(requester, &notModified)
+		}
+		// Stale responses are revalidated in the background by the revalidator of the middleware.
+		req = req.WithContext(rfc9111.ContextWithRevalidator(req.Context(), m.revalidator))
+		req, cs := m.withCacheStatus(req)
+		cacheUsed, res, err := m.cacher.Handle(req, cachedReq, cachedRes, requester, now) //nostyle:handlerrors
 		if err != nil {
 			m.logger.Error("failed to handle cache", slog.String("error", err.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)))
 		}
-		defer func() {
-			if err := res.Body.Close(); err != nil {
-				m.logger.Error("failed to close response body", slog.String("error", err.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode), slog.Any("response_headers", m.maskHeader(res.Header)))
+		if res != nil && m.cacher.Invalidate != nil && !isSafeMethod(reqc.Method) {
+			m.invalidate(reqc, res.StatusCode, res.Header)
+		}
+		if cw.written {
+			// The origin response has already been written to the client.
+			if res != nil {
+				_ = res.Body.Close() //nostyle:handlerrors
 			}
-		}()
-
-		// Response
-		for k, v := range res.Header {
-			set := false
-			for _, vv := range v {
-				if !set {
-					w.Header().Set(k, vv)
-					set = true
-					continue
-				}
-				w.Header().Add(k, vv)
+			m.logger.Debug("response passed through", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)))
+			return
+		}
+		if res == nil {
+			// The response could not be obtained (e.g. the request context is done while waiting for the coalesced request).
+			m.addCacheStatus(w.Header(), cs, false, cachedRes != nil, now)
+			m.setDecisionHeader(w.Header(), decisions)
+			if errors.Is(err, context.DeadlineExceeded) {
+				w.WriteHeader(http.StatusGatewayTimeout)
+				return
 			}
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if cacheUsed && notModified != nil {
+			// The stored response is freshened by the validation.
+			m.freshen(storedForHead(reqc, cachedReq), cachedRes, storedHeader, notModified, res, now)
 		}
-		w.WriteHeader(res.StatusCode)
+		if !cacheUsed && usesStoredGet(reqc, cachedReq) && res.StatusCode == http.StatusOK && varyMatched(m.cacher.NormalizeVaryField, storedHeader, reqc, cachedReq) {
+			// The stored response to GET is freshened or invalidated by the response to HEAD.
+			m.freshenWithHead(storedForHead(reqc, cachedReq), cachedRes, storedHeader, res, now)
+		}
+		if rr != nil {
+			// The rest of the origin response body is read so that it is stored.
+			pres, err := rr.response(res)
+			if err != nil {
+				m.logger.Error("failed to serve range request", slog.String("error", err.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode))
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			res = pres
+		}
+		m.writeResponse(w, reqc, res, cacheUsed, func(h http.Header) {
+			m.addCacheStatus(h, cs, cacheUsed, cachedRes != nil, now)
+			m.setDecisionHeader(h, decisions)
+		})
+	})
+}
 
-		ww, ok := w.(io.Writer)
-		if !ok {
-			m.logger.Error("failed to cast response writer to io.Writer", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()))
-			return
+// writeResponse writes res to the client and closes its body.
+// header is called to add the header fields of the middleware before the status code is written.
+func (m *cacheMw) writeResponse(w http.ResponseWriter, reqc *http.Request, res *http.Response, cacheUsed bool, header func(h http.Header)) {
+	defer func() {
+		if err := res.Body.Close(); err != nil {
+			m.logger.Error("failed to close response body", slog.String("error", err.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode), slog.Any("response_headers", m.maskHeader(res.Header)))
+		}
+	}()
+
+	// Response
+	for k, v := range res.Header {
+		set := false
+		for _, vv := range v {
+			if !set {
+				w.Header().Set(k, vv)
+				set = true
+				continue
+			}
+			w.Header().Add(k, vv)
+		}
+	}
+	header(w.Header())
+	w.WriteHeader(res.StatusCode)
+
+	ww, ok := w.(io.Writer)
+	if !ok {
+		m.logger.Error("failed to cast response writer to io.Writer", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()))
+		return
+	}
+	if m.streaming {
+		// Flush each chunk so that the streamed response reaches the client as it is written.
+		ww = &flushWriter{w: ww, rc: http.NewResponseController(w)}
+	}
+	buf := getCopyBuf()
+	defer putCopyBuf(buf)
+	if _, err := io.CopyBuffer(ww, res.Body, buf); err != nil {
+		// Error as debug
+		// - os.ErrDeadlineExceeded: The request context has been canceled or has expired.
+		// - "client disconnected": The client disconnected. (net/http.http2errClientDisconnected)
+		// - "http2: stream closed": The client disconnected. (net/http.http2errStreamClosed)
+		// - syscall.ECONNRESET: The client disconnected. ("connection reset by peer")
+		// - syscall.EPIPE: The client disconnected. ("broken pipe")
+		// - http.ErrBodyNotAllowed: The request method does not allow a body.
+		var perr *handlerPanicError
+		switch {
+		case errors.As(err, &perr):
+			// The handler panicked while streaming the response body. Abort the response so that the client can detect the truncated response.
+			m.logger.Error("failed to write response body", slog.String("error", err.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode), slog.Any("response_headers", m.maskHeader(res.Header)))
+			panic(http.ErrAbortHandler) //nostyle:dontpanic
+		case errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || contains([]string{"client disconnected", "http2: stream closed"}, err.Error()):
+			m.logger.Debug("failed to write response body", slog.String("error", err.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode), slog.Any("response_headers", m.maskHeader(res.Header)))
+		case errors.Is(err, http.ErrBodyNotAllowed):
+			// It is desirable that there should be no content body in the response, but the proxy server cannot handle it, so it is used as a debug log.
+			m.logger.Debug("failed to write response body", slog.String("error", err.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode), slog.Any("response_headers", m.maskHeader(res.Header)))
+		default:
+			m.logger.Error("failed to write response body", slog.String("error", err.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode), slog.Any("response_headers", m.maskHeader(res.Header)))
 		}
-		buf := getCopyBuf()
-		defer putCopyBuf(buf)
-		if _, err := io.CopyBuffer(ww, res.Body, buf); err != nil {
-			// Error as debug
-			// - os.ErrDeadlineExceeded: The request context has been canceled or has expired.
-			// - "client disconnected": The client disconnected. (net/http.http2errClientDisconnected)
-			// - "http2: stream closed": The client disconnected. (net/http.http2errStreamClosed)
-			// - syscall.ECONNRESET: The client disconnected. ("connection reset by peer")
-			// - syscall.EPIPE: The client disconnected. ("broken pipe")
-			// - http.ErrBodyNotAllowed: The request method does not allow a body.
-			switch {
-			case errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) || contains([]string{"client disconnected", "http2: stream closed"}, err.Error()):
-				m.logger.Debug("failed to write response body", slog.String("error", err.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode), slog.Any("response_headers", m.maskHeader(res.Header)))
-			case errors.Is(err, http.ErrBodyNotAllowed):
-				// It is desirable that there should be no content body in the response, but the proxy server cannot handle it, so it is used as a debug log.
-				m.logger.Debug("failed to write response body", slog.String("error", err.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode), slog.Any("response_headers", m.maskHeader(res.Header)))
-			default:
-				m.logger.Error("failed to write response body", slog.String("error", err.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode), slog.Any("response_headers", m.maskHeader(res.Header)))
+	}
+	for k, v := range res.Trailer {
+		w.Header()[http.TrailerPrefix+k] = v
+	}
+	if cacheUsed {
+		m.logger.Debug("cache used", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode))
+	}
+}
+
+// load loads the stored response for the request.
+// It returns false if the cache should not be used for the request (ErrShouldNotUseCache).
+func (m *cacheMw) load(reqc *http.Request) (*http.Request, *http.Response, bool) {
+	load := func(req *http.Request) (*http.Request, *http.Response, error) {
+		e, err := loadEntry(m.cacher.v2, req)
+		if err != nil {
+			return nil, nil, err
+		}
+		return e.Request, e.Response, nil
+	}
+	if index, ok := sliceIndex(reqc); ok {
+		load = func(req *http.Request) (*http.Request, *http.Response, error) {
+			return m.cacher.LoadSlice(req, index)
+		}
+	}
+	if _, ok := sliceIndex(reqc); !ok && m.cacher.LoadVariant != nil {
+		// The variant matching the request is preferred.
+		if reqc.Method == http.MethodHead {
+			if cachedReq, cachedRes, ok := m.loadVariant(headAsGet(reqc)); ok {
+				return cachedReq, cachedRes, true
 			}
 		}
-		if cacheUsed {
-			m.logger.Debug("cache used", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode))
+		if cachedReq, cachedRes, ok := m.loadVariant(reqc); ok {
+			return cachedReq, cachedRes, true
 		}
-	})
+	}
+	if reqc.Method == http.MethodHead {
+		// The stored response to GET is used for HEAD if any.
+		if cachedReq, cachedRes, err := load(headAsGet(reqc)); err == nil {
+			return cachedReq, cachedRes, true
+		}
+	}
+	cachedReq, cachedRes, err := load(reqc) //nostyle:handlerrors
+	if err == nil {
+		return cachedReq, cachedRes, true
+	}
+	switch {
+	case errors.Is(err, ErrCacheNotFound):
+		m.logger.Debug("cache not found", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)))
+	case errors.Is(err, ErrCacheExpired):
+		m.logger.Debug("cache expired", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)))
+	case errors.Is(err, ErrShouldNotUseCache):
+		m.logger.Debug("should not use cache", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)))
+		return nil, nil, false
+	default:
+		m.logger.Error("failed to load cache", slog.String("error", err.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)))
+	}
+	return nil, nil, true
 }
 
 func (m *cacheMw) duplicateRequest(req *http.Request) (*http.Request, *http.Request) {
@@ -193,29 +480,107 @@ func (m *cacheMw) duplicateRequest(req *http.Request) (*http.Request, *http.Requ
 	return copy, req
 }
 
-func (m *cacheMw) handlerToRequester(h http.Handler, reqc *http.Request, now time.Time) func(*http.Request) (*http.Response, error) {
+func (m *cacheMw) handlerToRequester(h http.Handler, cw *clientWriter, reqc *http.Request, now time.Time) func(*http.Request) (*http.Response, error) {
 	return func(req *http.Request) (*http.Response, error) {
-		rec := newRecorder()
-		defer rec.Reset()
-		h.ServeHTTP(rec, req)
-		res := rec.Result()
-		resc := rec.Result()
-
-		go func() {
-			ok, expires := m.cacher.Storable(reqc, resc, now)
-			if !ok {
-				m.logger.Debug("cache not storable", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode), slog.Any("response_headers", m.maskHeader(resc.Header)))
-				return
-			}
+		res, _ := m.requestOrigin(h, clientWriterFor(req, cw), req, reqc, now)
+		return res, nil
+	}
+}
 
-			// Store response as cache
-			if err := m.cacher.Store(reqc, resc, expires); err != nil {
-				m.logger.Error("failed to store cache", slog.String("error", err.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", resc.StatusCode))
-			}
-			m.logger.Debug("cache stored", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", resc.StatusCode))
-		}()
+// coalescedRequester returns the origin requester that collapses concurrent requests for the same resource into one.
+func (m *cacheMw) coalescedRequester(h http.Handler, cw *clientWriter, reqc *http.Request, now time.Time) func(*http.Request) (*http.Response, error) {
+	key := requestKey(reqc)
+	return func(req *http.Request) (*http.Response, error) {
+		called := false
+		res, err := m.coalescer.do(reqc, key, func() (*http.Response, bool, error) {
+			called = true
+			res, ok := m.requestOrigin(h, clientWriterFor(req, cw), req, reqc, now)
+			return res, ok, nil
+		})
+		if err == nil && !called {
+			recordCollapsed(req)
+		}
+		return res, err
+	}
+}
 
-		return res, nil
+// requestOrigin requests the origin (next handler) and stores the response as cache if it is storable.
+func (m *cacheMw) requestOrigin(h http.Handler, cw *clientWriter, req, reqc *http.Request, now time.Time) (*http.Response, bool) {
+	if m.streaming {
+		return m.requestOriginStream(h, cw, req, reqc, now)
+	}
+	rec := newRecorder(cw)
+	defer rec.Reset()
+	h.ServeHTTP(rec, req)
+	rec.finish()
+	responseTime := time.Now()
+	res := rec.Result()
+	if !rec.cacheable() {
+		m.logger.Debug("cache not storable", slog.String("error", errPassedThrough.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode))
+		return res, false
+	}
+	resc := rec.Result()
+
+	ok, expires := m.cacher.Storable(reqc, resc, now)
+	if !ok {
+		m.logger.Debug("cache not storable", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode), slog.Any("response_headers", m.maskHeader(resc.Header)))
+		return res, false
+	}
+	if isNotSlice(reqc, resc) {
+		m.logger.Debug("cache not storable", slog.String("error", errNotSlice.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode))
+		return res, false
+	}
+	if m.maxObjectSize > 0 && resc.ContentLength > m.maxObjectSize {
+		m.logger.Debug("cache not storable", slog.String("error", ErrObjectTooLarge.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode), slog.Int64("content_length", resc.ContentLength))
+		return res, false
+	}
+
+	resc.Header = m.cacher.StoredHeader(resc)
+	go m.store(withExchangeTimes(reqc, now, responseTime), resc, expires)
+	recordStored(req, expires)
+
+	return res, true
+}
+
+// store stores the response as cache.
+func (m *cacheMw) store(reqc *http.Request, resc *http.Response, expires time.Time) {
+	store := func(req *http.Request, res *http.Response, expires time.Time) error {
+		return storeEntry(m.cacher.v2, req, res, expires)
+	}
+	if index, ok := sliceIndex(reqc); ok {
+		store = func(req *http.Request, res *http.Response, expires time.Time) error {
+			return m.cacher.StoreSlice(req, res, index, expires)
+		}
+	}
+	if variant, ok := m.storesVariant(reqc, resc); ok {
+		store = func(req *http.Request, res *http.Response, expires time.Time) error {
+			return m.storeVariant(req, res, variant, expires)
+		}
+	}
+	if err := store(reqc, resc, expires); err != nil {
+		m.logger.Error("failed to store cache", slog.String("error", err.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", resc.StatusCode))
+		return
+	}
+	m.logger.Debug("cache stored", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", resc.StatusCode))
+}
+
+// storedHeader returns a copy of the header fields of the response to be stored used when the Handler does not implement HeaderStoringHandler.
+func storedHeader(res *http.Response) http.Header {
+	return res.Header.Clone()
+}
+
+// revalidated is called when the background revalidation is finished or dropped.
+func (m *cacheMw) revalidated(req *http.Request, result RevalidationResult, err error) {
+	switch result {
+	case RevalidationSucceeded:
+		m.logger.Debug("cache revalidated", slog.String("host", req.Host), slog.String("method", req.Method), slog.String("url", req.URL.String()), slog.Any("headers", m.maskHeader(req.Header)))
+	case RevalidationFailed:
+		m.logger.Error("failed to revalidate cache", slog.String("error", err.Error()), slog.String("host", req.Host), slog.String("method", req.Method), slog.String("url", req.URL.String()), slog.Any("headers", m.maskHeader(req.Header)))
+	case RevalidationDropped:
+		m.logger.Warn("cache revalidation dropped", slog.String("host", req.Host), slog.String("method", req.Method), slog.String("url", req.URL.String()), slog.Any("headers", m.maskHeader(req.Header)))
+	}
+	if m.revalidationHook != nil {
+		m.revalidationHook(req, result, err)
 	}
 }
 
@@ -253,53 +618,138 @@ func HeaderNamesToMask(names []string) Option {
 	}
 }
 
-// New returns a new response cache middleware.
-func New(cacher Cacher, opts ...Option) func(next http.Handler) http.Handler {
-	rl := newCacheMw(cacher, opts...)
-	return rl.Handler
+// WithRequestCoalescing enables to collapse concurrent cache misses for the same resource into one origin request (like proxy_cache_lock of NGINX).
+// The response is shared with the waiting requests only if it is storable and the request header fields nominated by Vary match.
+// The waiting requests stop waiting when their request context is done.
+func WithRequestCoalescing() Option {
+	return func(m *cacheMw) {
+		m.coalescer = newCoalescer()
+	}
 }
 
-type recorder struct {
-	statusCode int
-	header     http.Header
-	buf        *bytes.Buffer
+// WithRevalidation sets the number of workers, the queue size and the timeout of background revalidation (e.g. stale-while-revalidate).
+// Only one revalidation per resource runs at a time, and revalidations that overflow the queue are dropped.
+// If workers or timeout is 0 or less, or queueSize is less than 0, the default (8 workers, 128 queue size and 30s timeout) is used.
+// If queueSize is 0, revalidations are not queued and dropped while all the workers are busy.
+func WithRevalidation(workers, queueSize int, timeout time.Duration) Option {
+	return func(m *cacheMw) {
+		if workers <= 0 {
+			workers = defaultRevalidationWorkers
+		}
+		if queueSize < 0 {
+			queueSize = defaultRevalidationQueueSize
+		}
+		if timeout <= 0 {
+			timeout = defaultRevalidationTimeout
+		}
+		m.revalidator.workers = workers
+		m.revalidator.queueSize = queueSize
+		m.revalidator.timeout = timeout
+	}
+}
+
+// WithRevalidationHook sets the function called when a background revalidation is finished or dropped.
+// It can be used to collect metrics of background revalidation.
+func WithRevalidationHook(fn func(req *http.Request, result RevalidationResult, err error)) Option {
+	return func(m *cacheMw) {
+		m.revalidationHook = fn
+	}
+}
+
+// WithStreaming enables to stream the origin response to the client as it is written by the handler.
+// The response body is stored as cache at the same time (see StreamingCacher).
+// If the Cacher does not implement StreamingCacher, the response body is buffered only for storing.
+func WithStreaming() Option {
+	return func(m *cacheMw) {
+		m.streaming = true
+	}
+}
+
+// WithMaxObjectSize sets the maximum size of the response body to be stored as cache.
+// When streaming is enabled, storing is abandoned mid-stream if the response body exceeds the size.
+func WithMaxObjectSize(size int64) Option {
+	return func(m *cacheMw) {
+		m.maxObjectSize = size
+	}
+}
+
+// WithCacheStatusHeader enables to add the Cache-Status header field (https://www.rfc-editor.org/rfc/rfc9211) to the response.
+// name is the identifier of the cache in the field (e.g. the host name). If name is empty, "rc" is used.
+// The field is not added to the response passed through to the client (e.g. flushed or hijacked).
+func WithCacheStatusHeader(name string) Option {
+	return func(m *cacheMw) {
+		if name == "" {
+			name = defaultCacheIdentifier
+		}
+		m.cacheStatusName = name
+	}
 }
 
-var _ http.ResponseWriter = (*recorder)(nil)
+// WithDecisionHook sets the function called with the decisions of the Handler (e.g. why the response is not storable).
+// It is also called for the decisions in the background revalidation.
+func WithDecisionHook(fn func(req *http.Request, d rfc9111.Decision)) Option {
+	return func(m *cacheMw) {
+		m.decisionHook = fn
+	}
+}
 
-func newRecorder() *recorder {
-	return &recorder{
-		buf:    new(bytes.Buffer),
-		header: make(http.Header),
+// WithDecisionHeader enables to set the header field that lists the decisions of the Handler to the response for debugging.
+// The decisions are not listed in the response passed through to the client (e.g. flushed or hijacked).
+func WithDecisionHeader(name string) Option {
+	return func(m *cacheMw) {
+		m.decisionHeaderName = name
 	}
 }
 
-func (r *recorder) Header() http.Header {
-	return r.header
+// WithRangeRequests enables to serve Range requests (https://www.rfc-editor.org/rfc/rfc9110#section-14) from the full (200) response.
+// The Range and If-Range header fields are removed from the request to the origin, so the full response is requested once and stored.
+// The response to the client is 206 (including multipart/byteranges), 416 or the full response if the Range request is ignored (e.g. If-Range does not match).
+func WithRangeRequests() Option {
+	return func(m *cacheMw) {
+		m.rangeRequests = true
+	}
 }
 
-func (r *recorder) Write(b []byte) (int, error) {
-	return r.buf.Write(b)
+// WithSlice enables to split the response of GET into slices of size bytes and cache them separately (like the slice module of NGINX).
+// Each slice is requested from the origin with the Range request of the slice and stored by the SliceCacher.
+// The response to the client (including Range requests) is assembled from the slices, which must have the same ETag.
+// If the origin ignores the Range request of the slice, the full response is passed to the client without being stored.
+// If the Cacher does not implement SliceCacher, slicing is disabled.
+func WithSlice(size int64) Option {
+	return func(m *cacheMw) {
+		m.sliceSize = size
+	}
 }
 
-func (r *recorder) WriteHeader(statusCode int) {
-	r.statusCode = statusCode
+// WithKeyFunc sets the function that returns the cache key of the request (see KeyBuilder).
+// The key is computed once for the request and passed to the Cacher through the request context (see CacheKey).
+// The Handler of the Cacher uses the same key to check that the stored response is for the presented request instead of comparing the target URIs.
+// To serve the stored response to the requests that differ only in the query parameters listed by the No-Vary-Search response header field, the key must not include the query (e.g. KeyBuilder without KeyQuery).
+// The Handler still compares the query parameters that affect the stored response (see rfc9111.NoVarySearch).
+func WithKeyFunc(fn KeyFunc) Option {
+	return func(m *cacheMw) {
+		m.keyFunc = fn
+	}
 }
 
-func (r *recorder) Result() *http.Response {
-	return &http.Response{
-		Status:        http.StatusText(r.statusCode),
-		StatusCode:    r.statusCode,
-		Header:        r.header.Clone(),
-		Body:          io.NopCloser(bytes.NewReader(r.buf.Bytes())),
-		ContentLength: int64(r.buf.Len()),
+// WithMaxVariants sets the maximum number of the variants stored for a resource by the VariantCacher (16 by default).
+// When the number is exceeded, the oldest variants are deleted to guard against the explosion of the variants by the Vary header field.
+// The stores of the variants of a resource are serialized in the middleware, but the number is approximate if the VariantCacher is shared by other processes or middlewares.
+// If n is 0 or less, the number is not limited.
+func WithMaxVariants(n int) Option {
+	return func(m *cacheMw) {
+		m.maxVariants = n
 	}
 }
 
-func (r *recorder) Reset() {
-	r.statusCode = 0
-	r.header = make(http.Header)
-	r.buf.Reset()
+// New returns a new response cache middleware.
+func New(cacher Cacher, opts ...Option) func(next http.Handler) http.Handler {
+	s, err := rfc9111.NewShared()
+	if err != nil {
+		panic(err) //nostyle:dontpanic
+	}
+	rl := newCacheMw(cacher, s, opts...)
+	return rl.Handler
 }
 
 func contains(s []string, e string) bool {
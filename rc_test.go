@@ -1,13 +1,25 @@
 package rc_test
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/2manymws/rc"
+	"github.com/2manymws/rc/rfc9111"
 	"github.com/2manymws/rc/testutil"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -221,3 +233,2271 @@ func TestWithReverseProxy(t *testing.T) {
 		})
 	}
 }
+
+func TestRequestCoalescing(t *testing.T) {
+	tests := []struct {
+		name        string
+		opts        []rc.Option
+		headers     []http.Header
+		resHeader   http.Header
+		normalizers map[string]rfc9111.VaryNormalizer
+		wantWaiters int64
+		wantOrigins int64
+	}{
+		{
+			"without request coalescing",
+			nil,
+			[]http.Header{{}, {}, {}, {}},
+			http.Header{"Cache-Control": []string{"max-age=60"}},
+			nil,
+			0,
+			4,
+		},
+		{
+			"with request coalescing",
+			[]rc.Option{rc.WithRequestCoalescing()},
+			[]http.Header{{}, {}, {}, {}},
+			http.Header{"Cache-Control": []string{"max-age=60"}},
+			nil,
+			3,
+			1,
+		},
+		{
+			"with request coalescing but not storable",
+			[]rc.Option{rc.WithRequestCoalescing()},
+			[]http.Header{{}, {}, {}, {}},
+			http.Header{"Cache-Control": []string{"no-store"}},
+			nil,
+			3,
+			4,
+		},
+		{
+			"with request coalescing and streaming",
+			[]rc.Option{rc.WithRequestCoalescing(), rc.WithStreaming()},
+			[]http.Header{{}, {}, {}, {}},
+			http.Header{"Cache-Control": []string{"max-age=60"}},
+			nil,
+			3,
+			1,
+		},
+		{
+			"with request coalescing and Vary",
+			[]rc.Option{rc.WithRequestCoalescing()},
+			[]http.Header{{"Accept-Language": []string{"ja"}}, {"Accept-Language": []string{"ja"}}, {"Accept-Language": []string{"ja"}}, {"Accept-Language": []string{"en"}}},
+			http.Header{"Cache-Control": []string{"max-age=60"}, "Vary": []string{"Accept-Language"}},
+			nil,
+			3,
+			2,
+		},
+		{
+			"with request coalescing and Vary with the field values to be normalized",
+			[]rc.Option{rc.WithRequestCoalescing()},
+			[]http.Header{{"Accept-Language": []string{"ja, en"}}, {"Accept-Language": []string{"ja,en"}}, {"Accept-Language": []string{"ja", "en"}}, {"Accept-Language": []string{"ja ,  en"}}},
+			http.Header{"Cache-Control": []string{"max-age=60"}, "Vary": []string{"Accept-Language"}},
+			nil,
+			3,
+			1,
+		},
+		{
+			"with request coalescing and Vary with the normalizer of the handler",
+			[]rc.Option{rc.WithRequestCoalescing()},
+			[]http.Header{{"Accept-Encoding": []string{"gzip"}}, {"Accept-Encoding": []string{"gzip, deflate"}}, {"Accept-Encoding": []string{"x-gzip"}}, {"Accept-Encoding": []string{"br"}}},
+			http.Header{"Cache-Control": []string{"max-age=60"}, "Vary": []string{"Accept-Encoding"}},
+			map[string]rfc9111.VaryNormalizer{"Accept-Encoding": rfc9111.AcceptEncodingNormalizer("gzip")},
+			3,
+			2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				origins atomic.Int64
+				waiters atomic.Int64
+			)
+			entered := make(chan struct{})
+			waited := make(chan struct{})
+			t.Cleanup(rc.SetTestHookCoalescerWait(func() {
+				if waiters.Add(1) == tt.wantWaiters {
+					close(waited)
+				}
+			}))
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := origins.Add(1)
+				if n == 1 {
+					close(entered)
+				}
+				if tt.wantWaiters == 0 && n == int64(len(tt.headers)) {
+					// Without request coalescing, all the requests reach the origin.
+					close(waited)
+				}
+				// The origin responds after the other requests have started waiting for it (or have reached it).
+				<-waited
+				for k, v := range tt.resHeader {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write([]byte("hello")) //nostyle:handlerrors
+			})
+			var cacher rc.Cacher = testutil.NewAllCache(t)
+			if tt.normalizers != nil {
+				cacher = newSharedCacher(t, cacher, rfc9111.VaryNormalizers(tt.normalizers))
+			}
+			m := rc.New(cacher, tt.opts...)
+			ts := httptest.NewServer(m(h))
+			t.Cleanup(ts.Close)
+			tc := ts.Client()
+
+			var wg sync.WaitGroup
+			for i, hh := range tt.headers {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					req, err := http.NewRequest(http.MethodGet, ts.URL+"/coalesce", nil)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					req.Header = hh
+					res, err := tc.Do(req)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					defer res.Body.Close()
+					b, err := io.ReadAll(res.Body)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					if res.StatusCode != http.StatusOK || string(b) != "hello" {
+						t.Errorf("got %d %q want %d %q", res.StatusCode, b, http.StatusOK, "hello")
+					}
+				}()
+				if i == 0 {
+					// The first request leads the others.
+					<-entered
+				}
+			}
+			wg.Wait()
+
+			if got := waiters.Load(); got != tt.wantWaiters {
+				t.Errorf("got %v want %v", got, tt.wantWaiters)
+			}
+			if got := origins.Load(); got != tt.wantOrigins {
+				t.Errorf("got %v want %v", got, tt.wantOrigins)
+			}
+		})
+	}
+}
+
+// sharedCacher is a Cacher with the Shared handler created with the options.
+type sharedCacher struct {
+	rc.Cacher
+	*rfc9111.Shared
+}
+
+func newSharedCacher(t *testing.T, c rc.Cacher, opts ...rfc9111.SharedOption) *sharedCacher {
+	t.Helper()
+	s, err := rfc9111.NewShared(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &sharedCacher{Cacher: c, Shared: s}
+}
+
+func TestStreaming(t *testing.T) {
+	chunk := strings.Repeat("a", 8*1024)
+	tests := []struct {
+		name       string
+		cacher     testutil.Cacher
+		opts       []rc.Option
+		wantBody   string
+		wantHit    int
+		wantStored int
+	}{
+		{"streaming cacher", testutil.NewStreamingCache(t), []rc.Option{rc.WithStreaming()}, chunk + "end", 1, 1},
+		{"streaming cacher with max object size", testutil.NewStreamingCache(t), []rc.Option{rc.WithStreaming(), rc.WithMaxObjectSize(1024)}, chunk + "end", 0, 0},
+		{"cacher", testutil.NewAllCache(t), []rc.Option{rc.WithStreaming()}, chunk + "end", 1, -1},
+		{"cacher with max object size", testutil.NewAllCache(t), []rc.Option{rc.WithStreaming(), rc.WithMaxObjectSize(1024)}, chunk + "end", 0, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			release := make(chan struct{})
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.WriteHeader(http.StatusOK)
+				_, _ = w.Write([]byte(chunk)) //nostyle:handlerrors
+				<-release
+				_, _ = w.Write([]byte("end")) //nostyle:handlerrors
+			})
+			m := rc.New(tt.cacher, tt.opts...)
+			ts := httptest.NewServer(m(h))
+			t.Cleanup(ts.Close)
+			tc := ts.Client()
+
+			res, err := tc.Get(ts.URL + "/stream")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The first chunk is received before the handler finishes.
+			first := make([]byte, len(chunk))
+			read := make(chan error)
+			go func() {
+				_, err := io.ReadFull(res.Body, first)
+				read <- err
+			}()
+			select {
+			case err := <-read:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(time.Second):
+				t.Error("the response is not streamed")
+				close(release)
+				<-read
+				res.Body.Close()
+				return
+			}
+			close(release)
+			rest, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if got := string(first) + string(rest); got != tt.wantBody {
+				t.Errorf("got %d bytes want %d bytes", len(got), len(tt.wantBody))
+			}
+			// Wait for storing (the response is stored if it is used by the second request).
+			tt.cacher.WaitStored(t, tt.wantHit)
+
+			res2, err := tc.Get(ts.URL + "/stream")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(res2.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res2.Body.Close()
+			if string(b) != tt.wantBody {
+				t.Errorf("got %d bytes want %d bytes", len(b), len(tt.wantBody))
+			}
+			if got := tt.cacher.Hit(); got != tt.wantHit {
+				t.Errorf("got %v want %v", got, tt.wantHit)
+			}
+			if sc, ok := tt.cacher.(*testutil.StreamingCache); ok {
+				if got := sc.Stored(); got != tt.wantStored {
+					t.Errorf("got %v want %v", got, tt.wantStored)
+				}
+			}
+		})
+	}
+}
+
+func TestFreshenOnNotModified(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacher       testutil.Cacher
+		opts         []rc.Option
+		conditional  bool
+		wantStatuses []int
+	}{
+		{"cacher", testutil.NewAllCache(t), nil, false, []int{http.StatusOK, http.StatusOK, http.StatusOK}},
+		{"streaming cacher", testutil.NewStreamingCache(t), []rc.Option{rc.WithStreaming()}, false, []int{http.StatusOK, http.StatusOK, http.StatusOK}},
+		{"conditional request", testutil.NewAllCache(t), nil, true, []int{http.StatusOK, http.StatusNotModified, http.StatusNotModified}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var full, notModified atomic.Int64
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("If-None-Match") == `"v1"` {
+					notModified.Add(1)
+					w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+					w.Header().Set("Cache-Control", "max-age=60")
+					w.Header().Set("ETag", `"v1"`)
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				full.Add(1)
+				// The response is already stale when it is stored.
+				w.Header().Set("Date", time.Now().Add(-10*time.Second).UTC().Format(http.TimeFormat))
+				w.Header().Set("Cache-Control", "max-age=5")
+				w.Header().Set("ETag", `"v1"`)
+				_, _ = w.Write([]byte("hello")) //nostyle:handlerrors
+			})
+			m := rc.New(tt.cacher, tt.opts...)
+			ts := httptest.NewServer(m(h))
+			t.Cleanup(ts.Close)
+			tc := ts.Client()
+
+			for i, want := range tt.wantStatuses {
+				req, err := http.NewRequest(http.MethodGet, ts.URL+"/freshen", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.conditional && i > 0 {
+					req.Header.Set("If-None-Match", `"v1"`)
+				}
+				res, err := tc.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := io.ReadAll(res.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				res.Body.Close()
+				if res.StatusCode != want {
+					t.Errorf("request %d: got status code %v want %v", i, res.StatusCode, want)
+				}
+				if want == http.StatusOK && string(b) != "hello" {
+					t.Errorf("request %d: got %q want %q", i, string(b), "hello")
+				}
+				// Wait for storing (the response is stored by the first request and freshened by the validation of the second request).
+				tt.cacher.WaitStored(t, min(i+1, 2))
+			}
+			if got := full.Load(); got != 1 {
+				t.Errorf("got %v full responses want 1", got)
+			}
+			// The stored response is freshened by the first validation, so it is validated only once.
+			if got := notModified.Load(); got != 1 {
+				t.Errorf("got %v not modified responses want 1", got)
+			}
+		})
+	}
+}
+
+func TestInvalidation(t *testing.T) {
+	tests := []struct {
+		name            string
+		cacher          *testutil.InvalidatableCache
+		method          string
+		path            string
+		statusCode      int
+		header          http.Header
+		wantBody        string
+		wantInvalidated []string
+	}{
+		{"DELETE target URI", testutil.NewInvalidatableCache(t, testutil.NewAllCache(t)), http.MethodDelete, "/items/1", http.StatusNoContent, nil, "2", []string{"/items/1"}},
+		{"DELETE target URI (get only)", testutil.NewInvalidatableCache(t, testutil.NewGetOnlyCache(t)), http.MethodDelete, "/items/1", http.StatusNoContent, nil, "2", []string{"/items/1"}},
+		{"DELETE without writing the response", testutil.NewInvalidatableCache(t, testutil.NewAllCache(t)), http.MethodDelete, "/items/1", 0, nil, "2", []string{"/items/1"}},
+		{"DELETE without writing the response (get only)", testutil.NewInvalidatableCache(t, testutil.NewGetOnlyCache(t)), http.MethodDelete, "/items/1", 0, nil, "2", []string{"/items/1"}},
+		{"POST Location", testutil.NewInvalidatableCache(t, testutil.NewAllCache(t)), http.MethodPost, "/items", http.StatusCreated, http.Header{"Location": []string{"/items/1"}}, "2", []string{"/items", "/items/1"}},
+		{"POST Content-Location (get only)", testutil.NewInvalidatableCache(t, testutil.NewGetOnlyCache(t)), http.MethodPost, "/items", http.StatusOK, http.Header{"Content-Location": []string{"/items/1"}}, "2", []string{"/items", "/items/1"}},
+		{"POST Location of other host", testutil.NewInvalidatableCache(t, testutil.NewAllCache(t)), http.MethodPost, "/items", http.StatusCreated, http.Header{"Location": []string{"http://other.example.com/items/1"}}, "1", []string{"/items"}},
+		{"PUT error response", testutil.NewInvalidatableCache(t, testutil.NewAllCache(t)), http.MethodPut, "/items/1", http.StatusInternalServerError, nil, "1", nil},
+		{"GET is safe", testutil.NewInvalidatableCache(t, testutil.NewAllCache(t)), http.MethodGet, "/items/2", http.StatusOK, nil, "1", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var count atomic.Int64
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method == http.MethodGet && r.URL.Path == "/items/1" {
+					w.Header().Set("Cache-Control", "max-age=60")
+					_, _ = w.Write([]byte(strconv.FormatInt(count.Add(1), 10))) //nostyle:handlerrors
+					return
+				}
+				for k, v := range tt.header {
+					w.Header()[k] = v
+				}
+				if tt.statusCode != 0 {
+					w.WriteHeader(tt.statusCode)
+				}
+			})
+			m := rc.New(tt.cacher)
+			ts := httptest.NewServer(m(h))
+			t.Cleanup(ts.Close)
+			tc := ts.Client()
+
+			do := func(method, path string) string {
+				t.Helper()
+				req, err := http.NewRequest(method, ts.URL+path, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				res, err := tc.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer res.Body.Close()
+				b, err := io.ReadAll(res.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return string(b)
+			}
+			_ = do(http.MethodGet, "/items/1")
+			// Wait for storing.
+			tt.cacher.WaitStored(t, 1)
+			_ = do(tt.method, tt.path)
+			if got := do(http.MethodGet, "/items/1"); got != tt.wantBody {
+				t.Errorf("got %q want %q", got, tt.wantBody)
+			}
+			if diff := cmp.Diff(tt.cacher.Invalidated(), tt.wantInvalidated); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestKeyBuilder(t *testing.T) {
+	newReq := func(method, target string, header http.Header, body string) *http.Request {
+		t.Helper()
+		var r io.Reader
+		if body != "" {
+			r = strings.NewReader(body)
+		}
+		req := httptest.NewRequest(method, target, r)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		return req
+	}
+	tests := []struct {
+		name      string
+		keyFunc   rc.KeyFunc
+		req       *http.Request
+		otherReq  *http.Request
+		wantEqual bool
+	}{
+		{
+			"method",
+			rc.KeyBuilder(rc.KeyMethod(), rc.KeyPath()),
+			newReq(http.MethodGet, "http://example.com/a", nil, ""),
+			newReq(http.MethodHead, "http://example.com/a", nil, ""),
+			false,
+		},
+		{
+			"scheme",
+			rc.KeyBuilder(rc.KeyScheme(), rc.KeyPath()),
+			newReq(http.MethodGet, "http://example.com/a", nil, ""),
+			newReq(http.MethodGet, "https://example.com/a", nil, ""),
+			false,
+		},
+		{
+			"normalized host",
+			rc.KeyBuilder(rc.KeyHost(), rc.KeyPath()),
+			newReq(http.MethodGet, "http://Example.COM:80/a", nil, ""),
+			newReq(http.MethodGet, "http://example.com./a", nil, ""),
+			true,
+		},
+		{
+			"host with non-default port",
+			rc.KeyBuilder(rc.KeyHost(), rc.KeyPath()),
+			newReq(http.MethodGet, "https://example.com:80/a", nil, ""),
+			newReq(http.MethodGet, "https://example.com/a", nil, ""),
+			false,
+		},
+		{
+			"path",
+			rc.KeyBuilder(rc.KeyPath()),
+			newReq(http.MethodGet, "http://example.com/a", nil, ""),
+			newReq(http.MethodGet, "http://example.com/b", nil, ""),
+			false,
+		},
+		{
+			"sorted and filtered query",
+			rc.KeyBuilder(rc.KeyPath(), rc.KeyQuery("utm_*", "fbclid")),
+			newReq(http.MethodGet, "http://example.com/a?b=2&utm_source=x&a=1&fbclid=y", nil, ""),
+			newReq(http.MethodGet, "http://example.com/a?a=%31&b=2&utm_medium=z", nil, ""),
+			true,
+		},
+		{
+			"order of the values of the same name",
+			rc.KeyBuilder(rc.KeyPath(), rc.KeyQuery()),
+			newReq(http.MethodGet, "http://example.com/a?a=1&a=2", nil, ""),
+			newReq(http.MethodGet, "http://example.com/a?a=2&a=1", nil, ""),
+			false,
+		},
+		{
+			"parts are not ambiguous",
+			rc.KeyBuilder(rc.KeyPath(), rc.KeyQuery()),
+			newReq(http.MethodGet, "http://example.com/a1%3A?", nil, ""),
+			newReq(http.MethodGet, "http://example.com/a?1%3A", nil, ""),
+			false,
+		},
+		{
+			"headers",
+			rc.KeyBuilder(rc.KeyPath(), rc.KeyHeaders("accept-language")),
+			newReq(http.MethodGet, "http://example.com/a", http.Header{"Accept-Language": []string{"ja,  en"}, "User-Agent": []string{"a"}}, ""),
+			newReq(http.MethodGet, "http://example.com/a", http.Header{"Accept-Language": []string{"ja", "en"}, "User-Agent": []string{"b"}}, ""),
+			true,
+		},
+		{
+			"absent and empty header",
+			rc.KeyBuilder(rc.KeyPath(), rc.KeyHeaders("X-Tenant")),
+			newReq(http.MethodGet, "http://example.com/a", http.Header{"X-Tenant": []string{""}}, ""),
+			newReq(http.MethodGet, "http://example.com/a", nil, ""),
+			false,
+		},
+		{
+			"cookies",
+			rc.KeyBuilder(rc.KeyPath(), rc.KeyCookies("session")),
+			newReq(http.MethodGet, "http://example.com/a", http.Header{"Cookie": []string{"session=1; _ga=x"}}, ""),
+			newReq(http.MethodGet, "http://example.com/a", http.Header{"Cookie": []string{"_ga=y; session=1"}}, ""),
+			true,
+		},
+		{
+			"different cookies",
+			rc.KeyBuilder(rc.KeyPath(), rc.KeyCookies("session")),
+			newReq(http.MethodGet, "http://example.com/a", http.Header{"Cookie": []string{"session=1"}}, ""),
+			newReq(http.MethodGet, "http://example.com/a", http.Header{"Cookie": []string{"session=2"}}, ""),
+			false,
+		},
+		{
+			"body",
+			rc.KeyBuilder(rc.KeyPath(), rc.KeyBody()),
+			newReq(http.MethodPost, "http://example.com/a", nil, `{"q":1}`),
+			newReq(http.MethodPost, "http://example.com/a", nil, `{"q":2}`),
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.keyFunc(tt.req) == tt.keyFunc(tt.otherReq)
+			if got != tt.wantEqual {
+				t.Errorf("got %v want %v", got, tt.wantEqual)
+			}
+		})
+	}
+
+	t.Run("body is kept", func(t *testing.T) {
+		req := newReq(http.MethodPost, "http://example.com/a", nil, "hello")
+		k := rc.KeyBuilder(rc.KeyBody())
+		if k(req) != k(req) {
+			t.Error("key of the same body should be the same")
+		}
+		b, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != "hello" {
+			t.Errorf("got %q want %q", got, "hello")
+		}
+	})
+}
+
+func TestKeyBody(t *testing.T) {
+	// The request body is given to the origin without UseRequestBody.
+	keyFunc := rc.KeyBuilder(rc.KeyMethod(), rc.KeyPath(), rc.KeyBody())
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		_, _ = w.Write(b) //nostyle:handlerrors
+	})
+	t.Run("middleware", func(t *testing.T) {
+		m := rc.New(testutil.NewAllCache(t), rc.WithKeyFunc(keyFunc))
+		ts := httptest.NewServer(m(h))
+		t.Cleanup(ts.Close)
+		res, err := ts.Client().Post(ts.URL+"/search", "application/json", strings.NewReader(`{"q":1}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != `{"q":1}` {
+			t.Errorf("got %q want %q", got, `{"q":1}`)
+		}
+	})
+	t.Run("transport", func(t *testing.T) {
+		ts := httptest.NewServer(h)
+		t.Cleanup(ts.Close)
+		tc := &http.Client{Transport: rc.NewTransport(testutil.NewAllCache(t), ts.Client().Transport, rc.WithKeyFunc(keyFunc))}
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/search", io.NopCloser(strings.NewReader(`{"q":1}`)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := tc.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != `{"q":1}` {
+			t.Errorf("got %q want %q", got, `{"q":1}`)
+		}
+	})
+}
+
+func TestKeyFunc(t *testing.T) {
+	var count atomic.Int64
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte(strconv.FormatInt(count.Add(1), 10))) //nostyle:handlerrors
+	})
+	keyFunc := rc.KeyBuilder(rc.KeyMethod(), rc.KeyHost(), rc.KeyPath(), rc.KeyQuery("utm_*", "fbclid"), rc.KeyHeaders("X-Tenant"))
+	cacher := testutil.NewInvalidatableCache(t, testutil.NewAllCache(t))
+	var keys []string
+	var mu sync.Mutex
+	m := rc.New(&keyRecorder{InvalidatableCache: cacher, keys: &keys, mu: &mu}, rc.WithKeyFunc(keyFunc))
+	ts := httptest.NewServer(m(h))
+	t.Cleanup(ts.Close)
+	tc := ts.Client()
+
+	do := func(method, path string, header http.Header) string {
+		t.Helper()
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		res, err := tc.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Wait for storing (all responses to GET are stored).
+		cacher.WaitStored(t, int(count.Load()))
+		return string(b)
+	}
+	tests := []struct {
+		method string
+		path   string
+		header http.Header
+		want   string
+	}{
+		{http.MethodGet, "/items?b=2&a=1", nil, "1"},
+		{http.MethodGet, "/items?a=1&b=2&utm_source=x", nil, "1"},
+		{http.MethodGet, "/items?a=1&b=2&fbclid=y", nil, "1"},
+		{http.MethodGet, "/items?a=1&b=3", nil, "2"},
+		{http.MethodGet, "/items?a=1&b=2", http.Header{"X-Tenant": []string{"t1"}}, "3"},
+		{http.MethodGet, "/items?b=2&a=1", http.Header{"X-Tenant": []string{"t1"}}, "3"},
+		{http.MethodHead, "/items?utm_medium=z&a=1&b=2", nil, ""},
+		{http.MethodDelete, "/items?a=1&b=2&utm_source=x", nil, ""},
+		{http.MethodGet, "/items?b=2&a=1", nil, "4"},
+	}
+	for _, tt := range tests {
+		if got := do(tt.method, tt.path, tt.header); got != tt.want {
+			t.Errorf("%s %s %v: got %q want %q", tt.method, tt.path, tt.header, got, tt.want)
+		}
+	}
+	if got := count.Load(); got != 4 {
+		t.Errorf("got %d want %d", got, 4)
+	}
+	// The keys of the GET requests (including the request as GET for HEAD) passed to Load.
+	mu.Lock()
+	defer mu.Unlock()
+	key := func(path string, header http.Header) string {
+		req := httptest.NewRequest(http.MethodGet, ts.URL+path, nil)
+		req.Header = header
+		return keyFunc(req)
+	}
+	k1, k2, k3 := key("/items?a=1&b=2", nil), key("/items?a=1&b=3", nil), key("/items?a=1&b=2", http.Header{"X-Tenant": []string{"t1"}})
+	if diff := cmp.Diff([]string{k1, k1, k1, k2, k3, k3, k1, k1}, keys); diff != "" {
+		t.Error(diff)
+	}
+}
+
+// keyRecorder records the cache keys passed to Load.
+func TestNoVarySearch(t *testing.T) {
+	var count atomic.Int64
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("No-Vary-Search", `params=("utm_source" "fbclid")`)
+		count.Add(1)
+		_, _ = w.Write([]byte(r.URL.Query().Get("id"))) //nostyle:handlerrors
+	})
+	cacher := testutil.NewAllCache(t)
+	// The cache key does not include the query so that the stored response is loaded for the requests that differ in the query.
+	m := rc.New(cacher, rc.WithKeyFunc(rc.KeyBuilder(rc.KeyMethod(), rc.KeyHost(), rc.KeyPath())))
+	ts := httptest.NewServer(m(h))
+	t.Cleanup(ts.Close)
+	tc := ts.Client()
+
+	tests := []struct {
+		path        string
+		want        string
+		wantOrigins int64
+	}{
+		{"/items?id=1&utm_source=a", "1", 1},
+		{"/items?id=1&utm_source=b", "1", 1},
+		{"/items?fbclid=c&id=1", "1", 1},
+		{"/items?id=1", "1", 1},
+		{"/items?id=2&utm_source=a", "2", 2},
+		{"/items?id=2", "2", 2},
+	}
+	for _, tt := range tests {
+		res, err := tc.Get(ts.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := res.Body.Close(); err != nil {
+			t.Fatal(err)
+		}
+		cacher.WaitStored(t, int(count.Load()))
+		if string(b) != tt.want {
+			t.Errorf("%s: got %q want %q", tt.path, b, tt.want)
+		}
+		if got := count.Load(); got != tt.wantOrigins {
+			t.Errorf("%s: got %d want %d", tt.path, got, tt.wantOrigins)
+		}
+	}
+}
+
+type keyRecorder struct {
+	*testutil.InvalidatableCache
+	keys *[]string
+	mu   *sync.Mutex
+}
+
+func (c *keyRecorder) Load(req *http.Request) (*http.Request, *http.Response, error) {
+	if k, ok := rc.CacheKey(req); ok && req.Method == http.MethodGet {
+		c.mu.Lock()
+		*c.keys = append(*c.keys, k)
+		c.mu.Unlock()
+	}
+	return c.InvalidatableCache.Load(req)
+}
+
+func TestVariants(t *testing.T) {
+	type step struct {
+		acceptEncoding string
+		want           string
+	}
+	// variantCacher is a VariantCacher with the Shared handler.
+	type variantCacher struct {
+		*testutil.VariantCache
+		*rfc9111.Shared
+	}
+	tests := []struct {
+		name        string
+		opts        []rc.Option
+		normalizers map[string]rfc9111.VaryNormalizer
+		steps       []step
+	}{
+		{
+			"alternating variants are stored",
+			nil,
+			nil,
+			[]step{{"gzip", "gzip:1"}, {"", "identity:2"}, {"gzip", "gzip:1"}, {"", "identity:2"}, {"br", "br:3"}, {"br,gzip", "br,gzip:4"}, {"br, gzip", "br,gzip:4"}, {"gzip", "gzip:1"}},
+		},
+		{
+			"oldest variant is deleted",
+			[]rc.Option{rc.WithMaxVariants(2)},
+			nil,
+			[]step{{"gzip", "gzip:1"}, {"", "identity:2"}, {"br", "br:3"}, {"", "identity:2"}, {"br", "br:3"}, {"gzip", "gzip:4"}},
+		},
+		{
+			"variants are selected with the normalizer of the handler",
+			nil,
+			map[string]rfc9111.VaryNormalizer{"Accept-Encoding": rfc9111.AcceptEncodingNormalizer("br", "gzip")},
+			[]step{{"gzip", "gzip:1"}, {"gzip, deflate", "gzip:1"}, {"x-gzip", "gzip:1"}, {"", "identity:2"}, {"deflate", "identity:2"}, {"br;q=0, gzip", "gzip:1"}, {"br", "br:3"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var count atomic.Int64
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				enc := r.Header.Get("Accept-Encoding")
+				if enc == "" {
+					enc = "identity"
+				}
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.Header().Set("Vary", "Accept-Encoding")
+				_, _ = fmt.Fprintf(w, "%s:%d", enc, count.Add(1)) //nostyle:handlerrors
+			})
+			cacher := testutil.NewVariantCache(t)
+			var c rc.Cacher = cacher
+			if tt.normalizers != nil {
+				s, err := rfc9111.NewShared(rfc9111.VaryNormalizers(tt.normalizers))
+				if err != nil {
+					t.Fatal(err)
+				}
+				c = &variantCacher{VariantCache: cacher, Shared: s}
+			}
+			m := rc.New(c, tt.opts...)
+			ts := httptest.NewServer(m(h))
+			t.Cleanup(ts.Close)
+			tc := ts.Client()
+			tc.Transport.(*http.Transport).DisableCompression = true
+			for i, s := range tt.steps {
+				req, err := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if s.acceptEncoding != "" {
+					req.Header.Set("Accept-Encoding", s.acceptEncoding)
+				}
+				res, err := tc.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := io.ReadAll(res.Body)
+				_ = res.Body.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := string(b); got != s.want {
+					t.Errorf("step %d: got %q want %q", i, got, s.want)
+				}
+				// Wait for storing (all responses are stored).
+				cacher.WaitStored(t, int(count.Load()))
+			}
+		})
+	}
+}
+
+func TestCacherV2(t *testing.T) {
+	var count atomic.Int64
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write([]byte(strconv.FormatInt(count.Add(1), 10))) //nostyle:handlerrors
+	})
+	tests := []struct {
+		name    string
+		opts    []rc.Option
+		wantKey func(host string) string
+	}{
+		{"default key", nil, func(host string) string { return "GET|" + host + "|/items|a=1" }},
+		{"KeyFunc", []rc.Option{rc.WithKeyFunc(rc.KeyBuilder(rc.KeyMethod(), rc.KeyPath()))}, func(host string) string { return "3:GET6:/items" }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			count.Store(0)
+			cacher := testutil.NewV2Cache(t)
+			m := rc.New(rc.FromCacherV2(cacher), tt.opts...)
+			ts := httptest.NewServer(m(h))
+			t.Cleanup(ts.Close)
+			tc := ts.Client()
+			before := time.Now()
+			for range 2 {
+				res, err := tc.Get(ts.URL + "/items?a=1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := io.ReadAll(res.Body)
+				_ = res.Body.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := string(b); got != "1" {
+					t.Errorf("got %q want %q", got, "1")
+				}
+				// Wait for storing.
+				cacher.WaitStored(t, 1)
+			}
+			if got := cacher.Hit(); got != 1 {
+				t.Errorf("got %d want %d", got, 1)
+			}
+			entries := cacher.Entries()
+			if len(entries) != 1 {
+				t.Fatalf("got %d want %d", len(entries), 1)
+			}
+			e := entries[0]
+			if want := tt.wantKey(strings.TrimPrefix(ts.URL, "http://")); e.Key != want {
+				t.Errorf("got %q want %q", e.Key, want)
+			}
+			if e.RequestTime.Before(before) || e.ResponseTime.Before(e.RequestTime) || e.StoredAt.Before(e.ResponseTime) {
+				t.Errorf("invalid times: request %v, response %v, stored %v", e.RequestTime, e.ResponseTime, e.StoredAt)
+			}
+			if want := e.ResponseTime.Add(60 * time.Second); e.Expires.Before(want.Add(-2*time.Second)) || e.Expires.After(want.Add(2*time.Second)) {
+				t.Errorf("got %v want about %v", e.Expires, want)
+			}
+		})
+	}
+
+	t.Run("Cacher as CacherV2", func(t *testing.T) {
+		cacher := testutil.NewAllCache(t)
+		v2 := rc.NewCacherV2(cacher)
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/items", nil)
+		res := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Cache-Control": []string{"max-age=60"}}, Body: io.NopCloser(strings.NewReader("hello"))}
+		if err := v2.Store(context.Background(), "key", &rc.Entry{Request: req, Response: res, Expires: time.Now().Add(time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+		e, err := v2.Load(context.Background(), "key", req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer e.Request.Body.Close()
+		defer e.Response.Body.Close()
+		if e.Key != "key" {
+			t.Errorf("got %q want %q", e.Key, "key")
+		}
+		b, err := io.ReadAll(e.Response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(b); got != "hello" {
+			t.Errorf("got %q want %q", got, "hello")
+		}
+	})
+
+	t.Run("exact age", func(t *testing.T) {
+		tests := []struct {
+			name         string
+			cacheControl string
+			wantBody     string
+			wantAge      string
+		}{
+			// The clock of the origin is 40 seconds ahead, so the Date header field is 10 seconds ago although the response was received 50 seconds ago.
+			{"stale", "max-age=30", "1", ""},
+			{"fresh", "max-age=60", "stored", "51"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				count.Store(0)
+				cacher := testutil.NewV2Cache(t)
+				m := rc.New(rc.FromCacherV2(cacher))
+				ts := httptest.NewServer(m(h))
+				t.Cleanup(ts.Close)
+				now := time.Now()
+				req := httptest.NewRequest(http.MethodGet, ts.URL+"/items", nil)
+				res := &http.Response{
+					StatusCode:    http.StatusOK,
+					Header:        http.Header{"Cache-Control": []string{tt.cacheControl}, "Date": []string{now.Add(-10 * time.Second).UTC().Format(http.TimeFormat)}},
+					Body:          io.NopCloser(strings.NewReader("stored")),
+					ContentLength: 6,
+				}
+				key := "GET|" + req.Host + "|/items|"
+				if err := cacher.Store(context.Background(), key, &rc.Entry{Key: key, Request: req, Response: res, RequestTime: now.Add(-51 * time.Second), ResponseTime: now.Add(-50 * time.Second)}); err != nil {
+					t.Fatal(err)
+				}
+				got, err := ts.Client().Get(ts.URL + "/items")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer got.Body.Close()
+				b, err := io.ReadAll(got.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(b) != tt.wantBody {
+					t.Errorf("got %q want %q", string(b), tt.wantBody)
+				}
+				if age := got.Header.Get("Age"); age != tt.wantAge {
+					t.Errorf("got %q want %q", age, tt.wantAge)
+				}
+			})
+		}
+	})
+}
+
+func TestCacherV2OptionalInterfaces(t *testing.T) {
+	tests := []struct {
+		name      string
+		opts      []rc.Option
+		method    string
+		resHeader http.Header
+		want      string
+	}{
+		{"Handler", nil, http.MethodGet, nil, "Handle"},
+		{"VaryNormalizingHandler", nil, http.MethodGet, http.Header{"Vary": []string{"Accept-Encoding"}}, "NormalizeVaryField"},
+		{"StreamingCacher", []rc.Option{rc.WithStreaming()}, http.MethodGet, nil, "StoreStream"},
+		{"Invalidator", nil, http.MethodDelete, nil, "Invalidate"},
+		{"SliceCacher", []rc.Option{rc.WithSlice(1024)}, http.MethodGet, nil, "LoadSlice"},
+		{"VariantCacher", nil, http.MethodGet, http.Header{"Vary": []string{"Accept-Encoding"}}, "StoreVariant"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				for k, v := range tt.resHeader {
+					w.Header()[k] = v
+				}
+				_, _ = w.Write([]byte("hello")) //nostyle:handlerrors
+			})
+			cacher := newExtendedV2Cache(t)
+			m := rc.New(rc.FromCacherV2(cacher), tt.opts...)
+			ts := httptest.NewServer(m(h))
+			t.Cleanup(ts.Close)
+			req, err := http.NewRequest(tt.method, ts.URL+"/items", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.Copy(io.Discard, res.Body); err != nil {
+				t.Fatal(err)
+			}
+			if err := res.Body.Close(); err != nil {
+				t.Fatal(err)
+			}
+			cacher.waitCalled(t, tt.want)
+		})
+	}
+}
+
+func TestExchangeTimes(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if v := r.Header.Get("X-Vary"); v != "" {
+			w.Header().Set("Vary", v)
+		}
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader("hello"))
+	})
+	get := func(t *testing.T, tc *http.Client, url string, header http.Header) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header = header
+		res, err := tc.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(io.Discard, res.Body); err != nil {
+			t.Fatal(err)
+		}
+		if err := res.Body.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(t *testing.T, before, requestTime, responseTime time.Time) {
+		t.Helper()
+		if requestTime.Before(before) || responseTime.Before(requestTime) {
+			t.Errorf("invalid times: request %v, response %v", requestTime, responseTime)
+		}
+	}
+	receive := func(t *testing.T, times <-chan [2]time.Time) (time.Time, time.Time) {
+		t.Helper()
+		select {
+		case got := <-times:
+			return got[0], got[1]
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for storing")
+		}
+		return time.Time{}, time.Time{}
+	}
+
+	t.Run("transport", func(t *testing.T) {
+		ts := httptest.NewServer(h)
+		t.Cleanup(ts.Close)
+		cacher := testutil.NewV2Cache(t)
+		tc := &http.Client{Transport: rc.NewTransport(rc.FromCacherV2(cacher), ts.Client().Transport)}
+		before := time.Now()
+		get(t, tc, ts.URL+"/items", nil)
+		cacher.WaitStored(t, 1)
+		entries := cacher.Entries()
+		if len(entries) != 1 {
+			t.Fatalf("got %d want %d", len(entries), 1)
+		}
+		check(t, before, entries[0].RequestTime, entries[0].ResponseTime)
+	})
+
+	t.Run("variant", func(t *testing.T) {
+		cacher := &exchangeTimesVariantCache{VariantCache: testutil.NewVariantCache(t), times: make(chan [2]time.Time, 1)}
+		ts := httptest.NewServer(rc.New(cacher)(h))
+		t.Cleanup(ts.Close)
+		before := time.Now()
+		get(t, ts.Client(), ts.URL+"/items", http.Header{"X-Vary": []string{"Accept-Language"}})
+		requestTime, responseTime := receive(t, cacher.times)
+		check(t, before, requestTime, responseTime)
+	})
+
+	t.Run("slice", func(t *testing.T) {
+		cacher := &exchangeTimesSliceCache{SliceCache: testutil.NewSliceCache(t), times: make(chan [2]time.Time, 1)}
+		ts := httptest.NewServer(rc.New(cacher, rc.WithSlice(8))(h))
+		t.Cleanup(ts.Close)
+		before := time.Now()
+		get(t, ts.Client(), ts.URL+"/items", nil)
+		requestTime, responseTime := receive(t, cacher.times)
+		check(t, before, requestTime, responseTime)
+	})
+}
+
+// exchangeTimesVariantCache is a VariantCache that reports the times of the exchange with the origin given to StoreVariant.
+type exchangeTimesVariantCache struct {
+	*testutil.VariantCache
+	times chan [2]time.Time
+}
+
+func (c *exchangeTimesVariantCache) StoreVariant(req *http.Request, res *http.Response, variant string, expires time.Time) error {
+	requestTime, responseTime, _ := rc.ExchangeTimes(req)
+	select {
+	case c.times <- [2]time.Time{requestTime, responseTime}:
+	default:
+	}
+	return c.VariantCache.StoreVariant(req, res, variant, expires)
+}
+
+// exchangeTimesSliceCache is a SliceCache that reports the times of the exchange with the origin given to StoreSlice.
+type exchangeTimesSliceCache struct {
+	*testutil.SliceCache
+	times chan [2]time.Time
+}
+
+func (c *exchangeTimesSliceCache) StoreSlice(req *http.Request, res *http.Response, index int64, expires time.Time) error {
+	requestTime, responseTime, _ := rc.ExchangeTimes(req)
+	select {
+	case c.times <- [2]time.Time{requestTime, responseTime}:
+	default:
+	}
+	return c.SliceCache.StoreSlice(req, res, index, expires)
+}
+
+// extendedV2Cache is a CacherV2 with the methods of the optional interfaces that report the calls.
+type extendedV2Cache struct {
+	*testutil.V2Cache
+	shared *rfc9111.Shared
+	calls  chan string
+}
+
+func newExtendedV2Cache(t *testing.T) *extendedV2Cache {
+	t.Helper()
+	s, err := rfc9111.NewShared()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &extendedV2Cache{
+		V2Cache: testutil.NewV2Cache(t),
+		shared:  s,
+		calls:   make(chan string, 100),
+	}
+}
+
+// waitCalled waits for the method to be called.
+func (c *extendedV2Cache) waitCalled(t *testing.T, method string) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case m := <-c.calls:
+			if m == method {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s to be called", method)
+		}
+	}
+}
+
+func (c *extendedV2Cache) called(method string) {
+	select {
+	case c.calls <- method:
+	default:
+	}
+}
+
+func (c *extendedV2Cache) Handle(req *http.Request, cachedReq *http.Request, cachedRes *http.Response, do func(*http.Request) (*http.Response, error), now time.Time) (bool, *http.Response, error) {
+	c.called("Handle")
+	return c.shared.Handle(req, cachedReq, cachedRes, do, now)
+}
+
+func (c *extendedV2Cache) Storable(req *http.Request, res *http.Response, now time.Time) (bool, time.Time) {
+	return c.shared.Storable(req, res, now)
+}
+
+func (c *extendedV2Cache) NormalizeVaryField(name string, values []string) (string, bool) {
+	c.called("NormalizeVaryField")
+	return c.shared.NormalizeVaryField(name, values)
+}
+
+func (c *extendedV2Cache) StoreStream(req *http.Request, res *http.Response, body io.Reader, expires time.Time) error {
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return err
+	}
+	c.called("StoreStream")
+	return nil
+}
+
+func (c *extendedV2Cache) Invalidate(req *http.Request) error {
+	c.called("Invalidate")
+	return nil
+}
+
+func (c *extendedV2Cache) LoadSlice(req *http.Request, index int64) (*http.Request, *http.Response, error) {
+	c.called("LoadSlice")
+	return nil, nil, rc.ErrCacheNotFound
+}
+
+func (c *extendedV2Cache) StoreSlice(req *http.Request, res *http.Response, index int64, expires time.Time) error {
+	c.called("StoreSlice")
+	return nil
+}
+
+func (c *extendedV2Cache) Variants(req *http.Request) ([]string, error) {
+	c.called("Variants")
+	return nil, nil
+}
+
+func (c *extendedV2Cache) LoadVariant(req *http.Request, variant string) (*http.Request, *http.Response, error) {
+	c.called("LoadVariant")
+	return nil, nil, rc.ErrCacheNotFound
+}
+
+func (c *extendedV2Cache) StoreVariant(req *http.Request, res *http.Response, variant string, expires time.Time) error {
+	c.called("StoreVariant")
+	return nil
+}
+
+func (c *extendedV2Cache) DeleteVariant(req *http.Request, variant string) error {
+	c.called("DeleteVariant")
+	return nil
+}
+
+func TestCacheStatusHeader(t *testing.T) {
+	type step struct {
+		method string
+		path   string
+		header http.Header
+		want   string // regexp of the Cache-Status header field values joined with ", "
+	}
+	tests := []struct {
+		name  string
+		cache testutil.Cacher
+		id    string
+		steps []step
+	}{
+		{
+			"miss and hit",
+			testutil.NewAllCache(t),
+			"",
+			[]step{
+				{http.MethodGet, "/cacheable", nil, `^rc; fwd=uri-miss; fwd-status=200; ttl=(5[89]|60); stored$`},
+				{http.MethodGet, "/cacheable", nil, `^rc; hit; ttl=(5[89]|60)$`},
+			},
+		},
+		{
+			"not storable",
+			testutil.NewAllCache(t),
+			"",
+			[]step{
+				{http.MethodGet, "/no-store", nil, `^rc; fwd=uri-miss; fwd-status=200$`},
+				{http.MethodGet, "/no-store", nil, `^rc; fwd=uri-miss; fwd-status=200$`},
+			},
+		},
+		{
+			"request directive",
+			testutil.NewAllCache(t),
+			"",
+			[]step{
+				{http.MethodGet, "/cacheable", nil, `^rc; fwd=uri-miss; fwd-status=200; ttl=(5[89]|60); stored$`},
+				{http.MethodGet, "/cacheable", http.Header{"Cache-Control": []string{"no-cache"}}, `^rc; fwd=request; fwd-status=200; ttl=(5[89]|60); stored$`},
+			},
+		},
+		{
+			"stale",
+			testutil.NewAllCache(t),
+			"",
+			[]step{
+				{http.MethodGet, "/stale", nil, `^rc; fwd=uri-miss; fwd-status=200; ttl=0; stored$`},
+				{http.MethodGet, "/stale", nil, `^rc; fwd=stale; fwd-status=200; ttl=0; stored$`},
+			},
+		},
+		{
+			"vary miss",
+			testutil.NewAllCache(t),
+			"",
+			[]step{
+				{http.MethodGet, "/vary", http.Header{"Accept-Language": []string{"en"}}, `^rc; fwd=uri-miss; fwd-status=200; ttl=(5[89]|60); stored$`},
+				{http.MethodGet, "/vary", http.Header{"Accept-Language": []string{"ja"}}, `^rc; fwd=vary-miss; fwd-status=200; ttl=(5[89]|60); stored$`},
+			},
+		},
+		{
+			"bypass",
+			testutil.NewGetOnlyCache(t),
+			"",
+			[]step{
+				{http.MethodPost, "/cacheable", nil, `^rc; fwd=bypass$`},
+			},
+		},
+		{
+			"upstream cache",
+			testutil.NewAllCache(t),
+			"cache.example.com",
+			[]step{
+				{http.MethodGet, "/upstream", nil, `^upstream; hit, cache.example.com; fwd=uri-miss; fwd-status=200; ttl=(5[89]|60); stored$`},
+				{http.MethodGet, "/upstream", nil, `^upstream; hit, cache.example.com; hit; ttl=(5[89]|60)$`},
+			},
+		},
+		{
+			"identifier as string",
+			testutil.NewAllCache(t),
+			`my "cache"`,
+			[]step{
+				{http.MethodGet, "/cacheable", nil, `^"my \\"cache\\""; fwd=uri-miss; fwd-status=200; ttl=(5[89]|60); stored$`},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+				switch r.URL.Path {
+				case "/no-store":
+					w.Header().Set("Cache-Control", "no-store")
+				case "/stale":
+					w.Header().Set("Cache-Control", "max-age=0")
+				case "/vary":
+					w.Header().Set("Cache-Control", "max-age=60")
+					w.Header().Set("Vary", "Accept-Language")
+				case "/upstream":
+					w.Header().Set("Cache-Control", "max-age=60")
+					w.Header().Set("Cache-Status", "upstream; hit")
+				default:
+					w.Header().Set("Cache-Control", "max-age=60")
+				}
+				_, _ = w.Write([]byte("hello")) //nostyle:handlerrors
+			})
+			m := rc.New(tt.cache, rc.WithCacheStatusHeader(tt.id))
+			ts := httptest.NewServer(m(h))
+			t.Cleanup(ts.Close)
+			tc := ts.Client()
+			stored := 0
+			for i, s := range tt.steps {
+				req, err := http.NewRequest(s.method, ts.URL+s.path, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for k, v := range s.header {
+					req.Header[k] = v
+				}
+				res, err := tc.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, _ = io.ReadAll(res.Body) //nostyle:handlerrors
+				res.Body.Close()
+				got := strings.Join(res.Header.Values("Cache-Status"), ", ")
+				if !regexp.MustCompile(s.want).MatchString(got) {
+					t.Errorf("request %d: got %q want %q", i, got, s.want)
+				}
+				if strings.HasSuffix(s.want, "; stored$") {
+					// Wait for storing.
+					stored++
+					tt.cache.WaitStored(t, stored)
+				}
+			}
+		})
+	}
+
+	t.Run("transport", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+			w.Header().Set("Cache-Control", "max-age=60")
+			_, _ = w.Write([]byte("hello")) //nostyle:handlerrors
+		}))
+		t.Cleanup(ts.Close)
+		cacher := testutil.NewAllCache(t)
+		tc := &http.Client{Transport: rc.NewTransport(cacher, ts.Client().Transport, rc.WithCacheStatusHeader(""))}
+		for i, want := range []string{`^rc; fwd=uri-miss; fwd-status=200; ttl=(5[89]|60); stored$`, `^rc; hit; ttl=(5[89]|60)$`} {
+			res, err := tc.Get(ts.URL + "/transport")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = io.ReadAll(res.Body) //nostyle:handlerrors
+			res.Body.Close()
+			if got := res.Header.Get("Cache-Status"); !regexp.MustCompile(want).MatchString(got) {
+				t.Errorf("request %d: got %q want %q", i, got, want)
+			}
+			// Wait for storing.
+			cacher.WaitStored(t, 1)
+		}
+	})
+}
+
+func TestDecision(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		wantHeader []string
+		wantStored int
+	}{
+		{
+			"stored and used",
+			"/cacheable",
+			[]string{
+				`max-age; section="RFC 9111 Section 5.2.2.1"; lifetime=60, uri-miss; section="RFC 9111 Section 4"`,
+				`fresh; section="RFC 9111 Section 4.2"; lifetime=60`,
+			},
+			1,
+		},
+		{
+			"not storable",
+			"/private",
+			[]string{
+				`private; section="RFC 9111 Section 5.2.2.7", uri-miss; section="RFC 9111 Section 4"`,
+				`private; section="RFC 9111 Section 5.2.2.7", uri-miss; section="RFC 9111 Section 4"`,
+			},
+			0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+				if r.URL.Path == "/private" {
+					w.Header().Set("Cache-Control", "private, max-age=60")
+				} else {
+					w.Header().Set("Cache-Control", "max-age=60")
+				}
+				_, _ = w.Write([]byte("hello")) //nostyle:handlerrors
+			})
+			var (
+				got []rfc9111.DecisionReason
+				mu  sync.Mutex
+			)
+			hook := func(req *http.Request, d rfc9111.Decision) {
+				mu.Lock()
+				defer mu.Unlock()
+				got = append(got, d.Reason)
+			}
+			cacher := testutil.NewAllCache(t)
+			m := rc.New(cacher, rc.WithDecisionHeader("X-Cache-Decision"), rc.WithDecisionHook(hook))
+			ts := httptest.NewServer(m(h))
+			t.Cleanup(ts.Close)
+			tc := ts.Client()
+			var want []rfc9111.DecisionReason
+			for i, wantHeader := range tt.wantHeader {
+				res, err := tc.Get(ts.URL + tt.path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, _ = io.ReadAll(res.Body) //nostyle:handlerrors
+				res.Body.Close()
+				if got := res.Header.Get("X-Cache-Decision"); got != wantHeader {
+					t.Errorf("request %d: got %q want %q", i, got, wantHeader)
+				}
+				for _, m := range strings.Split(wantHeader, ", ") {
+					want = append(want, rfc9111.DecisionReason(strings.SplitN(m, ";", 2)[0]))
+				}
+				// Wait for storing.
+				cacher.WaitStored(t, tt.wantStored)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestStoredHeader(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl string
+		field        string
+	}{
+		{`no-cache="Set-Cookie"`, `no-cache="Set-Cookie", max-age=60`, "Set-Cookie"},
+		{`private="Set-Cookie"`, `private="Set-Cookie", max-age=60`, "Set-Cookie"},
+		{`private="X-User"`, `private="X-User", max-age=60`, "X-User"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+				w.Header().Set("Cache-Control", tt.cacheControl)
+				w.Header().Set(tt.field, "secret")
+				_, _ = w.Write([]byte("hello")) //nostyle:handlerrors
+			})
+			cacher := testutil.NewAllCache(t)
+			m := rc.New(cacher)
+			ts := httptest.NewServer(m(h))
+			t.Cleanup(ts.Close)
+			tc := ts.Client()
+			for i, want := range []string{"secret", ""} {
+				res, err := tc.Get(ts.URL)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, _ = io.ReadAll(res.Body) //nostyle:handlerrors
+				res.Body.Close()
+				// The response of the origin has the field, but the stored response does not.
+				if got := res.Header.Get(tt.field); got != want {
+					t.Errorf("request %d: got %q want %q", i, got, want)
+				}
+				// Wait for storing.
+				cacher.WaitStored(t, 1)
+			}
+			if cacher.Hit() != 1 {
+				t.Errorf("got %v want %v", cacher.Hit(), 1)
+			}
+		})
+	}
+}
+
+func TestRangeRequests(t *testing.T) {
+	const body = "0123456789abcdefghij"
+	type step struct {
+		header           http.Header
+		wantStatus       int
+		wantContentRange string
+		wantBody         string
+		wantParts        []string // Content-Range and body of the parts of multipart/byteranges
+	}
+	steps := []step{
+		{http.Header{"Range": []string{"bytes=0-4"}}, http.StatusPartialContent, "bytes 0-4/20", "01234", nil},
+		{http.Header{"Range": []string{"bytes=-5"}}, http.StatusPartialContent, "bytes 15-19/20", "fghij", nil},
+		{http.Header{"Range": []string{"bytes=18-100"}}, http.StatusPartialContent, "bytes 18-19/20", "ij", nil},
+		{http.Header{"Range": []string{"bytes=100-"}}, http.StatusRequestedRangeNotSatisfiable, "bytes */20", "", nil},
+		{http.Header{"Range": []string{"items=0-4"}}, http.StatusOK, "", body, nil},
+		{http.Header{"Range": []string{"bytes=0-4"}, "If-Range": []string{`"v1"`}}, http.StatusPartialContent, "bytes 0-4/20", "01234", nil},
+		{http.Header{"Range": []string{"bytes=0-4"}, "If-Range": []string{`"v2"`}}, http.StatusOK, "", body, nil},
+		{http.Header{"Range": []string{"bytes=0-4"}, "If-Range": []string{`W/"v1"`}}, http.StatusOK, "", body, nil},
+		{http.Header{"Range": []string{"bytes=0-1, 10-11"}}, http.StatusPartialContent, "", "", []string{"bytes 0-1/20:01", "bytes 10-11/20:ab"}},
+		{nil, http.StatusOK, "", body, nil},
+	}
+	check := func(t *testing.T, i int, s step, res *http.Response) {
+		t.Helper()
+		if res.StatusCode != s.wantStatus {
+			t.Errorf("request %d: got %v want %v", i, res.StatusCode, s.wantStatus)
+		}
+		if got := res.Header.Get("Content-Range"); got != s.wantContentRange {
+			t.Errorf("request %d: got %q want %q", i, got, s.wantContentRange)
+		}
+		if s.wantParts == nil {
+			b, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != s.wantBody {
+				t.Errorf("request %d: got %q want %q", i, string(b), s.wantBody)
+			}
+			return
+		}
+		mt, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mt != "multipart/byteranges" {
+			t.Errorf("request %d: got %q want %q", i, mt, "multipart/byteranges")
+		}
+		var got []string
+		mr := multipart.NewReader(res.Body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, p.Header.Get("Content-Range")+":"+string(b))
+		}
+		if diff := cmp.Diff(s.wantParts, got); diff != "" {
+			t.Errorf("request %d: %s", i, diff)
+		}
+	}
+	newHandler := func(called *atomic.Int64) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called.Add(1)
+			if r.Header.Get("Range") != "" || r.Header.Get("If-Range") != "" {
+				t.Error("the range request should not be sent to the origin")
+			}
+			w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("ETag", `"v1"`)
+			w.Header().Set("Content-Type", "text/plain")
+			_, _ = w.Write([]byte(body)) //nostyle:handlerrors
+		})
+	}
+
+	tests := []struct {
+		name string
+		opts []rc.Option
+	}{
+		{"default", []rc.Option{rc.WithRangeRequests()}},
+		{"streaming", []rc.Option{rc.WithRangeRequests(), rc.WithStreaming()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var called atomic.Int64
+			cacher := testutil.NewAllCache(t)
+			m := rc.New(cacher, tt.opts...)
+			ts := httptest.NewServer(m(newHandler(&called)))
+			t.Cleanup(ts.Close)
+			tc := ts.Client()
+			for i, s := range steps {
+				req, err := http.NewRequest(http.MethodGet, ts.URL+"/range", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for k, v := range s.header {
+					req.Header[k] = v
+				}
+				res, err := tc.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				check(t, i, s, res)
+				res.Body.Close()
+				// Wait for storing (the response to the first request is stored).
+				cacher.WaitStored(t, 1)
+			}
+			// Wait for the handlers to close the stored responses.
+			ts.Close()
+			if got := called.Load(); got != 1 {
+				t.Errorf("the origin called %d times, want 1", got)
+			}
+		})
+	}
+
+	t.Run("transport", func(t *testing.T) {
+		var called atomic.Int64
+		ts := httptest.NewServer(newHandler(&called))
+		t.Cleanup(ts.Close)
+		cacher := testutil.NewAllCache(t)
+		tc := &http.Client{Transport: rc.NewTransport(cacher, ts.Client().Transport, rc.WithRangeRequests())}
+		for i, s := range steps {
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/range", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for k, v := range s.header {
+				req.Header[k] = v
+			}
+			res, err := tc.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			check(t, i, s, res)
+			res.Body.Close()
+			// Wait for storing (the response to the first request is stored).
+			cacher.WaitStored(t, 1)
+		}
+		if got := called.Load(); got != 1 {
+			t.Errorf("the origin called %d times, want 1", got)
+		}
+	})
+}
+
+func TestSlice(t *testing.T) {
+	const body = "0123456789abcdefghij"
+	type step struct {
+		header     http.Header
+		wantStatus int
+		wantBody   string
+		wantStored int // the number of the slices stored after the request
+	}
+	tests := []struct {
+		name             string
+		rangeSupported   bool
+		steps            []step
+		wantOriginRanges []string
+		wantStored       []int64
+	}{
+		{
+			"whole response",
+			true,
+			[]step{
+				{nil, http.StatusOK, body, 3},
+				{nil, http.StatusOK, body, 3},
+				{http.Header{"Range": []string{"bytes=10-12"}}, http.StatusPartialContent, "abc", 3},
+				{http.Header{"Range": []string{"bytes=-3"}}, http.StatusPartialContent, "hij", 3},
+			},
+			[]string{"bytes=0-7", "bytes=8-15", "bytes=16-23"},
+			[]int64{0, 1, 2},
+		},
+		{
+			"range request",
+			true,
+			[]step{
+				{http.Header{"Range": []string{"bytes=17-18"}}, http.StatusPartialContent, "hi", 1},
+				{http.Header{"Range": []string{"bytes=6-9"}}, http.StatusPartialContent, "6789", 3},
+				{http.Header{"Range": []string{"bytes=100-"}}, http.StatusRequestedRangeNotSatisfiable, "invalid range: failed to overlap\n", 3},
+			},
+			[]string{"bytes=16-23", "bytes=0-7", "bytes=8-15", "bytes=96-103"},
+			[]int64{0, 1, 2},
+		},
+		{
+			"origin does not support range requests",
+			false,
+			[]step{
+				{http.Header{"Range": []string{"bytes=10-12"}}, http.StatusPartialContent, "abc", 0},
+				{nil, http.StatusOK, body, 0},
+			},
+			// The whole response is not stored as a slice.
+			[]string{"bytes=8-15", "bytes=0-7"},
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				gotOriginRanges []string
+				mu              sync.Mutex
+			)
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				gotOriginRanges = append(gotOriginRanges, r.Header.Get("Range"))
+				mu.Unlock()
+				w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.Header().Set("ETag", `"v1"`)
+				if !tt.rangeSupported {
+					_, _ = w.Write([]byte(body)) //nostyle:handlerrors
+					return
+				}
+				http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+			})
+			c := testutil.NewSliceCache(t)
+			m := rc.New(c, rc.WithSlice(8))
+			ts := httptest.NewServer(m(h))
+			t.Cleanup(ts.Close)
+			tc := ts.Client()
+			for i, s := range tt.steps {
+				req, err := http.NewRequest(http.MethodGet, ts.URL+"/slice", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for k, v := range s.header {
+					req.Header[k] = v
+				}
+				res, err := tc.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := io.ReadAll(res.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				res.Body.Close()
+				if res.StatusCode != s.wantStatus {
+					t.Errorf("request %d: got %v want %v", i, res.StatusCode, s.wantStatus)
+				}
+				if string(b) != s.wantBody {
+					t.Errorf("request %d: got %q want %q", i, string(b), s.wantBody)
+				}
+				// Wait for storing.
+				c.WaitStored(t, s.wantStored)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if diff := cmp.Diff(tt.wantOriginRanges, gotOriginRanges); diff != "" {
+				t.Error(diff)
+			}
+			if diff := cmp.Diff(tt.wantStored, c.Stored(), cmpopts.SortSlices(func(a, b int64) bool { return a < b })); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+
+	t.Run("etag mismatch", func(t *testing.T) {
+		var called atomic.Int64
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := called.Add(1)
+			w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("ETag", fmt.Sprintf(`"v%d"`, n))
+			http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+		})
+		sc := testutil.NewSliceCache(t)
+		c := &invalidatableSliceCache{SliceCache: sc, invalidator: testutil.NewInvalidatableCache(t, sc)}
+		m := rc.New(c, rc.WithSlice(8))
+		ts := httptest.NewServer(m(h))
+		t.Cleanup(ts.Close)
+		get := func(header http.Header) ([]byte, error) {
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/slice", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header = header
+			res, err := ts.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			return io.ReadAll(res.Body)
+		}
+		// The first slice is stored.
+		if _, err := get(http.Header{"Range": []string{"bytes=0-3"}}); err != nil {
+			t.Fatal(err)
+		}
+		sc.WaitStored(t, 1)
+		// The second slice has the other ETag.
+		if _, err := get(http.Header{}); err == nil {
+			t.Error("the response body should be truncated")
+		}
+		if diff := cmp.Diff([]string{"/slice"}, c.invalidator.Invalidated()); diff != "" {
+			t.Error(diff)
+		}
+		// The stale first slice is not used.
+		b, err := get(http.Header{"Range": []string{"bytes=0-3"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "0123" {
+			t.Errorf("got %q want %q", string(b), "0123")
+		}
+		if got := called.Load(); got != 3 {
+			t.Errorf("the origin called %d times, want 3", got)
+		}
+	})
+}
+
+// invalidatableSliceCache is a SliceCache that invalidates the stored slices.
+type invalidatableSliceCache struct {
+	*testutil.SliceCache
+	invalidator *testutil.InvalidatableCache
+}
+
+func (c *invalidatableSliceCache) Invalidate(req *http.Request) error {
+	return c.invalidator.Invalidate(req)
+}
+
+func TestHeadRequest(t *testing.T) {
+	tests := []struct {
+		name            string
+		header          func(n int64) http.Header
+		wantOriginCalls []string
+		wantXCache      string
+		wantVersion     string // X-Version of the stored response to GET after HEAD
+		wantInvalidated []string
+		wantStored      int
+	}{
+		{
+			"served from the stored GET",
+			func(n int64) http.Header {
+				return http.Header{"Cache-Control": []string{"max-age=60"}, "X-Version": []string{strconv.FormatInt(n, 10)}}
+			},
+			[]string{http.MethodGet},
+			"HIT",
+			"1",
+			nil,
+			1,
+		},
+		{
+			"the stored GET is freshened by HEAD",
+			func(n int64) http.Header {
+				return http.Header{"Cache-Control": []string{"max-age=0"}, "X-Version": []string{strconv.FormatInt(n, 10)}}
+			},
+			[]string{http.MethodGet, http.MethodHead},
+			"",
+			"2",
+			nil,
+			2,
+		},
+		{
+			"the stored GET is invalidated by HEAD",
+			func(n int64) http.Header {
+				return http.Header{"Cache-Control": []string{"max-age=0"}, "Etag": []string{fmt.Sprintf(`"v%d"`, n)}, "X-Version": []string{strconv.FormatInt(n, 10)}}
+			},
+			[]string{http.MethodGet, http.MethodHead},
+			"",
+			"",
+			[]string{"/head"},
+			1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				called  atomic.Int64
+				methods []string
+				mu      sync.Mutex
+			)
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := called.Add(1)
+				mu.Lock()
+				methods = append(methods, r.Method)
+				mu.Unlock()
+				for k, v := range tt.header(n) {
+					w.Header()[k] = v
+				}
+				w.Header().Set("Date", time.Now().UTC().Format(http.TimeFormat))
+				w.Header().Set("Content-Length", "5")
+				if r.Method == http.MethodHead {
+					return
+				}
+				_, _ = w.Write([]byte("hello")) //nostyle:handlerrors
+			})
+			ac := testutil.NewAllCache(t)
+			c := testutil.NewInvalidatableCache(t, ac)
+			m := rc.New(c)
+			ts := httptest.NewServer(m(h))
+			t.Cleanup(ts.Close)
+			tc := ts.Client()
+
+			res, err := tc.Get(ts.URL + "/head")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = io.ReadAll(res.Body) //nostyle:handlerrors
+			res.Body.Close()
+			// Wait for storing.
+			ac.WaitStored(t, 1)
+
+			res, err = tc.Head(ts.URL + "/head")
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				t.Errorf("got %v want %v", res.StatusCode, http.StatusOK)
+			}
+			if got := res.Header.Get("X-Cache"); got != tt.wantXCache {
+				t.Errorf("got %q want %q", got, tt.wantXCache)
+			}
+			if got := res.ContentLength; got != 5 {
+				t.Errorf("got %v want %v", got, 5)
+			}
+			// Wait for storing (the stored response to GET is stored again if it is freshened).
+			ac.WaitStored(t, tt.wantStored)
+
+			mu.Lock()
+			if diff := cmp.Diff(tt.wantOriginCalls, methods); diff != "" {
+				t.Error(diff)
+			}
+			mu.Unlock()
+			var gotVersion string
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/head", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cachedReq, cachedRes, err := ac.Load(req); err == nil {
+				gotVersion = cachedRes.Header.Get("X-Version")
+				cachedReq.Body.Close()
+				cachedRes.Body.Close()
+			}
+			if gotVersion != tt.wantVersion {
+				t.Errorf("got %q want %q", gotVersion, tt.wantVersion)
+			}
+			if diff := cmp.Diff(tt.wantInvalidated, c.Invalidated()); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestTransport(t *testing.T) {
+	past := func() string {
+		return time.Now().Add(-10 * time.Second).UTC().Format(http.TimeFormat)
+	}
+	tests := []struct {
+		name       string
+		handler    func(n int64, w http.ResponseWriter, r *http.Request)
+		reqHeaders []http.Header
+		wantBodies []string
+		wantStored []int // the number of the responses stored after each request
+		wantOrigin int64
+	}{
+		{
+			"cache hit",
+			func(n int64, w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				_, _ = fmt.Fprintf(w, "%d", n) //nostyle:handlerrors
+			},
+			[]http.Header{{}, {}, {}},
+			[]string{"1", "1", "1"},
+			[]int{1, 1, 1},
+			1,
+		},
+		{
+			"not storable",
+			func(n int64, w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "no-store")
+				_, _ = fmt.Fprintf(w, "%d", n) //nostyle:handlerrors
+			},
+			[]http.Header{{}, {}},
+			[]string{"1", "2"},
+			[]int{0, 0},
+			2,
+		},
+		{
+			"vary",
+			func(n int64, w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.Header().Set("Vary", "Accept-Language")
+				_, _ = fmt.Fprintf(w, "%d", n) //nostyle:handlerrors
+			},
+			[]http.Header{{"Accept-Language": []string{"en"}}, {"Accept-Language": []string{"en"}}, {"Accept-Language": []string{"ja"}}},
+			[]string{"1", "1", "2"},
+			[]int{1, 1, 2},
+			2,
+		},
+		{
+			"revalidation",
+			func(n int64, w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", `"v1"`)
+				if r.Header.Get("If-None-Match") == `"v1"` {
+					w.Header().Set("Cache-Control", "max-age=60")
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("Date", past())
+				w.Header().Set("Cache-Control", "max-age=5")
+				_, _ = fmt.Fprintf(w, "%d", n) //nostyle:handlerrors
+			},
+			[]http.Header{{}, {}, {}},
+			[]string{"1", "1", "1"},
+			[]int{1, 2, 2},
+			2,
+		},
+		{
+			"stale-if-error",
+			func(n int64, w http.ResponseWriter, r *http.Request) {
+				if n > 1 {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				w.Header().Set("Date", past())
+				w.Header().Set("Cache-Control", "max-age=5, stale-if-error=60")
+				_, _ = fmt.Fprintf(w, "%d", n) //nostyle:handlerrors
+			},
+			[]http.Header{{}, {}},
+			[]string{"1", "1"},
+			[]int{1, 1},
+			2,
+		},
+		{
+			"private response",
+			func(n int64, w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "private, max-age=60")
+				_, _ = fmt.Fprintf(w, "%d", n) //nostyle:handlerrors
+			},
+			[]http.Header{{}, {}},
+			[]string{"1", "1"},
+			[]int{1, 1},
+			1,
+		},
+		{
+			"request with Authorization",
+			func(n int64, w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "max-age=60")
+				_, _ = fmt.Fprintf(w, "%d", n) //nostyle:handlerrors
+			},
+			[]http.Header{{"Authorization": []string{"Bearer token"}}, {"Authorization": []string{"Bearer token"}}},
+			[]string{"1", "1"},
+			[]int{1, 1},
+			1,
+		},
+		{
+			"s-maxage is ignored",
+			func(n int64, w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "max-age=60, s-maxage=0")
+				_, _ = fmt.Fprintf(w, "%d", n) //nostyle:handlerrors
+			},
+			[]http.Header{{}, {}},
+			[]string{"1", "1"},
+			[]int{1, 1},
+			1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var count atomic.Int64
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				tt.handler(count.Add(1), w, r)
+			}))
+			t.Cleanup(ts.Close)
+			cacher := testutil.NewAllCache(t)
+			tc := &http.Client{
+				Transport: rc.NewTransport(cacher, ts.Client().Transport),
+			}
+			for i, h := range tt.reqHeaders {
+				req, err := http.NewRequest(http.MethodGet, ts.URL+"/transport", nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				req.Header = h
+				res, err := tc.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := io.ReadAll(res.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				res.Body.Close()
+				if res.StatusCode != http.StatusOK {
+					t.Errorf("request %d: got status code %v want %v", i, res.StatusCode, http.StatusOK)
+				}
+				if res.Request != req {
+					t.Errorf("request %d: the request of the response is not the request", i)
+				}
+				if got := string(b); got != tt.wantBodies[i] {
+					t.Errorf("request %d: got %q want %q", i, got, tt.wantBodies[i])
+				}
+				// Wait for storing.
+				cacher.WaitStored(t, tt.wantStored[i])
+			}
+			if got := count.Load(); got != tt.wantOrigin {
+				t.Errorf("got %v origin requests want %v", got, tt.wantOrigin)
+			}
+		})
+	}
+
+	t.Run("request body is closed on cache hit", func(t *testing.T) {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=60")
+			_, _ = w.Write([]byte("hello")) //nostyle:handlerrors
+		}))
+		t.Cleanup(ts.Close)
+		cacher := testutil.NewAllCache(t)
+		tr := rc.NewTransport(cacher, ts.Client().Transport)
+		for i := range 2 {
+			body := &closeTrackingBody{Reader: strings.NewReader("body")}
+			req, err := http.NewRequest(http.MethodGet, ts.URL+"/transport", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := tr.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.Copy(io.Discard, res.Body); err != nil {
+				t.Fatal(err)
+			}
+			if err := res.Body.Close(); err != nil {
+				t.Fatal(err)
+			}
+			cacher.WaitStored(t, 1)
+			if i == 1 && !body.closed.Load() {
+				t.Error("the request body of the cache hit is not closed")
+			}
+		}
+		if got := cacher.Hit(); got != 1 {
+			t.Errorf("got %d want %d", got, 1)
+		}
+	})
+}
+
+// closeTrackingBody is a request body that records whether it is closed.
+type closeTrackingBody struct {
+	io.Reader
+	closed atomic.Bool
+}
+
+func (b *closeTrackingBody) Close() error {
+	b.closed.Store(true)
+	return nil
+}
+
+func TestPassThrough(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []rc.Option
+	}{
+		{"buffered", nil},
+		{"streaming", []rc.Option{rc.WithStreaming()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var origins atomic.Int64
+			release := make(chan struct{})
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				origins.Add(1)
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.Header().Set("Content-Type", "text/event-stream")
+				_, _ = w.Write([]byte("data: 1\n\n")) //nostyle:handlerrors
+				if err := http.NewResponseController(w).Flush(); err != nil {
+					t.Error(err)
+				}
+				<-release
+				_, _ = w.Write([]byte("data: 2\n\n")) //nostyle:handlerrors
+			})
+			cacher := testutil.NewAllCache(t)
+			m := rc.New(cacher, tt.opts...)
+			ts := httptest.NewServer(m(h))
+			t.Cleanup(ts.Close)
+			tc := ts.Client()
+
+			for range 2 {
+				release = make(chan struct{})
+				res, err := tc.Get(ts.URL + "/events")
+				if err != nil {
+					t.Fatal(err)
+				}
+				// The first event is received before the handler finishes.
+				first := make([]byte, len("data: 1\n\n"))
+				if _, err := io.ReadFull(res.Body, first); err != nil {
+					t.Fatal(err)
+				}
+				close(release)
+				rest, err := io.ReadAll(res.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				res.Body.Close()
+				if got := string(first) + string(rest); got != "data: 1\n\ndata: 2\n\n" {
+					t.Errorf("got %q", got)
+				}
+			}
+			if got := origins.Load(); got != 2 {
+				t.Errorf("got %v want %v", got, 2)
+			}
+			if got := cacher.Hit(); got != 0 {
+				t.Errorf("got %v want %v", got, 0)
+			}
+		})
+	}
+}
+
+func TestInformationalResponseAndTrailers(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []rc.Option
+	}{
+		{"buffered", nil},
+		{"streaming", []rc.Option{rc.WithStreaming()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+				w.WriteHeader(http.StatusEarlyHints)
+				w.Header().Set("Cache-Control", "max-age=60")
+				w.Header().Set("Trailer", "X-Checksum")
+				_, _ = w.Write([]byte("hello")) //nostyle:handlerrors
+				w.Header().Set("X-Checksum", "abc")
+			})
+			m := rc.New(testutil.NewAllCache(t), tt.opts...)
+			ts := httptest.NewServer(m(h))
+			t.Cleanup(ts.Close)
+			tc := ts.Client()
+
+			var got1xx []int
+			trace := &httptrace.ClientTrace{
+				Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+					got1xx = append(got1xx, code)
+					return nil
+				},
+			}
+			req, err := http.NewRequestWithContext(httptrace.WithClientTrace(t.Context(), trace), http.MethodGet, ts.URL+"/hints", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, err := tc.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if string(b) != "hello" {
+				t.Errorf("got %q want %q", b, "hello")
+			}
+			if diff := cmp.Diff([]int{http.StatusEarlyHints}, got1xx); diff != "" {
+				t.Error(diff)
+			}
+			if got := res.Header.Get("Content-Type"); got != "text/plain; charset=utf-8" {
+				t.Errorf("got %v want %v", got, "text/plain; charset=utf-8")
+			}
+			if got := res.Trailer.Get("X-Checksum"); got != "abc" {
+				t.Errorf("got %v want %v", got, "abc")
+			}
+		})
+	}
+}
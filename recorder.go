@@ -0,0 +1,286 @@
+package rc
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// sniffLen is the number of bytes used to detect Content-Type (same as net/http).
+const sniffLen = 512
+
+// clientWriter is the response writer of the client.
+// It is used by the recorders to pass the origin response through to the client (e.g. flushed or hijacked).
+type clientWriter struct {
+	http.ResponseWriter
+	// written reports whether the origin response has been written to the client directly.
+	written bool
+}
+
+func (c *clientWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// recorder is a http.ResponseWriter that records the origin response like net/http.
+// When the handler flushes or hijacks, the response is passed through to the client and is never cached.
+type recorder struct {
+	// cw is nil when the origin is requested in the background.
+	cw          *clientWriter
+	statusCode  int
+	header      http.Header
+	wroteHeader bool
+	// committed is the snapshot of the header when the status code is written.
+	committed   http.Header
+	buf         *bytes.Buffer
+	passThrough bool
+	hijacked    bool
+}
+
+var (
+	_ http.ResponseWriter = (*recorder)(nil)
+	_ http.Flusher        = (*recorder)(nil)
+	_ http.Hijacker       = (*recorder)(nil)
+	_ io.ReaderFrom       = (*recorder)(nil)
+)
+
+func newRecorder(cw *clientWriter) *recorder {
+	return &recorder{
+		cw:     cw,
+		buf:    new(bytes.Buffer),
+		header: make(http.Header),
+	}
+}
+
+func (r *recorder) Header() http.Header {
+	return r.header
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	if r.hijacked {
+		return 0, http.ErrHijacked
+	}
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.passThrough {
+		return r.cw.Write(b)
+	}
+	return r.buf.Write(b)
+}
+
+func (r *recorder) WriteHeader(statusCode int) {
+	if r.wroteHeader || r.hijacked {
+		return
+	}
+	if isInformational(statusCode) {
+		writeInformational(r.cw, r.header, statusCode)
+		return
+	}
+	r.statusCode = statusCode
+	r.wroteHeader = true
+	r.committed = r.header.Clone()
+}
+
+func (r *recorder) ReadFrom(src io.Reader) (int64, error) {
+	if r.hijacked {
+		return 0, http.ErrHijacked
+	}
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.passThrough {
+		return io.Copy(r.cw, src)
+	}
+	return r.buf.ReadFrom(src)
+}
+
+func (r *recorder) Flush() {
+	_ = r.FlushError() //nostyle:handlerrors
+}
+
+// FlushError starts passing the response through to the client and flushes it.
+func (r *recorder) FlushError() error {
+	if r.hijacked {
+		return http.ErrHijacked
+	}
+	if r.cw == nil {
+		// There is no client to flush to.
+		return nil
+	}
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.passThrough {
+		h := r.cw.Header()
+		for k, v := range r.committed {
+			h[k] = v
+		}
+		r.cw.WriteHeader(r.statusCode)
+		r.cw.written = true
+		r.passThrough = true
+		if r.buf.Len() > 0 {
+			if _, err := r.cw.Write(r.buf.Bytes()); err != nil {
+				return err
+			}
+			r.buf.Reset()
+		}
+	}
+	return http.NewResponseController(r.cw.ResponseWriter).Flush()
+}
+
+func (r *recorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if r.cw == nil {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, brw, err := http.NewResponseController(r.cw.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	r.hijacked = true
+	r.cw.written = true
+	return conn, brw, nil
+}
+
+// Unwrap returns the response writer of the client for http.ResponseController.
+func (r *recorder) Unwrap() http.ResponseWriter {
+	if r.cw == nil {
+		return nil
+	}
+	return r.cw.ResponseWriter
+}
+
+// finish is called when the handler returns.
+func (r *recorder) finish() {
+	if r.hijacked {
+		return
+	}
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.passThrough {
+		h := r.cw.Header()
+		for k, v := range trailers(r.header, r.committed) {
+			h[http.TrailerPrefix+k] = v
+		}
+		return
+	}
+	sniffContentType(r.committed, r.statusCode, r.buf.Bytes())
+}
+
+// cacheable reports whether the recorded response can be cached (not passed through to the client).
+func (r *recorder) cacheable() bool {
+	return !r.passThrough && !r.hijacked
+}
+
+// Result returns the recorded response.
+// If the response has been passed through to the client, the body is empty.
+func (r *recorder) Result() *http.Response {
+	res := &http.Response{
+		Status:        http.StatusText(r.statusCode),
+		StatusCode:    r.statusCode,
+		Header:        headerWithoutTrailers(r.committed),
+		Body:          http.NoBody,
+		ContentLength: 0,
+		Trailer:       trailers(r.header, r.committed),
+	}
+	if r.cacheable() {
+		res.Body = io.NopCloser(bytes.NewReader(r.buf.Bytes()))
+		res.ContentLength = int64(r.buf.Len())
+	}
+	return res
+}
+
+func (r *recorder) Reset() {
+	r.statusCode = 0
+	r.header = make(http.Header)
+	r.committed = nil
+	r.wroteHeader = false
+	r.buf.Reset()
+}
+
+func isInformational(statusCode int) bool {
+	// 101 Switching Protocols is the final response of the request.
+	return statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols
+}
+
+// writeInformational writes the 1xx informational response (e.g. 103 Early Hints) to the client.
+func writeInformational(cw *clientWriter, header http.Header, statusCode int) {
+	if cw == nil {
+		return
+	}
+	h := cw.Header()
+	for k, v := range header {
+		h[k] = v
+	}
+	cw.WriteHeader(statusCode)
+}
+
+// sniffContentType sets Content-Type detected from the body if it is not set (like net/http).
+func sniffContentType(header http.Header, statusCode int, body []byte) {
+	if _, ok := header["Content-Type"]; ok {
+		// Content-Type: nil suppresses sniffing.
+		return
+	}
+	if len(body) == 0 || !bodyAllowedForStatus(statusCode) || header.Get("Transfer-Encoding") != "" {
+		return
+	}
+	header.Set("Content-Type", http.DetectContentType(body[:min(len(body), sniffLen)]))
+}
+
+// bodyAllowedForStatus reports whether a given response status code permits a body (see https://www.rfc-editor.org/rfc/rfc9110#section-6.4.1).
+func bodyAllowedForStatus(statusCode int) bool {
+	switch {
+	case statusCode >= 100 && statusCode <= 199:
+		return false
+	case statusCode == http.StatusNoContent:
+		return false
+	case statusCode == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// trailers returns the trailers declared by the Trailer header field or set with http.TrailerPrefix.
+func trailers(header, committed http.Header) http.Header {
+	var t http.Header
+	for _, v := range committed.Values("Trailer") {
+		for _, k := range strings.Split(v, ",") {
+			k = http.CanonicalHeaderKey(strings.TrimSpace(k))
+			vv, ok := header[k]
+			if k == "" || !ok {
+				continue
+			}
+			if t == nil {
+				t = make(http.Header)
+			}
+			t[k] = append([]string(nil), vv...)
+		}
+	}
+	for k, vv := range header {
+		if !strings.HasPrefix(k, http.TrailerPrefix) {
+			continue
+		}
+		if t == nil {
+			t = make(http.Header)
+		}
+		t[http.CanonicalHeaderKey(strings.TrimPrefix(k, http.TrailerPrefix))] = append([]string(nil), vv...)
+	}
+	return t
+}
+
+// headerWithoutTrailers returns a copy of the header without the keys with http.TrailerPrefix.
+func headerWithoutTrailers(header http.Header) http.Header {
+	h := header.Clone()
+	if h == nil {
+		return http.Header{}
+	}
+	for k := range h {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			delete(h, k)
+		}
+	}
+	return h
+}
@@ -0,0 +1,168 @@
+package rc
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/2manymws/rc/rfc9111"
+)
+
+const (
+	defaultRevalidationWorkers   = 8
+	defaultRevalidationQueueSize = 128
+	defaultRevalidationTimeout   = 30 * time.Second
+)
+
+// RevalidationResult is the result of a background revalidation.
+type RevalidationResult int
+
+const (
+	// RevalidationSucceeded means that the origin responded to the background revalidation.
+	RevalidationSucceeded RevalidationResult = iota
+	// RevalidationFailed means that the background revalidation failed (error, timeout or 5xx status code).
+	RevalidationFailed
+	// RevalidationDropped means that the background revalidation was dropped because the queue was full.
+	RevalidationDropped
+)
+
+// String returns the name of the result.
+func (r RevalidationResult) String() string {
+	switch r {
+	case RevalidationSucceeded:
+		return "succeeded"
+	case RevalidationFailed:
+		return "failed"
+	case RevalidationDropped:
+		return "dropped"
+	default:
+		return fmt.Sprintf("RevalidationResult(%d)", int(r))
+	}
+}
+
+var _ rfc9111.Revalidator = (*revalidator)(nil)
+
+// backgroundKey is the context key that marks the request for the origin in the background.
+type backgroundKey struct{}
+
+// isBackground reports whether the request is for the origin in the background.
+func isBackground(req *http.Request) bool {
+	v, ok := req.Context().Value(backgroundKey{}).(bool)
+	return ok && v
+}
+
+// clientWriterFor returns the response writer of the client unless the request is for the origin in the background.
+func clientWriterFor(req *http.Request, cw *clientWriter) *clientWriter {
+	if isBackground(req) {
+		return nil
+	}
+	return cw
+}
+
+// revalidator is a scheduler of background revalidation.
+// It runs at most one revalidation per key at a time with a bounded number of workers and queue.
+type revalidator struct {
+	workers   int
+	queueSize int
+	timeout   time.Duration
+	// done is called when the revalidation is finished or dropped.
+	done func(req *http.Request, result RevalidationResult, err error)
+
+	running  int
+	queue    []*revalidation
+	inflight map[string]struct{}
+	mu       sync.Mutex
+}
+
+type revalidation struct {
+	key string
+	req *http.Request
+	do  func(*http.Request) (*http.Response, error)
+}
+
+func newRevalidator() *revalidator {
+	return &revalidator{
+		workers:   defaultRevalidationWorkers,
+		queueSize: defaultRevalidationQueueSize,
+		timeout:   defaultRevalidationTimeout,
+		done:      func(*http.Request, RevalidationResult, error) {},
+		inflight:  map[string]struct{}{},
+	}
+}
+
+// Revalidate schedules the revalidation of req.
+// If the revalidation of the same resource is already scheduled, it is ignored.
+func (r *revalidator) Revalidate(req *http.Request, do func(*http.Request) (*http.Response, error)) {
+	rv := &revalidation{
+		key: requestKey(req),
+		// The revalidation is detached from the request context because it is cancelled when the response is written.
+		req: req.Clone(context.WithValue(context.WithoutCancel(req.Context()), backgroundKey{}, true)),
+		do:  do,
+	}
+	r.mu.Lock()
+	if _, ok := r.inflight[rv.key]; ok {
+		r.mu.Unlock()
+		return
+	}
+	if r.running < r.workers {
+		r.inflight[rv.key] = struct{}{}
+		r.running++
+		r.mu.Unlock()
+		go r.run(rv)
+		return
+	}
+	if len(r.queue) >= r.queueSize {
+		r.mu.Unlock()
+		r.done(rv.req, RevalidationDropped, nil)
+		return
+	}
+	r.inflight[rv.key] = struct{}{}
+	r.queue = append(r.queue, rv)
+	r.mu.Unlock()
+}
+
+// run runs the revalidation and then the queued ones until the queue is empty.
+func (r *revalidator) run(rv *revalidation) {
+	for {
+		r.revalidate(rv)
+		r.mu.Lock()
+		delete(r.inflight, rv.key)
+		if len(r.queue) == 0 {
+			r.running--
+			r.mu.Unlock()
+			return
+		}
+		rv = r.queue[0]
+		r.queue[0] = nil
+		r.queue = r.queue[1:]
+		r.mu.Unlock()
+	}
+}
+
+func (r *revalidator) revalidate(rv *revalidation) {
+	ctx, cancel := context.WithTimeout(rv.req.Context(), r.timeout)
+	defer cancel()
+	req := rv.req.WithContext(ctx)
+	res, err := rv.do(req)
+	if err != nil {
+		r.done(req, RevalidationFailed, err)
+		return
+	}
+	if res.Body != nil {
+		// Read the body to the end so that the streamed response is stored.
+		_, _ = io.Copy(io.Discard, res.Body) //nostyle:handlerrors
+		_ = res.Body.Close()                 //nostyle:handlerrors
+	}
+	if err := ctx.Err(); err != nil {
+		r.done(req, RevalidationFailed, err)
+		return
+	}
+	if res.StatusCode >= http.StatusInternalServerError {
+		r.done(req, RevalidationFailed, fmt.Errorf("unexpected status code: %d", res.StatusCode))
+		return
+	}
+	r.done(req, RevalidationSucceeded, nil)
+}
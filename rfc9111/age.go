@@ -6,16 +6,43 @@ import (
 	"time"
 )
 
-func setAgeHeader(useCached bool, resHeader http.Header, now time.Time) {
-	// 4.2.3. Calculating Age
+// responseTimes are the times of the request that resulted in the stored response and of the response (https://www.rfc-editor.org/rfc/rfc9111#section-4.2.3).
+type responseTimes struct {
+	// request_time
+	request time.Time
+	// response_time
+	response time.Time
+}
+
+func setAgeHeader(useCached bool, resHeader http.Header, t *responseTimes, now time.Time) {
 	if !useCached {
 		// The presence of an Age header field implies that the response was not generated or validated by the origin server for this request. However, lack of an Age header field does not imply the origin was contacted (https://www.rfc-editor.org/rfc/rfc9111#section-5.1).
 		return
 	}
+	currentAge, ok := calculateAge(resHeader, t, now)
+	if !ok {
+		return
+	}
+	resHeader.Set("Age", strconv.Itoa(currentAge))
+}
+
+// calculateAge returns the current age of the stored response in seconds.
+// If the times of the stored response are unknown (t is nil), request_time is approximated by the Date header field and response_time by now.
+// It returns false if the age cannot be calculated (no valid Date header field).
+func calculateAge(resHeader http.Header, t *responseTimes, now time.Time) (int, bool) {
+	currentAge, ok := currentAge(resHeader, t, now)
+	if !ok {
+		return 0, false
+	}
+	return int(currentAge / time.Second), true
+}
+
+func currentAge(resHeader http.Header, t *responseTimes, now time.Time) (time.Duration, bool) {
+	// 4.2.3. Calculating Age
 	// The following is straight code with the expectation that it will be optimized by the compiler
 	var (
 		// age_value
-		ageValue int
+		ageValue time.Duration
 		// date_value
 		dateValue time.Time
 		// now
@@ -25,28 +52,51 @@ func setAgeHeader(useCached bool, resHeader http.Header, now time.Time) {
 		responseTime time.Time
 		err          error
 	)
-	ageValue, err = strconv.Atoi(resHeader.Get("Age"))
-	if err != nil {
-		ageValue = 0
+	age, err := strconv.Atoi(resHeader.Get("Age"))
+	if err == nil && age > 0 {
+		ageValue = time.Duration(age) * time.Second
 	}
 
 	dateValue, err = http.ParseTime(resHeader.Get("Date"))
-	if err != nil {
-		return
+	switch {
+	case t != nil:
+		requestTime = t.request
+		responseTime = t.response
+		if err != nil {
+			// A recipient with a clock that receives a response with an invalid Date header field value MAY replace that value with the time that response was received (https://www.rfc-editor.org/rfc/rfc9110#section-6.6.1).
+			dateValue = responseTime
+		}
+	case err != nil:
+		return 0, false
+	default:
+		requestTime = dateValue // Approximate value.
+		responseTime = now      // Approximate value.
 	}
-	requestTime = dateValue // Approximate value.
-	responseTime = now      // Approximate value.
 	// apparent_age = max(0, response_time - date_value);
-	apparentAge := max(0, int(responseTime.Sub(dateValue)/time.Second))
+	apparentAge := max(0, responseTime.Sub(dateValue))
 	// response_delay = response_time - request_time
-	responseDelay := int(responseTime.Sub(requestTime) / time.Second)
+	responseDelay := responseTime.Sub(requestTime)
 	// corrected_age_value = age_value + response_delay
 	correctedAgeValue := ageValue + responseDelay
 	// corrected_initial_age = max(apparent_age, corrected_age_value)
 	correctedInitialAge := max(apparentAge, correctedAgeValue)
 	// resident_time = now - response_time;
-	residentTime := int(now.Sub(responseTime) / time.Second)
+	residentTime := now.Sub(responseTime)
 	// current_age = corrected_initial_age + resident_time;
 	currentAge := correctedInitialAge + residentTime
-	resHeader.Set("Age", strconv.Itoa(currentAge))
+	return currentAge, true
+}
+
+// storedFreshness returns the expiration time and the freshness lifetime of the stored response.
+// If the times of the stored response are known, the expiration time is when the current age reaches the freshness lifetime (https://www.rfc-editor.org/rfc/rfc9111#section-4.2).
+func (s *Shared) storedFreshness(d *ResponseDirectives, res *http.Response, t *responseTimes, now time.Time) (time.Time, time.Duration) {
+	expires, lifetime := s.freshness(d, res, now)
+	if t == nil || expires.IsZero() {
+		return expires, lifetime
+	}
+	age, ok := currentAge(res.Header, t, now)
+	if !ok {
+		return expires, lifetime
+	}
+	return now.Add(lifetime - age), lifetime
 }
@@ -82,7 +82,7 @@ func TestSetAgeHeader(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			setAgeHeader(tt.useCached, tt.resHeader, tt.now)
+			setAgeHeader(tt.useCached, tt.resHeader, nil, tt.now)
 			gotAge := tt.resHeader.Get("Age")
 			if gotAge != tt.wantAge {
 				t.Errorf("Age header got = %v, want %v", gotAge, tt.wantAge)
@@ -112,3 +112,68 @@ func headersEqual(a, b http.Header) bool {
 	}
 	return true
 }
+
+func TestCalculateAgeWithResponseTimes(t *testing.T) {
+	now := time.Date(2024, 12, 13, 14, 15, 16, 00, time.UTC)
+	tests := []struct {
+		name      string
+		resHeader http.Header
+		times     *responseTimes
+		want      int
+		wantOK    bool
+	}{
+		{
+			"resident time",
+			http.Header{"Date": []string{now.Add(-50 * time.Second).Format(http.TimeFormat)}},
+			&responseTimes{request: now.Add(-51 * time.Second), response: now.Add(-50 * time.Second)},
+			51,
+			true,
+		},
+		{
+			"Age header and response delay",
+			http.Header{"Age": []string{"30"}, "Date": []string{now.Add(-10 * time.Second).Format(http.TimeFormat)}},
+			&responseTimes{request: now.Add(-12 * time.Second), response: now.Add(-10 * time.Second)},
+			42,
+			true,
+		},
+		{
+			"apparent age of Date header in the past",
+			http.Header{"Date": []string{now.Add(-100 * time.Second).Format(http.TimeFormat)}},
+			&responseTimes{request: now.Add(-10 * time.Second), response: now.Add(-10 * time.Second)},
+			100,
+			true,
+		},
+		{
+			"Date header in the future",
+			http.Header{"Date": []string{now.Add(-10 * time.Second).Format(http.TimeFormat)}},
+			&responseTimes{request: now.Add(-50 * time.Second), response: now.Add(-50 * time.Second)},
+			50,
+			true,
+		},
+		{
+			"no Date header",
+			http.Header{},
+			&responseTimes{request: now.Add(-20 * time.Second), response: now.Add(-20 * time.Second)},
+			20,
+			true,
+		},
+		{
+			"no Date header without times",
+			http.Header{},
+			nil,
+			0,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := calculateAge(tt.resHeader, tt.times, now)
+			if ok != tt.wantOK {
+				t.Errorf("got %v want %v", ok, tt.wantOK)
+			}
+			if got != tt.want {
+				t.Errorf("got %d want %d", got, tt.want)
+			}
+		})
+	}
+}
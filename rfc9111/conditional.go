@@ -0,0 +1,225 @@
+package rfc9111
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// notModifiedHeaderNames are the header fields that a 304 response must contain if they would have been sent in a 200 response (https://www.rfc-editor.org/rfc/rfc9110#section-15.4.5).
+var notModifiedHeaderNames = []string{
+	"Cache-Control",
+	"Content-Location",
+	"Date",
+	"ETag",
+	"Expires",
+	"Vary",
+}
+
+// revalidationRequest returns the conditional request to validate the stored response (https://www.rfc-editor.org/rfc/rfc9111#section-4.3.1).
+// The conditional header fields of the client are replaced with the validators of the stored response so that a 304 response is meant for the cache.
+func revalidationRequest(req *http.Request, cachedRes *http.Response) *http.Request {
+	vreq := unconditionalRequest(req)
+	if cachedRes.Header.Get("ETag") != "" {
+		vreq.Header.Set("If-None-Match", cachedRes.Header.Get("ETag"))
+	}
+	if cachedRes.Header.Get("Last-Modified") != "" {
+		vreq.Header.Set("If-Modified-Since", cachedRes.Header.Get("Last-Modified"))
+	}
+	return vreq
+}
+
+// unconditionalRequest returns a copy of req without the conditional header fields of the client.
+func unconditionalRequest(req *http.Request) *http.Request {
+	ureq := req.Clone(req.Context())
+	if ureq.Header == nil {
+		ureq.Header = http.Header{}
+	}
+	ureq.Header.Del("If-None-Match")
+	ureq.Header.Del("If-Modified-Since")
+	return ureq
+}
+
+// preconditionsNotModified evaluates the conditional header fields of the client against the stored response and returns true if the client's copy is not modified (https://www.rfc-editor.org/rfc/rfc9111#section-4.3.2).
+func preconditionsNotModified(req *http.Request, cachedRes *http.Response, now time.Time) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+	if cachedRes.StatusCode != http.StatusOK {
+		return false
+	}
+	// A recipient MUST ignore If-Modified-Since if the request contains an If-None-Match header field (https://www.rfc-editor.org/rfc/rfc9110#section-13.1.3).
+	if v := req.Header.Values("If-None-Match"); len(v) != 0 {
+		return etagMatched(strings.Join(v, ","), cachedRes.Header.Get("ETag"))
+	}
+	if v := req.Header.Get("If-Modified-Since"); v != "" {
+		ims, err := http.ParseTime(v)
+		if err != nil {
+			// A recipient MUST ignore the If-Modified-Since header field if the received field value is not a valid HTTP-date.
+			return false
+		}
+		// If no Last-Modified header field is present, the Date header field value is used, or the time the response was received if it is not present (https://www.rfc-editor.org/rfc/rfc9111#section-4.3.2).
+		lm := originDate(cachedRes.Header, now)
+		if v := cachedRes.Header.Get("Last-Modified"); v != "" {
+			if t, err := http.ParseTime(v); err == nil {
+				lm = t
+			}
+		}
+		return !lm.After(ims)
+	}
+	return false
+}
+
+// notModifiedResponse returns the 304 (Not Modified) response generated from the stored response.
+func notModifiedResponse(cachedRes *http.Response) *http.Response {
+	h := http.Header{}
+	for _, k := range notModifiedHeaderNames {
+		if v := cachedRes.Header.Values(k); len(v) != 0 {
+			h[http.CanonicalHeaderKey(k)] = append([]string(nil), v...)
+		}
+	}
+	if v := cachedRes.Header.Values("Age"); len(v) != 0 {
+		h["Age"] = append([]string(nil), v...)
+	}
+	return &http.Response{
+		Status:     http.StatusText(http.StatusNotModified),
+		StatusCode: http.StatusNotModified,
+		Proto:      cachedRes.Proto,
+		ProtoMajor: cachedRes.ProtoMajor,
+		ProtoMinor: cachedRes.ProtoMinor,
+		Header:     h,
+		Body:       http.NoBody,
+		Request:    cachedRes.Request,
+	}
+}
+
+// etagMatched reports whether the entity tag matches one of the If-None-Match field value using the weak comparison (https://www.rfc-editor.org/rfc/rfc9110#section-13.1.2).
+func etagMatched(ifNoneMatch, etag string) bool {
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+	opaque := strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	for _, t := range splitETags(ifNoneMatch) {
+		if strings.TrimPrefix(t, "W/") == opaque {
+			return true
+		}
+	}
+	return false
+}
+
+// splitETags splits the list of entity tags.
+// Entity tags are quoted strings that can contain commas.
+func splitETags(v string) []string {
+	var (
+		etags  []string
+		quoted bool
+		start  int
+	)
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '"':
+			quoted = !quoted
+		case ',':
+			if quoted {
+				continue
+			}
+			if t := strings.TrimSpace(v[start:i]); t != "" {
+				etags = append(etags, t)
+			}
+			start = i + 1
+		}
+	}
+	if t := strings.TrimSpace(v[start:]); t != "" {
+		etags = append(etags, t)
+	}
+	return etags
+}
+
+// excludedHeaderNamesOnUpdate are the header fields that are not updated with the 304 response (https://www.rfc-editor.org/rfc/rfc9111#section-3.2).
+var excludedHeaderNamesOnUpdate = []string{
+	"Content-Length",
+	// Connection-specific header fields (https://www.rfc-editor.org/rfc/rfc9110#section-7.6.1).
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Transfer-Encoding",
+	"Upgrade",
+	"Proxy-Authenticate",
+	"Proxy-Authentication-Info",
+	"Proxy-Authorization",
+}
+
+// FreshenHeader updates the header fields of the stored response with the 304 (Not Modified) response received by the validation (https://www.rfc-editor.org/rfc/rfc9111#section-4.3.4).
+// It returns false and does not update stored if the validators of the 304 response do not identify the stored response.
+func FreshenHeader(stored, notModified http.Header) bool {
+	// If the new response contains a validator, it is used to select the stored response to update.
+	if etag := notModified.Get("ETag"); etag != "" {
+		if etag != stored.Get("ETag") {
+			return false
+		}
+	} else if lm := notModified.Get("Last-Modified"); lm != "" && stored.Get("Last-Modified") != "" {
+		if lm != stored.Get("Last-Modified") {
+			return false
+		}
+	}
+	updateHeader(stored, notModified)
+	return true
+}
+
+// FreshenHeaderWithHead updates the header fields of the stored response to GET with the 200 (OK) response to HEAD (https://www.rfc-editor.org/rfc/rfc9111#section-4.3.5).
+// contentLength is the length of the content of the stored response (-1 if unknown).
+// It returns false and does not update stored if the stored response should be considered stale.
+func FreshenHeaderWithHead(stored, head http.Header, contentLength int64) bool {
+	// if the stored response and HEAD response have matching values for any received validator fields (ETag and Last-Modified) and, if the HEAD response has a Content-Length header field, the value of Content-Length matches that of the stored response, the cache SHOULD update the stored response as described below; otherwise, the cache SHOULD consider the stored response to be stale.
+	for _, k := range []string{"ETag", "Last-Modified"} {
+		if v := head.Get(k); v != "" && v != stored.Get(k) {
+			return false
+		}
+	}
+	if v := head.Get("Content-Length"); v != "" {
+		cl := stored.Get("Content-Length")
+		if contentLength >= 0 {
+			cl = strconv.FormatInt(contentLength, 10)
+		}
+		if v != cl {
+			return false
+		}
+	}
+	// If a cache updates a stored response with the metadata provided in a HEAD response, the cache MUST use the header fields provided in the HEAD response to update the stored response (see https://www.rfc-editor.org/rfc/rfc9111#section-3.2).
+	updateHeader(stored, head)
+	return true
+}
+
+// updateHeader updates the header fields of the stored response with the header fields of the provided response.
+func updateHeader(stored, h http.Header) {
+	// 3.2. Updating Stored Header Fields (https://www.rfc-editor.org/rfc/rfc9111#section-3.2)
+	// The cache MUST add each header field in the provided response to the stored response, replacing field values that are already present.
+	excluded := map[string]struct{}{}
+	for _, k := range excludedHeaderNamesOnUpdate {
+		excluded[k] = struct{}{}
+	}
+	for _, v := range h.Values("Connection") {
+		for _, k := range strings.Split(v, ",") {
+			excluded[http.CanonicalHeaderKey(strings.TrimSpace(k))] = struct{}{}
+		}
+	}
+	for k, v := range h {
+		if _, ok := excluded[http.CanonicalHeaderKey(k)]; ok {
+			continue
+		}
+		stored[http.CanonicalHeaderKey(k)] = append([]string(nil), v...)
+	}
+}
+
+// headResponse returns the response to HEAD made from the stored response to GET.
+// The content is not sent in the response to HEAD.
+func headResponse(cachedRes *http.Response) *http.Response {
+	res := *cachedRes
+	res.Body = http.NoBody
+	return &res
+}
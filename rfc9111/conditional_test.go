@@ -0,0 +1,212 @@
+package rfc9111
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFreshenHeader(t *testing.T) {
+	tests := []struct {
+		name        string
+		stored      http.Header
+		notModified http.Header
+		wantOK      bool
+		want        http.Header
+	}{
+		{
+			"Update header fields",
+			http.Header{
+				"Etag":           []string{`"v1"`},
+				"Cache-Control":  []string{"max-age=10"},
+				"Content-Length": []string{"5"},
+				"Content-Type":   []string{"text/plain"},
+			},
+			http.Header{
+				"Etag":           []string{`"v1"`},
+				"Cache-Control":  []string{"max-age=60"},
+				"Content-Length": []string{"0"},
+				"Connection":     []string{"X-Hop"},
+				"X-Hop":          []string{"1"},
+			},
+			true,
+			http.Header{
+				"Etag":           []string{`"v1"`},
+				"Cache-Control":  []string{"max-age=60"},
+				"Content-Length": []string{"5"},
+				"Content-Type":   []string{"text/plain"},
+			},
+		},
+		{
+			"ETag not matched",
+			http.Header{
+				"Etag":          []string{`"v1"`},
+				"Cache-Control": []string{"max-age=10"},
+			},
+			http.Header{
+				"Etag":          []string{`"v2"`},
+				"Cache-Control": []string{"max-age=60"},
+			},
+			false,
+			http.Header{
+				"Etag":          []string{`"v1"`},
+				"Cache-Control": []string{"max-age=10"},
+			},
+		},
+		{
+			"Last-Modified not matched",
+			http.Header{
+				"Last-Modified": []string{"Fri, 13 Dec 2024 14:14:46 GMT"},
+				"Cache-Control": []string{"max-age=10"},
+			},
+			http.Header{
+				"Last-Modified": []string{"Fri, 13 Dec 2024 14:15:16 GMT"},
+				"Cache-Control": []string{"max-age=60"},
+			},
+			false,
+			http.Header{
+				"Last-Modified": []string{"Fri, 13 Dec 2024 14:14:46 GMT"},
+				"Cache-Control": []string{"max-age=10"},
+			},
+		},
+		{
+			"No validators",
+			http.Header{
+				"Etag":          []string{`"v1"`},
+				"Cache-Control": []string{"max-age=10"},
+			},
+			http.Header{
+				"Cache-Control": []string{"max-age=60"},
+			},
+			true,
+			http.Header{
+				"Etag":          []string{`"v1"`},
+				"Cache-Control": []string{"max-age=60"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.stored.Clone()
+			if ok := FreshenHeader(got, tt.notModified); ok != tt.wantOK {
+				t.Errorf("FreshenHeader() = %v, want %v", ok, tt.wantOK)
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Errorf("FreshenHeader() stored header:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestFreshenHeaderWithHead(t *testing.T) {
+	tests := []struct {
+		name          string
+		stored        http.Header
+		contentLength int64
+		head          http.Header
+		wantOK        bool
+		want          http.Header
+	}{
+		{
+			"Update header fields",
+			http.Header{
+				"Etag":          []string{`"v1"`},
+				"Cache-Control": []string{"max-age=10"},
+				"Content-Type":  []string{"text/plain"},
+			},
+			5,
+			http.Header{
+				"Etag":           []string{`"v1"`},
+				"Cache-Control":  []string{"max-age=60"},
+				"Content-Length": []string{"5"},
+			},
+			true,
+			http.Header{
+				"Etag":          []string{`"v1"`},
+				"Cache-Control": []string{"max-age=60"},
+				"Content-Type":  []string{"text/plain"},
+			},
+		},
+		{
+			"ETag not matched",
+			http.Header{
+				"Etag":          []string{`"v1"`},
+				"Cache-Control": []string{"max-age=10"},
+			},
+			5,
+			http.Header{
+				"Etag":          []string{`"v2"`},
+				"Cache-Control": []string{"max-age=60"},
+			},
+			false,
+			http.Header{
+				"Etag":          []string{`"v1"`},
+				"Cache-Control": []string{"max-age=10"},
+			},
+		},
+		{
+			"Last-Modified not matched",
+			http.Header{
+				"Etag":          []string{`"v1"`},
+				"Last-Modified": []string{"Fri, 13 Dec 2024 14:14:46 GMT"},
+			},
+			5,
+			http.Header{
+				"Etag":          []string{`"v1"`},
+				"Last-Modified": []string{"Fri, 13 Dec 2024 14:15:16 GMT"},
+			},
+			false,
+			http.Header{
+				"Etag":          []string{`"v1"`},
+				"Last-Modified": []string{"Fri, 13 Dec 2024 14:14:46 GMT"},
+			},
+		},
+		{
+			"Content-Length not matched",
+			http.Header{
+				"Etag":          []string{`"v1"`},
+				"Cache-Control": []string{"max-age=10"},
+			},
+			5,
+			http.Header{
+				"Etag":           []string{`"v1"`},
+				"Cache-Control":  []string{"max-age=60"},
+				"Content-Length": []string{"6"},
+			},
+			false,
+			http.Header{
+				"Etag":          []string{`"v1"`},
+				"Cache-Control": []string{"max-age=10"},
+			},
+		},
+		{
+			"Content-Length of the stored header",
+			http.Header{
+				"Cache-Control":  []string{"max-age=10"},
+				"Content-Length": []string{"5"},
+			},
+			-1,
+			http.Header{
+				"Cache-Control":  []string{"max-age=60"},
+				"Content-Length": []string{"5"},
+			},
+			true,
+			http.Header{
+				"Cache-Control":  []string{"max-age=60"},
+				"Content-Length": []string{"5"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.stored.Clone()
+			if ok := FreshenHeaderWithHead(got, tt.head, tt.contentLength); ok != tt.wantOK {
+				t.Errorf("FreshenHeaderWithHead() = %v, want %v", ok, tt.wantOK)
+			}
+			if diff := cmp.Diff(got, tt.want); diff != "" {
+				t.Errorf("FreshenHeaderWithHead() stored header:\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package rfc9111
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+type testHandler interface {
+	Storable(req *http.Request, res *http.Response, now time.Time) (bool, time.Time)
+	Handle(req *http.Request, cachedReq *http.Request, cachedRes *http.Response, do func(*http.Request) (*http.Response, error), now time.Time) (bool, *http.Response, error)
+}
+
+// newTestHandlers returns the shared cache and the private cache to be tested with the same table.
+func newTestHandlers(t *testing.T, opts ...SharedOption) map[string]testHandler {
+	t.Helper()
+	s, err := NewShared(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPrivate(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]testHandler{
+		"shared":  s,
+		"private": p,
+	}
+}
+
+func TestConformance_Storable(t *testing.T) {
+	now := time.Date(2024, 12, 13, 14, 15, 16, 00, time.UTC)
+
+	tests := []struct {
+		name        string
+		reqHeader   http.Header
+		resHeader   http.Header
+		wantShared  time.Time
+		wantPrivate time.Time
+	}{
+		{
+			"max-age=10",
+			http.Header{},
+			http.Header{"Cache-Control": []string{"max-age=10"}},
+			now.Add(10 * time.Second),
+			now.Add(10 * time.Second),
+		},
+		{
+			"private, max-age=10",
+			http.Header{},
+			http.Header{"Cache-Control": []string{"private, max-age=10"}},
+			time.Time{},
+			now.Add(10 * time.Second),
+		},
+		{
+			"private with Last-Modified",
+			http.Header{},
+			http.Header{"Cache-Control": []string{"private"}, "Last-Modified": []string{now.Add(-100 * time.Second).Format(http.TimeFormat)}},
+			time.Time{},
+			now.Add(10 * time.Second),
+		},
+		{
+			"s-maxage=10, max-age=20",
+			http.Header{},
+			http.Header{"Cache-Control": []string{"s-maxage=10, max-age=20"}},
+			now.Add(10 * time.Second),
+			now.Add(20 * time.Second),
+		},
+		{
+			"s-maxage=10 only",
+			http.Header{},
+			http.Header{"Cache-Control": []string{"s-maxage=10"}},
+			now.Add(10 * time.Second),
+			time.Time{},
+		},
+		{
+			"Authorization and max-age=10",
+			http.Header{"Authorization": []string{"Bearer token"}},
+			http.Header{"Cache-Control": []string{"max-age=10"}},
+			time.Time{},
+			now.Add(10 * time.Second),
+		},
+		{
+			"Authorization and public, max-age=10",
+			http.Header{"Authorization": []string{"Bearer token"}},
+			http.Header{"Cache-Control": []string{"public, max-age=10"}},
+			now.Add(10 * time.Second),
+			now.Add(10 * time.Second),
+		},
+		{
+			"Set-Cookie and max-age=10",
+			http.Header{},
+			http.Header{"Cache-Control": []string{"max-age=10"}, "Set-Cookie": []string{"session=abc"}},
+			time.Time{},
+			now.Add(10 * time.Second),
+		},
+		{
+			"no-store",
+			http.Header{},
+			http.Header{"Cache-Control": []string{"no-store, max-age=10"}},
+			time.Time{},
+			time.Time{},
+		},
+	}
+	for _, tt := range tests {
+		for name, h := range newTestHandlers(t) {
+			t.Run(tt.name+" ("+name+")", func(t *testing.T) {
+				want := tt.wantShared
+				if name == "private" {
+					want = tt.wantPrivate
+				}
+				req := &http.Request{
+					Host:   "example.com",
+					Method: http.MethodGet,
+					Header: tt.reqHeader,
+				}
+				res := &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     tt.resHeader,
+				}
+				gotOK, gotExpires := h.Storable(req, res, now)
+				if gotOK != !want.IsZero() {
+					t.Errorf("Storable() gotOK = %v, want %v", gotOK, !want.IsZero())
+				}
+				if !gotExpires.Equal(want) {
+					t.Errorf("Storable() gotExpires = %v, want %v", gotExpires, want)
+				}
+			})
+		}
+	}
+}
+
+func TestConformance_Handle(t *testing.T) {
+	now := time.Date(2024, 12, 13, 14, 15, 16, 00, time.UTC)
+	before30sec := now.Add(-30 * time.Second)
+	endpoint, err := url.Parse("https://example.com/api/v1/path/to/resource")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		reqHeader       http.Header
+		cachedResHeader http.Header
+		wantShared      bool
+		wantPrivate     bool
+	}{
+		{
+			"fresh max-age",
+			http.Header{},
+			http.Header{"Date": []string{before30sec.Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=60"}},
+			true,
+			true,
+		},
+		{
+			"fresh s-maxage, stale max-age",
+			http.Header{},
+			http.Header{"Date": []string{before30sec.Format(http.TimeFormat)}, "Cache-Control": []string{"s-maxage=60, max-age=10"}},
+			true,
+			false,
+		},
+		{
+			"stale s-maxage, fresh max-age",
+			http.Header{},
+			http.Header{"Date": []string{before30sec.Format(http.TimeFormat)}, "Cache-Control": []string{"s-maxage=10, max-age=60"}},
+			false,
+			true,
+		},
+		{
+			"stale proxy-revalidate with max-stale",
+			http.Header{"Cache-Control": []string{"max-stale=60"}},
+			http.Header{"Date": []string{before30sec.Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=10, proxy-revalidate"}},
+			false,
+			true,
+		},
+		{
+			"stale must-revalidate with max-stale",
+			http.Header{"Cache-Control": []string{"max-stale=60"}},
+			http.Header{"Date": []string{before30sec.Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=10, must-revalidate"}},
+			false,
+			false,
+		},
+	}
+	for _, tt := range tests {
+		for name, h := range newTestHandlers(t) {
+			t.Run(tt.name+" ("+name+")", func(t *testing.T) {
+				want := tt.wantShared
+				if name == "private" {
+					want = tt.wantPrivate
+				}
+				req := &http.Request{
+					Host:   endpoint.Host,
+					URL:    endpoint,
+					Method: http.MethodGet,
+					Header: tt.reqHeader,
+				}
+				cachedReq := &http.Request{
+					Host:   endpoint.Host,
+					URL:    endpoint,
+					Method: http.MethodGet,
+				}
+				cachedRes := &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     tt.cachedResHeader.Clone(),
+				}
+				do := func(req *http.Request) (*http.Response, error) {
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Header:     http.Header{},
+					}, nil
+				}
+				gotCacheUsed, _, err := h.Handle(req, cachedReq, cachedRes, do, now)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if gotCacheUsed != want {
+					t.Errorf("Handle() gotCacheUsed = %v, want %v", gotCacheUsed, want)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package rfc9111
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Revalidator schedules revalidation of stale responses in the background (e.g. stale-while-revalidate).
+type Revalidator interface { //nostyle:ifacenames
+	// Revalidate requests the origin for req using do in the background.
+	// The context of req is not cancelled when the response is written.
+	Revalidate(req *http.Request, do func(*http.Request) (*http.Response, error))
+}
+
+type revalidatorKey struct{}
+
+// ContextWithRevalidator returns a copy of ctx in which the Revalidator is set.
+// Shared.Handle uses the Revalidator to revalidate stale responses in the background.
+func ContextWithRevalidator(ctx context.Context, r Revalidator) context.Context {
+	return context.WithValue(ctx, revalidatorKey{}, r)
+}
+
+func revalidatorFromContext(ctx context.Context) (Revalidator, bool) {
+	r, ok := ctx.Value(revalidatorKey{}).(Revalidator)
+	return r, ok
+}
+
+type keyFuncKey struct{}
+
+// ContextWithKeyFunc returns a copy of ctx in which the function that returns the cache key of the request is set.
+// Shared.Handle and Private.Handle use the cache key to check that the stored response is for the presented request instead of comparing the target URIs.
+// The key of the stored request is computed with the method of the presented request because the method is checked separately.
+// The query parameters that affect the stored response are still compared if it has the No-Vary-Search header field (see NoVarySearch).
+func ContextWithKeyFunc(ctx context.Context, fn func(req *http.Request) string) context.Context {
+	return context.WithValue(ctx, keyFuncKey{}, fn)
+}
+
+func keyFuncFromContext(ctx context.Context) (func(req *http.Request) string, bool) {
+	fn, ok := ctx.Value(keyFuncKey{}).(func(req *http.Request) string)
+	return fn, ok
+}
+
+type responseTimesKey struct{}
+
+// ContextWithResponseTimes returns a copy of ctx in which the times of the request that resulted in the stored response and of the response are set.
+// It is set to the context of the stored request (cachedReq), and Shared.Handle uses the times to calculate the exact age of the stored response for the Age header field and the freshness (https://www.rfc-editor.org/rfc/rfc9111#section-4.2.3).
+// Without them, the age is approximated by the Date header field.
+func ContextWithResponseTimes(ctx context.Context, requestTime, responseTime time.Time) context.Context {
+	return context.WithValue(ctx, responseTimesKey{}, &responseTimes{request: requestTime, response: responseTime})
+}
+
+func responseTimesFromContext(ctx context.Context) (*responseTimes, bool) {
+	t, ok := ctx.Value(responseTimesKey{}).(*responseTimes)
+	return t, ok
+}
@@ -0,0 +1,144 @@
+package rfc9111
+
+import (
+	"context"
+	"time"
+)
+
+// DecisionReason is the reason code of a decision of Storable or Handle.
+type DecisionReason string
+
+// Reasons of Storable.
+const (
+	// ReasonMethodNotUnderstood means that the request method is not understood by the cache.
+	ReasonMethodNotUnderstood DecisionReason = "method-not-understood"
+	// ReasonStatusNotFinal means that the response status code is not final.
+	ReasonStatusNotFinal DecisionReason = "status-not-final"
+	// ReasonNotModified means that the response is 304 (Not Modified), which only updates the stored response.
+	ReasonNotModified DecisionReason = "not-modified"
+	// ReasonStatusNotUnderstood means that the response status code is not understood by the cache.
+	ReasonStatusNotUnderstood DecisionReason = "status-not-understood"
+	// ReasonRequestNoStore means that the request contains the no-store directive.
+	ReasonRequestNoStore DecisionReason = "request-no-store"
+	// ReasonNoStore means that the response contains the no-store directive.
+	ReasonNoStore DecisionReason = "no-store"
+	// ReasonPrivate means that the response contains the private directive and the cache is shared.
+	ReasonPrivate DecisionReason = "private"
+	// ReasonAuthorization means that the request contains the Authorization header field and the response does not explicitly allow shared caching.
+	ReasonAuthorization DecisionReason = "authorization"
+	// ReasonSetCookie means that the response contains the Set-Cookie header field (THIS IS NOT RFC 9111).
+	ReasonSetCookie DecisionReason = "set-cookie"
+	// ReasonNoFreshnessInformation means that the response contains nothing that allows it to be stored (e.g. max-age or Expires).
+	ReasonNoFreshnessInformation DecisionReason = "no-freshness-information"
+	// ReasonPublic means that the response is stored because of the public directive.
+	ReasonPublic DecisionReason = "public"
+	// ReasonPrivateCache means that the response is stored because of the private directive and the cache is private.
+	ReasonPrivateCache DecisionReason = "private-cache"
+	// ReasonExpires means that the response is stored because of the Expires header field.
+	ReasonExpires DecisionReason = "expires"
+	// ReasonMaxAge means that the response is stored because of the max-age directive.
+	ReasonMaxAge DecisionReason = "max-age"
+	// ReasonSMaxAge means that the response is stored because of the s-maxage directive.
+	ReasonSMaxAge DecisionReason = "s-maxage"
+	// ReasonHeuristic means that the response is stored because its status code is heuristically cacheable.
+	ReasonHeuristic DecisionReason = "heuristic"
+	// ReasonExtension means that the response is stored because of the cache extension directive (see DirectiveExtension).
+	ReasonExtension DecisionReason = "extension"
+	// ReasonExtendedRule means that the response is stored because of the ExtendedRule (THIS IS NOT RFC 9111).
+	ReasonExtendedRule DecisionReason = "extended-rule"
+)
+
+// Reasons of Handle.
+const (
+	// ReasonURIMiss means that there is no stored response for the target URI.
+	ReasonURIMiss DecisionReason = "uri-miss"
+	// ReasonMethodMismatch means that the request method of the stored response does not allow it to be used.
+	ReasonMethodMismatch DecisionReason = "method-mismatch"
+	// ReasonVaryMiss means that the request header fields nominated by Vary do not match.
+	ReasonVaryMiss DecisionReason = "vary-miss"
+	// ReasonNoCache means that the stored response could not be validated although the no-cache directive is present.
+	ReasonNoCache DecisionReason = "no-cache"
+	// ReasonFresh means that the stored response is fresh.
+	ReasonFresh DecisionReason = "fresh"
+	// ReasonStaleWhileRevalidate means that the stale response is used while it is revalidated in the background.
+	ReasonStaleWhileRevalidate DecisionReason = "stale-while-revalidate"
+	// ReasonMaxStale means that the stale response is used because of the max-stale request directive.
+	ReasonMaxStale DecisionReason = "max-stale"
+	// ReasonStaleIfError means that the stale response is used because the origin failed.
+	ReasonStaleIfError DecisionReason = "stale-if-error"
+	// ReasonValidated means that the stored response is used because it is successfully validated.
+	ReasonValidated DecisionReason = "validated"
+	// ReasonNotValidated means that the stored response is not used because the origin returned a new response.
+	ReasonNotValidated DecisionReason = "not-validated"
+	// ReasonStale means that the stored response is stale and is not used.
+	ReasonStale DecisionReason = "stale"
+	// ReasonOnlyIfCached means that 504 (Gateway Timeout) is returned because of the only-if-cached request directive.
+	ReasonOnlyIfCached DecisionReason = "only-if-cached"
+)
+
+// decisionSections are the sections of the RFCs that the reasons are based on.
+var decisionSections = map[DecisionReason]string{
+	ReasonMethodNotUnderstood:    "RFC 9111 Section 3",
+	ReasonStatusNotFinal:         "RFC 9111 Section 3",
+	ReasonNotModified:            "RFC 9111 Section 4.3.4",
+	ReasonStatusNotUnderstood:    "RFC 9111 Section 3",
+	ReasonRequestNoStore:         "RFC 9111 Section 5.2.1.5",
+	ReasonNoStore:                "RFC 9111 Section 5.2.2.5",
+	ReasonPrivate:                "RFC 9111 Section 5.2.2.7",
+	ReasonAuthorization:          "RFC 9111 Section 3.5",
+	ReasonNoFreshnessInformation: "RFC 9111 Section 3",
+	ReasonPublic:                 "RFC 9111 Section 5.2.2.9",
+	ReasonPrivateCache:           "RFC 9111 Section 5.2.2.7",
+	ReasonExpires:                "RFC 9111 Section 5.3",
+	ReasonMaxAge:                 "RFC 9111 Section 5.2.2.1",
+	ReasonSMaxAge:                "RFC 9111 Section 5.2.2.10",
+	ReasonHeuristic:              "RFC 9111 Section 4.2.2",
+	ReasonExtension:              "RFC 9111 Section 5.2.3",
+	ReasonURIMiss:                "RFC 9111 Section 4",
+	ReasonMethodMismatch:         "RFC 9111 Section 4",
+	ReasonVaryMiss:               "RFC 9111 Section 4.1",
+	ReasonNoCache:                "RFC 9111 Section 5.2.2.4",
+	ReasonFresh:                  "RFC 9111 Section 4.2",
+	ReasonStaleWhileRevalidate:   "RFC 5861 Section 3",
+	ReasonMaxStale:               "RFC 9111 Section 5.2.1.2",
+	ReasonStaleIfError:           "RFC 5861 Section 4",
+	ReasonValidated:              "RFC 9111 Section 4.3.3",
+	ReasonNotValidated:           "RFC 9111 Section 4.3.3",
+	ReasonStale:                  "RFC 9111 Section 4.2.4",
+	ReasonOnlyIfCached:           "RFC 9111 Section 5.2.1.7",
+}
+
+// Decision explains why Storable or Handle returned its result.
+type Decision struct {
+	// Reason is the reason code of the decision.
+	Reason DecisionReason
+	// Section is the section of the RFC that the decision is based on (e.g. "RFC 9111 Section 5.2.2.5").
+	// It is empty if the decision is not based on the RFCs.
+	Section string
+	// Lifetime is the freshness lifetime of the response used for the decision (https://www.rfc-editor.org/rfc/rfc9111#section-4.2.1).
+	// It is 0 if the freshness lifetime is not used.
+	Lifetime time.Duration
+}
+
+func newDecision(reason DecisionReason, lifetime time.Duration) Decision {
+	return Decision{
+		Reason:   reason,
+		Section:  decisionSections[reason],
+		Lifetime: lifetime,
+	}
+}
+
+type decisionHookKey struct{}
+
+// ContextWithDecisionHook returns a copy of ctx in which the hook is set.
+// Shared.Storable and Shared.Handle call the hook with the Decision that explains their result.
+func ContextWithDecisionHook(ctx context.Context, hook func(d Decision)) context.Context {
+	return context.WithValue(ctx, decisionHookKey{}, hook)
+}
+
+// reportDecision calls the hook set in ctx with the Decision.
+func reportDecision(ctx context.Context, d Decision) {
+	if hook, ok := ctx.Value(decisionHookKey{}).(func(d Decision)); ok && hook != nil {
+		hook(d)
+	}
+}
@@ -35,6 +35,7 @@ var defaultUnderstoodStatusCodes = []int{
 	// - This implementation does not currently handle Vary: Range or range-specific cache keys
 	// - While RFC 9110 defines 206 as heuristically cacheable, safe caching requires understanding Range semantics
 	// - Users can explicitly add 206 to understood status codes via UnderstoodStatusCodes option if needed
+	// - Range requests can be served from the stored 200 responses instead (see rc.WithRangeRequests)
 	http.StatusMultiStatus,     // 207 / RFC 4918, 11.1
 	http.StatusAlreadyReported, // 208 / RFC 5842, 7.1
 	http.StatusIMUsed,          // 226 / RFC 3229, 10.4.1
@@ -2,10 +2,47 @@ package rfc9111
 
 import (
 	"math"
+	"net/textproto"
 	"strconv"
 	"strings"
 )
 
+// requestDirectiveNames are the names of the request directives (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.1).
+var requestDirectiveNames = []string{
+	"max-age",
+	"max-stale",
+	"min-fresh",
+	"no-cache",
+	"no-store",
+	"no-transform",
+	"only-if-cached",
+}
+
+// maxDeltaSeconds is the value used for the delta-seconds that cannot be represented (https://www.rfc-editor.org/rfc/rfc9111#section-1.2.2).
+const maxDeltaSeconds = uint32(2147483648)
+
+// Directive is a cache directive (https://www.rfc-editor.org/rfc/rfc9111#section-5.2).
+type Directive struct {
+	// Name is the name of the directive in lowercase.
+	Name string
+	// Value is the argument of the directive. The quoted-string form is unquoted.
+	Value string
+	// HasValue reports whether the directive has an argument.
+	HasValue bool
+}
+
+// String returns the directive in the form of the Cache-Control header field.
+// The argument is quoted if it is not a token.
+func (d Directive) String() string {
+	if !d.HasValue {
+		return d.Name
+	}
+	if isToken(d.Value) {
+		return d.Name + "=" + d.Value
+	}
+	return d.Name + "=" + quoteString(d.Value)
+}
+
 type RequestDirectives struct {
 	// max-age https://www.rfc-editor.org/rfc/rfc9111#section-5.2.1.1
 	MaxAge *uint32
@@ -21,6 +58,42 @@ type RequestDirectives struct {
 	NoTransform bool
 	// only-if-cached https://www.rfc-editor.org/rfc/rfc9111#section-5.2.1.7
 	OnlyIfCached bool
+	// Extensions are the cache extension directives that are not understood (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.3).
+	Extensions []Directive
+}
+
+// String returns the directives in the form of the Cache-Control header field.
+func (d *RequestDirectives) String() string {
+	var s []string
+	if d.MaxAge != nil {
+		s = append(s, "max-age="+strconv.FormatUint(uint64(*d.MaxAge), 10))
+	}
+	if d.MaxStale != nil {
+		if *d.MaxStale == math.MaxUint32 {
+			s = append(s, "max-stale")
+		} else {
+			s = append(s, "max-stale="+strconv.FormatUint(uint64(*d.MaxStale), 10))
+		}
+	}
+	if d.MinFresh != nil {
+		s = append(s, "min-fresh="+strconv.FormatUint(uint64(*d.MinFresh), 10))
+	}
+	if d.NoCache {
+		s = append(s, "no-cache")
+	}
+	if d.NoStore {
+		s = append(s, "no-store")
+	}
+	if d.NoTransform {
+		s = append(s, "no-transform")
+	}
+	if d.OnlyIfCached {
+		s = append(s, "only-if-cached")
+	}
+	for _, e := range d.Extensions {
+		s = append(s, e.String())
+	}
+	return strings.Join(s, ", ")
 }
 
 type ResponseDirectives struct {
@@ -32,12 +105,18 @@ type ResponseDirectives struct {
 	MustUnderstand bool
 	// no-cache https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.4
 	NoCache bool
+	// NoCacheFields are the field names listed by the qualified form of no-cache (e.g. no-cache="Set-Cookie").
+	// NoCache is false if only the qualified form is present.
+	NoCacheFields []string
 	// no-store https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.5
 	NoStore bool
 	// no-transform https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.6
 	NoTransform bool
 	// private https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.7
 	Private bool
+	// PrivateFields are the field names listed by the qualified form of private (e.g. private="Set-Cookie").
+	// Private is false if only the qualified form is present.
+	PrivateFields []string
 	// proxy-revalidate https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.8
 	ProxyRevalidate bool
 	// public https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.9
@@ -48,56 +127,98 @@ type ResponseDirectives struct {
 	StaleWhileRevalidate *uint32
 	// stale-if-error https://www.rfc-editor.org/rfc/rfc9111#section-4.2.4 https://www.rfc-editor.org/rfc/rfc5861
 	StaleIfError *uint32
+	// Extensions are the cache extension directives that are not understood (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.3).
+	Extensions []Directive
+
+	// targeted is true if the directives are of the targeted cache control field (https://www.rfc-editor.org/rfc/rfc9213).
+	// Then the Expires header field is ignored.
+	targeted bool
+}
+
+// String returns the directives in the form of the Cache-Control header field.
+func (d *ResponseDirectives) String() string {
+	var s []string
+	if d.MaxAge != nil {
+		s = append(s, "max-age="+strconv.FormatUint(uint64(*d.MaxAge), 10))
+	}
+	if d.MustRevalidate {
+		s = append(s, "must-revalidate")
+	}
+	if d.MustUnderstand {
+		s = append(s, "must-understand")
+	}
+	if d.NoCache {
+		s = append(s, "no-cache")
+	}
+	if len(d.NoCacheFields) != 0 {
+		s = append(s, "no-cache="+quoteString(strings.Join(d.NoCacheFields, ", ")))
+	}
+	if d.NoStore {
+		s = append(s, "no-store")
+	}
+	if d.NoTransform {
+		s = append(s, "no-transform")
+	}
+	if d.Private {
+		s = append(s, "private")
+	}
+	if len(d.PrivateFields) != 0 {
+		s = append(s, "private="+quoteString(strings.Join(d.PrivateFields, ", ")))
+	}
+	if d.ProxyRevalidate {
+		s = append(s, "proxy-revalidate")
+	}
+	if d.Public {
+		s = append(s, "public")
+	}
+	if d.SMaxAge != nil {
+		s = append(s, "s-maxage="+strconv.FormatUint(uint64(*d.SMaxAge), 10))
+	}
+	if d.StaleWhileRevalidate != nil {
+		s = append(s, "stale-while-revalidate="+strconv.FormatUint(uint64(*d.StaleWhileRevalidate), 10))
+	}
+	if d.StaleIfError != nil {
+		s = append(s, "stale-if-error="+strconv.FormatUint(uint64(*d.StaleIfError), 10))
+	}
+	for _, e := range d.Extensions {
+		s = append(s, e.String())
+	}
+	return strings.Join(s, ", ")
 }
 
 // ParseRequestCacheControlHeader parses the Cache-Control header of a request.
 func ParseRequestCacheControlHeader(headers []string) *RequestDirectives {
 	d := &RequestDirectives{}
-	for _, h := range headers {
-		tokens := strings.Split(h, ",")
-		for _, t := range tokens {
-			t = strings.TrimSpace(t)
-			switch {
-			// When there is more than one value present for a given directive (e.g., two Expires header field lines or multiple Cache-Control: max-age directives), either the first occurrence should be used or the response should be considered stale.
-			case strings.HasPrefix(t, "max-age=") && d.MaxAge == nil:
-				sec := strings.TrimPrefix(t, "max-age=")
-				u64, err := strconv.ParseUint(sec, 10, 32)
-				if err != nil {
-					continue
-				}
-				u32 := uint32(u64)
-				d.MaxAge = &u32
-			case strings.HasPrefix(t, "max-stale=") && d.MaxStale == nil:
-				sec := strings.TrimPrefix(t, "max-stale=")
-				u64, err := strconv.ParseUint(sec, 10, 32)
-				if err != nil {
-					continue
-				}
-				u32 := uint32(u64)
-				d.MaxStale = &u32
-			case strings.HasPrefix(t, "max-stale") && d.MaxStale == nil:
+	for _, dir := range ParseDirectives(headers) {
+		switch dir.Name {
+		// When there is more than one value present for a given directive (e.g., two Expires header field lines or multiple Cache-Control: max-age directives), either the first occurrence should be used or the response should be considered stale.
+		case "max-age":
+			d.MaxAge = firstSeconds(d.MaxAge, dir)
+		case "max-stale":
+			if d.MaxStale != nil {
+				continue
+			}
+			if !dir.HasValue {
 				// If no value is assigned to max-stale, then the client will accept a stale response of any age (ref https://www.rfc-editor.org/rfc/rfc9111#section-5.2.1.2).
 				max := uint32(math.MaxUint32)
 				d.MaxStale = &max
-			case strings.HasPrefix(t, "min-fresh=") && d.MinFresh == nil:
-				sec := strings.TrimPrefix(t, "min-fresh=")
-				u64, err := strconv.ParseUint(sec, 10, 32)
-				if err != nil {
-					continue
-				}
-				u32 := uint32(u64)
-				d.MinFresh = &u32
-			case t == "no-cache":
-				d.NoCache = true
-			case t == "no-store":
-				d.NoStore = true
-			case t == "no-transform":
-				d.NoTransform = true
-			case t == "only-if-cached":
-				d.OnlyIfCached = true
-			default:
-				// A cache MUST ignore unrecognized cache directives. (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.3)
+				continue
 			}
+			d.MaxStale = firstSeconds(d.MaxStale, dir)
+		case "min-fresh":
+			d.MinFresh = firstSeconds(d.MinFresh, dir)
+		case "no-cache":
+			d.NoCache = true
+		case "no-store":
+			d.NoStore = true
+		case "no-transform":
+			d.NoTransform = true
+		case "only-if-cached":
+			d.OnlyIfCached = true
+		default:
+			// A cache MUST ignore unrecognized cache directives. (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.3)
+			// They are kept so that they can be passed to the extensions or serialized.
+			d.Extensions = append(d.Extensions, dir)
 		}
 	}
 	return d
@@ -106,64 +227,238 @@ func ParseRequestCacheControlHeader(headers []string) *RequestDirectives {
 // ParseResponseCacheControlHeader parses the Cache-Control header of a response.
 func ParseResponseCacheControlHeader(headers []string) *ResponseDirectives {
 	d := &ResponseDirectives{}
-	for _, h := range headers {
-		tokens := strings.Split(h, ",")
-		for _, t := range tokens {
-			t = strings.TrimSpace(t)
-			switch {
-			// When there is more than one value present for a given directive (e.g., two Expires header field lines or multiple Cache-Control: max-age directives), either the first occurrence should be used or the response should be considered stale.
-			case strings.HasPrefix(t, "max-age=") && d.MaxAge == nil:
-				sec := strings.TrimPrefix(t, "max-age=")
-				u64, err := strconv.ParseUint(sec, 10, 32)
-				if err != nil {
-					continue
-				}
-				u32 := uint32(u64)
-				d.MaxAge = &u32
-			case t == "must-revalidate":
-				d.MustRevalidate = true
-			case t == "must-understand":
-				d.MustUnderstand = true
-			case t == "no-cache":
-				d.NoCache = true
-			case t == "no-store":
-				d.NoStore = true
-			case t == "no-transform":
-				d.NoTransform = true
-			case t == "private":
-				d.Private = true
-			case t == "proxy-revalidate":
-				d.ProxyRevalidate = true
-			case t == "public":
-				d.Public = true
-			case strings.HasPrefix(t, "s-maxage=") && d.SMaxAge == nil:
-				sec := strings.TrimPrefix(t, "s-maxage=")
-				u64, err := strconv.ParseUint(sec, 10, 32)
-				if err != nil {
-					continue
-				}
-				u32 := uint32(u64)
-				d.SMaxAge = &u32
-			case strings.HasPrefix(t, "stale-while-revalidate=") && d.StaleWhileRevalidate == nil:
-				sec := strings.TrimPrefix(t, "stale-while-revalidate=")
-				u64, err := strconv.ParseUint(sec, 10, 32)
-				if err != nil {
-					continue
-				}
-				u32 := uint32(u64)
-				d.StaleWhileRevalidate = &u32
-			case strings.HasPrefix(t, "stale-if-error=") && d.StaleIfError == nil:
-				sec := strings.TrimPrefix(t, "stale-if-error=")
-				u64, err := strconv.ParseUint(sec, 10, 32)
-				if err != nil {
-					continue
-				}
-				u32 := uint32(u64)
-				d.StaleIfError = &u32
-			default:
-				// A cache MUST ignore unrecognized cache directives. (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.3)
+	for _, dir := range ParseDirectives(headers) {
+		switch dir.Name {
+		case "max-age":
+			d.MaxAge = freshnessSeconds(d.MaxAge, dir)
+		case "must-revalidate":
+			d.MustRevalidate = true
+		case "must-understand":
+			d.MustUnderstand = true
+		case "no-cache":
+			if dir.HasValue {
+				d.NoCacheFields = append(d.NoCacheFields, parseFieldNames(dir.Value)...)
+				continue
 			}
+			d.NoCache = true
+		case "no-store":
+			d.NoStore = true
+		case "no-transform":
+			d.NoTransform = true
+		case "private":
+			if dir.HasValue {
+				d.PrivateFields = append(d.PrivateFields, parseFieldNames(dir.Value)...)
+				continue
+			}
+			d.Private = true
+		case "proxy-revalidate":
+			d.ProxyRevalidate = true
+		case "public":
+			d.Public = true
+		case "s-maxage":
+			d.SMaxAge = freshnessSeconds(d.SMaxAge, dir)
+		case "stale-while-revalidate":
+			d.StaleWhileRevalidate = firstSeconds(d.StaleWhileRevalidate, dir)
+		case "stale-if-error":
+			d.StaleIfError = firstSeconds(d.StaleIfError, dir)
+		default:
+			// A cache MUST ignore unrecognized cache directives. (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.3)
+			// They are kept so that they can be passed to the extensions or serialized.
+			d.Extensions = append(d.Extensions, dir)
 		}
 	}
 	return d
 }
+
+// ParseDirectives tokenizes the Cache-Control header field values into directives (https://www.rfc-editor.org/rfc/rfc9111#section-5.2).
+// The directive names are compared case-insensitively, so they are lowercased.
+// The argument can use either token or quoted-string syntax, and the quoted-string is unquoted.
+// Invalid members are skipped.
+func ParseDirectives(headers []string) []Directive {
+	var dirs []Directive
+	for _, h := range headers {
+		i := 0
+		for i < len(h) {
+			dir, next, ok := parseDirective(h, i)
+			if ok {
+				dirs = append(dirs, dir)
+			}
+			i = next
+		}
+	}
+	return dirs
+}
+
+// parseDirective parses the directive that starts at i and returns the index of the next member.
+func parseDirective(h string, i int) (Directive, int, bool) {
+	i = skipOWS(h, i)
+	if i < len(h) && h[i] == ',' {
+		return Directive{}, i + 1, false
+	}
+	start := i
+	for i < len(h) && isTchar(h[i]) {
+		i++
+	}
+	if start == i {
+		return Directive{}, skipMember(h, i), false
+	}
+	dir := Directive{Name: strings.ToLower(h[start:i])}
+	i = skipOWS(h, i)
+	if i < len(h) && h[i] == '=' {
+		dir.HasValue = true
+		i = skipOWS(h, i+1)
+		if i < len(h) && h[i] == '"' {
+			v, next, ok := unquoteString(h, i)
+			if !ok {
+				return Directive{}, len(h), false
+			}
+			dir.Value = v
+			i = next
+		} else {
+			start := i
+			for i < len(h) && isTchar(h[i]) {
+				i++
+			}
+			dir.Value = h[start:i]
+		}
+		i = skipOWS(h, i)
+	}
+	if i < len(h) && h[i] != ',' {
+		return Directive{}, skipMember(h, i), false
+	}
+	return dir, i + 1, true
+}
+
+// unquoteString unquotes the quoted-string that starts at i (https://www.rfc-editor.org/rfc/rfc9110#section-5.6.4).
+func unquoteString(h string, i int) (string, int, bool) {
+	var b strings.Builder
+	for i++; i < len(h); i++ {
+		switch h[i] {
+		case '\\':
+			i++
+			if i < len(h) {
+				_ = b.WriteByte(h[i])
+			}
+		case '"':
+			return b.String(), i + 1, true
+		default:
+			_ = b.WriteByte(h[i])
+		}
+	}
+	return "", i, false
+}
+
+// quoteString returns the quoted-string of s (https://www.rfc-editor.org/rfc/rfc9110#section-5.6.4).
+func quoteString(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	return `"` + r.Replace(s) + `"`
+}
+
+// skipMember returns the index of the next member skipping the invalid member.
+func skipMember(h string, i int) int {
+	quoted := false
+	for ; i < len(h); i++ {
+		switch {
+		case quoted && h[i] == '\\':
+			i++
+		case h[i] == '"':
+			quoted = !quoted
+		case !quoted && h[i] == ',':
+			return i + 1
+		}
+	}
+	return i
+}
+
+func skipOWS(h string, i int) int {
+	for i < len(h) && (h[i] == ' ' || h[i] == '\t') {
+		i++
+	}
+	return i
+}
+
+// isTchar reports whether c is tchar (https://www.rfc-editor.org/rfc/rfc9110#section-5.6.2).
+func isTchar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
+
+func isToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isTchar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// deltaSeconds parses the argument of the directive as delta-seconds (https://www.rfc-editor.org/rfc/rfc9111#section-1.2.2).
+// If the value is greater than the greatest integer that can be represented, 2147483648 (2^31) is used.
+func deltaSeconds(dir Directive) (uint32, bool) {
+	if !dir.HasValue || dir.Value == "" {
+		return 0, false
+	}
+	for i := 0; i < len(dir.Value); i++ {
+		if dir.Value[i] < '0' || dir.Value[i] > '9' {
+			return 0, false
+		}
+	}
+	u64, err := strconv.ParseUint(dir.Value, 10, 32)
+	if err != nil {
+		return maxDeltaSeconds, true
+	}
+	return uint32(u64), true
+}
+
+// firstSeconds returns the first occurrence of the delta-seconds directive.
+// The directive with an invalid argument is ignored.
+func firstSeconds(prev *uint32, dir Directive) *uint32 {
+	if prev != nil {
+		return prev
+	}
+	v, ok := deltaSeconds(dir)
+	if !ok {
+		return nil
+	}
+	return &v
+}
+
+// freshnessSeconds returns the delta-seconds of the directive that determines the freshness lifetime (e.g. max-age).
+// When there is more than one value present for a given directive, either the first occurrence should be used or the response should be considered stale.
+// Caches are encouraged to consider responses that have invalid freshness information (e.g., a max-age directive with non-integer content) to be stale (https://www.rfc-editor.org/rfc/rfc9111#section-4.2.1).
+// So the conflicting duplicates and the invalid argument make the response stale (0).
+func freshnessSeconds(prev *uint32, dir Directive) *uint32 {
+	stale := uint32(0)
+	v, ok := deltaSeconds(dir)
+	if !ok {
+		return &stale
+	}
+	if prev != nil && *prev != v {
+		return &stale
+	}
+	return &v
+}
+
+// parseFieldNames parses the argument of the qualified form of no-cache and private (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.4, https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.7).
+// The quoted-string form is used by senders, but the token form is also accepted.
+func parseFieldNames(v string) []string {
+	v = strings.TrimSpace(v)
+	if len(v) >= 2 && v[0] == '"' && v[len(v)-1] == '"' {
+		v = v[1 : len(v)-1]
+	}
+	var names []string
+	for _, n := range strings.Split(v, ",") {
+		n = strings.TrimSpace(n)
+		if n == "" {
+			continue
+		}
+		names = append(names, textproto.CanonicalMIMEHeaderKey(n))
+	}
+	return names
+}
@@ -0,0 +1,94 @@
+package rfc9111
+
+import (
+	"math"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestParseResponseCacheControlHeader(t *testing.T) {
+	u32 := func(v uint32) *uint32 { return &v }
+	tests := []struct {
+		name    string
+		headers []string
+		want    *ResponseDirectives
+	}{
+		{"unqualified", []string{"no-cache, private"}, &ResponseDirectives{NoCache: true, Private: true}},
+		{"qualified no-cache", []string{`no-cache="Set-Cookie, x-user", max-age=60`}, &ResponseDirectives{NoCacheFields: []string{"Set-Cookie", "X-User"}, MaxAge: u32(60)}},
+		{"qualified private", []string{`private="Set-Cookie"`, "max-age=60"}, &ResponseDirectives{PrivateFields: []string{"Set-Cookie"}, MaxAge: u32(60)}},
+		{"token form", []string{"private=Set-Cookie"}, &ResponseDirectives{PrivateFields: []string{"Set-Cookie"}}},
+		{"both forms", []string{`no-cache, no-cache="X-User"`}, &ResponseDirectives{NoCache: true, NoCacheFields: []string{"X-User"}}},
+		{"uppercase names", []string{"Max-Age=60, PUBLIC"}, &ResponseDirectives{MaxAge: u32(60), Public: true}},
+		{"quoted argument", []string{`max-age="60", stale-if-error="30"`}, &ResponseDirectives{MaxAge: u32(60), StaleIfError: u32(30)}},
+		{"whitespace around =", []string{"max-age = 60"}, &ResponseDirectives{MaxAge: u32(60)}},
+		{"same duplicates", []string{"max-age=60", "max-age=60"}, &ResponseDirectives{MaxAge: u32(60)}},
+		{"conflicting duplicates are stale", []string{"max-age=60, s-maxage=10", "max-age=30, s-maxage=10"}, &ResponseDirectives{MaxAge: u32(0), SMaxAge: u32(10)}},
+		{"invalid max-age is stale", []string{"max-age=abc"}, &ResponseDirectives{MaxAge: u32(0)}},
+		{"overflow", []string{"max-age=99999999999"}, &ResponseDirectives{MaxAge: u32(2147483648)}},
+		{"first stale-while-revalidate", []string{"stale-while-revalidate=10, stale-while-revalidate=20"}, &ResponseDirectives{StaleWhileRevalidate: u32(10)}},
+		{"extensions", []string{`immutable, Foo="a, b", bar=baz`}, &ResponseDirectives{Extensions: []Directive{{Name: "immutable"}, {Name: "foo", Value: "a, b", HasValue: true}, {Name: "bar", Value: "baz", HasValue: true}}}},
+		{"invalid members are skipped", []string{`max-age=60 x, "public", , no-store, no-cache="unterminated`}, &ResponseDirectives{NoStore: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ParseResponseCacheControlHeader(tt.headers)
+			if diff := cmp.Diff(tt.want, got, cmpopts.IgnoreUnexported(ResponseDirectives{})); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestParseRequestCacheControlHeader(t *testing.T) {
+	u32 := func(v uint32) *uint32 { return &v }
+	tests := []struct {
+		name    string
+		headers []string
+		want    *RequestDirectives
+	}{
+		{"directives", []string{"max-age=60, No-Cache", "min-fresh=10"}, &RequestDirectives{MaxAge: u32(60), MinFresh: u32(10), NoCache: true}},
+		{"max-stale without value", []string{"max-stale"}, &RequestDirectives{MaxStale: u32(math.MaxUint32)}},
+		{"first occurrence", []string{"max-age=60, max-age=30"}, &RequestDirectives{MaxAge: u32(60)}},
+		{"extensions", []string{"foo=1"}, &RequestDirectives{Extensions: []Directive{{Name: "foo", Value: "1", HasValue: true}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ParseRequestCacheControlHeader(tt.headers)
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestDirectivesString(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"public, max-age=60", "max-age=60, public"},
+		{`Max-Age="60", no-cache="set-cookie, x-user", Private`, `max-age=60, no-cache="Set-Cookie, X-User", private`},
+		{`immutable, foo="a, \"b\""`, `immutable, foo="a, \"b\""`},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			d := ParseResponseCacheControlHeader([]string{tt.header})
+			got := d.String()
+			if got != tt.want {
+				t.Errorf("got %q want %q", got, tt.want)
+			}
+			// The serialized directives are parsed to the same directives.
+			if diff := cmp.Diff(d, ParseResponseCacheControlHeader([]string{got}), cmpopts.IgnoreUnexported(ResponseDirectives{})); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+
+	rd := ParseRequestCacheControlHeader([]string{"max-stale, no-cache, max-age=0, x-foo"})
+	if got, want := rd.String(), "max-age=0, max-stale, no-cache, x-foo"; got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
@@ -3,3 +3,5 @@ package rfc9111
 import "errors"
 
 var ErrNegativeRatio = errors.New("invalid heuristic expiration ratio (< 0)")
+
+var ErrUnknownRequestDirective = errors.New("unknown request directive")
@@ -0,0 +1,132 @@
+package rfc9111
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DirectiveExtension handles a cache extension directive (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.3).
+// The directive is passed as it is found in the Cache-Control header field of the response (or the targeted cache control field).
+type DirectiveExtension interface { //nostyle:ifacenames
+	// Name returns the name of the directive.
+	Name() string
+	// Storable returns true if the directive allows the response to be stored without explicit freshness information such as max-age (https://www.rfc-editor.org/rfc/rfc9111#section-3).
+	// It cannot allow the response that must not be stored (e.g. no-store).
+	Storable(dir Directive, res *http.Response) bool
+	// Lifetime returns the freshness lifetime of the response given by the directive.
+	// If ok is true, it takes precedence over the other freshness information (https://www.rfc-editor.org/rfc/rfc9111#section-4.2.1).
+	Lifetime(dir Directive, res *http.Response) (lifetime time.Duration, ok bool)
+	// SkipRevalidation returns true if the fresh stored response is used even if the client requests the revalidation (e.g. Cache-Control: no-cache or max-age=0 on reload).
+	SkipRevalidation(dir Directive, req *http.Request) bool
+}
+
+// DirectiveExtensions sets the handlers of the cache extension directives.
+func DirectiveExtensions(exts []DirectiveExtension) SharedOption {
+	return func(s *Shared) error {
+		s.extensions = map[string]DirectiveExtension{}
+		for _, ext := range exts {
+			s.extensions[strings.ToLower(ext.Name())] = ext
+		}
+		return nil
+	}
+}
+
+// extensionDirectives calls fn for each cache extension directive of the response that has the handler until fn returns true.
+func (s *Shared) extensionDirectives(d *ResponseDirectives, fn func(ext DirectiveExtension, dir Directive) bool) bool {
+	for _, dir := range d.Extensions {
+		ext, ok := s.extensions[dir.Name]
+		if !ok {
+			continue
+		}
+		if fn(ext, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// freshness returns the expiration time and the freshness lifetime of the response.
+// The freshness lifetime given by the cache extension directive takes precedence.
+func (s *Shared) freshness(d *ResponseDirectives, res *http.Response, now time.Time) (time.Time, time.Duration) {
+	var lifetime time.Duration
+	if s.extensionDirectives(d, func(ext DirectiveExtension, dir Directive) bool {
+		var ok bool
+		lifetime, ok = ext.Lifetime(dir, res)
+		return ok
+	}) {
+		return originDate(res.Header, now).Add(lifetime), lifetime
+	}
+	return calculateFreshness(d, res.Header, s.heuristicExpirationRatio, now)
+}
+
+// extensionStorable returns true if one of the cache extension directives allows the response to be stored.
+func (s *Shared) extensionStorable(d *ResponseDirectives, res *http.Response) bool {
+	return s.extensionDirectives(d, func(ext DirectiveExtension, dir Directive) bool {
+		return ext.Storable(dir, res)
+	})
+}
+
+// skipRevalidation returns true if one of the cache extension directives skips the revalidation requested by the client.
+func (s *Shared) skipRevalidation(d *ResponseDirectives, req *http.Request) bool {
+	return s.extensionDirectives(d, func(ext DirectiveExtension, dir Directive) bool {
+		return ext.SkipRevalidation(dir, req)
+	})
+}
+
+type immutableExtension struct{}
+
+// ImmutableExtension returns the handler of the immutable response directive (https://www.rfc-editor.org/rfc/rfc8246).
+// The fresh stored response with immutable is used without revalidation even if the client reloads.
+func ImmutableExtension() DirectiveExtension {
+	return immutableExtension{}
+}
+
+func (immutableExtension) Name() string {
+	return "immutable"
+}
+
+func (immutableExtension) Storable(Directive, *http.Response) bool {
+	return false
+}
+
+func (immutableExtension) Lifetime(Directive, *http.Response) (time.Duration, bool) {
+	return 0, false
+}
+
+// Clients SHOULD NOT issue a conditional request during the response's freshness lifetime (e.g., upon a reload) unless explicitly overridden by the user (https://www.rfc-editor.org/rfc/rfc8246#section-2).
+func (immutableExtension) SkipRevalidation(Directive, *http.Request) bool {
+	return true
+}
+
+type ttlExtension struct {
+	name string
+}
+
+// TTLExtension returns the handler of the private response directive that gives the freshness lifetime in seconds to the cache (e.g. rc-ttl=60).
+// The response with the directive is storable and its freshness lifetime takes precedence over max-age, s-maxage and Expires.
+// THIS IS NOT RFC 9111.
+func TTLExtension(name string) DirectiveExtension {
+	return ttlExtension{name: name}
+}
+
+func (e ttlExtension) Name() string {
+	return e.name
+}
+
+func (e ttlExtension) Storable(dir Directive, _ *http.Response) bool {
+	_, ok := deltaSeconds(dir)
+	return ok
+}
+
+func (e ttlExtension) Lifetime(dir Directive, _ *http.Response) (time.Duration, bool) {
+	sec, ok := deltaSeconds(dir)
+	if !ok {
+		return 0, false
+	}
+	return time.Duration(sec) * time.Second, true
+}
+
+func (e ttlExtension) SkipRevalidation(Directive, *http.Request) bool {
+	return false
+}
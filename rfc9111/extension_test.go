@@ -0,0 +1,184 @@
+package rfc9111
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestShared_DirectiveExtensionsStorable(t *testing.T) {
+	now := time.Date(2024, 12, 13, 14, 15, 16, 00, time.UTC)
+	endpoint, err := url.Parse("https://example.com/api/v1/path/to/resource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{
+		Host:   endpoint.Host,
+		URL:    endpoint,
+		Method: http.MethodGet,
+		Header: http.Header{},
+	}
+	tests := []struct {
+		name        string
+		exts        []DirectiveExtension
+		header      http.Header
+		wantOK      bool
+		wantExpires time.Time
+		wantReason  DecisionReason
+	}{
+		{
+			"rc-ttl without extensions -> not storable",
+			nil,
+			http.Header{"Date": []string{now.Format(http.TimeFormat)}, "Cache-Control": []string{"rc-ttl=60"}},
+			false,
+			time.Time{},
+			ReasonNoFreshnessInformation,
+		},
+		{
+			"rc-ttl -> storable",
+			[]DirectiveExtension{TTLExtension("rc-ttl")},
+			http.Header{"Date": []string{now.Format(http.TimeFormat)}, "Cache-Control": []string{"rc-ttl=60"}},
+			true,
+			now.Add(60 * time.Second),
+			ReasonExtension,
+		},
+		{
+			"rc-ttl takes precedence over max-age",
+			[]DirectiveExtension{TTLExtension("rc-ttl")},
+			http.Header{"Date": []string{now.Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=10, RC-TTL=60"}},
+			true,
+			now.Add(60 * time.Second),
+			ReasonMaxAge,
+		},
+		{
+			"invalid rc-ttl -> not storable",
+			[]DirectiveExtension{TTLExtension("rc-ttl")},
+			http.Header{"Date": []string{now.Format(http.TimeFormat)}, "Cache-Control": []string{"rc-ttl=abc"}},
+			false,
+			time.Time{},
+			ReasonNoFreshnessInformation,
+		},
+		{
+			"rc-ttl with no-store -> not storable",
+			[]DirectiveExtension{TTLExtension("rc-ttl")},
+			http.Header{"Date": []string{now.Format(http.TimeFormat)}, "Cache-Control": []string{"no-store, rc-ttl=60"}},
+			false,
+			time.Time{},
+			ReasonNoStore,
+		},
+		{
+			"immutable alone -> not storable",
+			[]DirectiveExtension{ImmutableExtension()},
+			http.Header{"Date": []string{now.Format(http.TimeFormat)}, "Cache-Control": []string{"immutable"}},
+			false,
+			time.Time{},
+			ReasonNoFreshnessInformation,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewShared(DirectiveExtensions(tt.exts))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got Decision
+			ctx := ContextWithDecisionHook(req.Context(), func(d Decision) { got = d })
+			res := &http.Response{StatusCode: http.StatusOK, Header: tt.header}
+			ok, expires := s.Storable(req.WithContext(ctx), res, now)
+			if ok != tt.wantOK {
+				t.Errorf("got %v want %v", ok, tt.wantOK)
+			}
+			if !expires.Equal(tt.wantExpires) {
+				t.Errorf("got %v want %v", expires, tt.wantExpires)
+			}
+			if got.Reason != tt.wantReason {
+				t.Errorf("got %v want %v", got.Reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestShared_DirectiveExtensionsHandle(t *testing.T) {
+	now := time.Date(2024, 12, 13, 14, 15, 16, 00, time.UTC)
+	endpoint, err := url.Parse("https://example.com/api/v1/path/to/resource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name             string
+		exts             []DirectiveExtension
+		reqHeader        http.Header
+		cachedResHeader  http.Header
+		wantOriginCalled bool
+	}{
+		{
+			"immutable fresh with no-cache request -> used without revalidation",
+			[]DirectiveExtension{ImmutableExtension()},
+			http.Header{"Cache-Control": []string{"no-cache"}},
+			http.Header{"Date": []string{now.Add(-10 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=60, immutable"}},
+			false,
+		},
+		{
+			"immutable fresh with max-age=0 request -> used without revalidation",
+			[]DirectiveExtension{ImmutableExtension()},
+			http.Header{"Cache-Control": []string{"max-age=0"}},
+			http.Header{"Date": []string{now.Add(-10 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=60, immutable"}},
+			false,
+		},
+		{
+			"immutable without extensions -> revalidated",
+			nil,
+			http.Header{"Cache-Control": []string{"no-cache"}},
+			http.Header{"Date": []string{now.Add(-10 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=60, immutable"}},
+			true,
+		},
+		{
+			"immutable stale -> revalidated",
+			[]DirectiveExtension{ImmutableExtension()},
+			http.Header{"Cache-Control": []string{"no-cache"}},
+			http.Header{"Date": []string{now.Add(-120 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=60, immutable"}},
+			true,
+		},
+		{
+			"rc-ttl fresh -> used",
+			[]DirectiveExtension{TTLExtension("rc-ttl")},
+			http.Header{},
+			http.Header{"Date": []string{now.Add(-30 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=10, rc-ttl=60"}},
+			false,
+		},
+		{
+			"rc-ttl stale -> revalidated",
+			[]DirectiveExtension{TTLExtension("rc-ttl")},
+			http.Header{},
+			http.Header{"Date": []string{now.Add(-90 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=120, rc-ttl=60"}},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewShared(DirectiveExtensions(tt.exts))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &http.Request{
+				Host:   endpoint.Host,
+				URL:    endpoint,
+				Method: http.MethodGet,
+				Header: tt.reqHeader,
+			}
+			cachedRes := &http.Response{StatusCode: http.StatusOK, Header: tt.cachedResHeader.Clone(), Body: http.NoBody}
+			var gotOriginCalled bool
+			do := func(req *http.Request) (*http.Response, error) {
+				gotOriginCalled = true
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+			}
+			if _, _, err := s.Handle(req, req, cachedRes, do, now); err != nil {
+				t.Fatal(err)
+			}
+			if gotOriginCalled != tt.wantOriginCalled {
+				t.Errorf("the origin called = %v, want %v", gotOriginCalled, tt.wantOriginCalled)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package rfc9111
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// NoVarySearch is the No-Vary-Search response header field that declares the query parameters that do not affect the response (https://wicg.github.io/nav-speculation/no-vary-search.html).
+// Shared ignores the query parameters when it matches the request with the stored response.
+// The stored response is only given for the request whose cache key is the same, so the cache key needs to ignore the query parameters (e.g. the key function of ContextWithKeyFunc without the query or NoVarySearchKey).
+type NoVarySearch struct {
+	// KeyOrder is true if the order of the query parameters does not affect the response.
+	KeyOrder bool
+	// AllParams is true if none of the query parameters affect the response except Except (params).
+	AllParams bool
+	// Params are the names of the query parameters that do not affect the response (params=(...)).
+	Params []string
+	// Except are the names of the query parameters that affect the response when AllParams is true (except=(...)).
+	Except []string
+}
+
+// ParseNoVarySearchHeader parses the No-Vary-Search header field.
+// The field is a Dictionary Structured Field (https://www.rfc-editor.org/rfc/rfc9651#section-3.2).
+// It returns false if the field is absent or not valid, then all the query parameters affect the response.
+func ParseNoVarySearchHeader(headers []string) (*NoVarySearch, bool) {
+	nvs := &NoVarySearch{}
+	members := 0
+	var hasExcept bool
+	for _, h := range headers {
+		for _, m := range splitSFList(h) {
+			m = strings.TrimSpace(m)
+			if m == "" {
+				if strings.TrimSpace(h) == "" {
+					continue
+				}
+				return nil, false
+			}
+			k, v, ok := strings.Cut(m, "=")
+			if !ok {
+				// Parameters of the Boolean value true are ignored.
+				k, _, _ = strings.Cut(k, ";")
+				v = "?1"
+			}
+			k = strings.TrimSpace(k)
+			v = strings.TrimSpace(v)
+			if !sfKeyRe.MatchString(k) {
+				return nil, false
+			}
+			members++
+			switch k {
+			case "key-order":
+				b, ok := sfBoolean(v)
+				if !ok {
+					return nil, false
+				}
+				nvs.KeyOrder = b
+			case "params":
+				if b, ok := sfBoolean(v); ok {
+					nvs.AllParams, nvs.Params = b, nil
+					continue
+				}
+				params, ok := sfInnerStrings(v)
+				if !ok {
+					return nil, false
+				}
+				nvs.AllParams, nvs.Params = false, params
+			case "except":
+				except, ok := sfInnerStrings(v)
+				if !ok {
+					return nil, false
+				}
+				nvs.Except, hasExcept = except, true
+			}
+		}
+	}
+	if members == 0 {
+		return nil, false
+	}
+	// except is only valid with params that is true.
+	if hasExcept && !nvs.AllParams {
+		return nil, false
+	}
+	return nvs, true
+}
+
+// Query returns the query of u normalized by the No-Vary-Search.
+// The URLs whose normalized queries are the same are equivalent for the response.
+func (nvs *NoVarySearch) Query(u *url.URL) string {
+	var kept []QueryParam
+	for _, p := range ParseQueryParams(u.RawQuery) {
+		if nvs.AllParams && !contains(p.Name, nvs.Except) {
+			continue
+		}
+		if !nvs.AllParams && contains(p.Name, nvs.Params) {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	if nvs.KeyOrder {
+		sort.SliceStable(kept, func(i, j int) bool {
+			return kept[i].Name < kept[j].Name
+		})
+	}
+	s := make([]string, 0, len(kept))
+	for _, p := range kept {
+		s = append(s, url.QueryEscape(p.Name)+"="+url.QueryEscape(p.Value))
+	}
+	return strings.Join(s, "&")
+}
+
+// NoVarySearchKey returns the query of u normalized by the No-Vary-Search header field of the response header resHeader.
+// If the field is absent or not valid, the raw query of u is returned as it is.
+// Cacher implementations can use it as the query part of the cache key so that the requests that differ only in the query parameters that do not affect the response share the stored response.
+// Because the field is of the response, the implementation needs to remember the field of the stored response (e.g. per path) to compute the key when loading.
+func NoVarySearchKey(u *url.URL, resHeader http.Header) string {
+	nvs, ok := ParseNoVarySearchHeader(resHeader.Values("No-Vary-Search"))
+	if !ok {
+		return u.RawQuery
+	}
+	return nvs.Query(u)
+}
+
+// queryMatched returns true if the query of the presented request matches that of the stored request.
+// The query parameters that do not affect the stored response (see NoVarySearch) are ignored.
+func queryMatched(resHeader http.Header, u, cachedURL *url.URL) bool {
+	if u.RawQuery == cachedURL.RawQuery {
+		return true
+	}
+	nvs, ok := ParseNoVarySearchHeader(resHeader.Values("No-Vary-Search"))
+	if !ok {
+		return false
+	}
+	return nvs.Query(u) == nvs.Query(cachedURL)
+}
+
+// noVarySearchMatched returns true if the query parameters of the presented request that affect the stored response match those of the stored request.
+// It returns true if the stored response does not have the No-Vary-Search header field.
+func noVarySearchMatched(resHeader http.Header, u, cachedURL *url.URL) bool {
+	nvs, ok := ParseNoVarySearchHeader(resHeader.Values("No-Vary-Search"))
+	if !ok {
+		return true
+	}
+	return nvs.Query(u) == nvs.Query(cachedURL)
+}
+
+// QueryParam is a name-value pair of the query.
+type QueryParam struct {
+	Name  string
+	Value string
+}
+
+// ParseQueryParams parses the query as application/x-www-form-urlencoded keeping the order (https://url.spec.whatwg.org/#urlencoded-parsing).
+// The invalid percent-encodings are kept as they are.
+func ParseQueryParams(q string) []QueryParam {
+	var params []QueryParam
+	for _, s := range strings.Split(q, "&") {
+		if s == "" {
+			continue
+		}
+		name, value, _ := strings.Cut(s, "=")
+		params = append(params, QueryParam{Name: queryUnescape(name), Value: queryUnescape(value)})
+	}
+	return params
+}
+
+// queryUnescape decodes s. The invalid percent-encodings are kept as they are.
+func queryUnescape(s string) string {
+	u, err := url.QueryUnescape(s)
+	if err != nil {
+		return strings.ReplaceAll(s, "+", " ")
+	}
+	return u
+}
+
+// sfBoolean parses the Boolean (https://www.rfc-editor.org/rfc/rfc9651#section-3.3.6).
+// Parameters are ignored.
+func sfBoolean(v string) (bool, bool) {
+	v, _, _ = strings.Cut(v, ";")
+	switch strings.TrimSpace(v) {
+	case "?1":
+		return true, true
+	case "?0":
+		return false, true
+	}
+	return false, false
+}
+
+// sfInnerStrings parses the Inner List of Strings (https://www.rfc-editor.org/rfc/rfc9651#section-3.1.1).
+// The strings are decoded as the names of the query parameters. Parameters are ignored.
+func sfInnerStrings(v string) ([]string, bool) {
+	if !strings.HasPrefix(v, "(") {
+		return nil, false
+	}
+	var (
+		s []string
+		i = 1
+	)
+	for {
+		i = skipOWS(v, i)
+		if i >= len(v) {
+			return nil, false
+		}
+		if v[i] == ')' {
+			break
+		}
+		if v[i] != '"' {
+			return nil, false
+		}
+		str, next, ok := unquoteString(v, i)
+		if !ok || !sfBareItemRe.MatchString(v[i:next]) {
+			return nil, false
+		}
+		s = append(s, queryUnescape(str))
+		i = next
+		for i < len(v) && v[i] != ' ' && v[i] != ')' {
+			// Parameters of the item.
+			if v[i] == '"' {
+				_, next, ok := unquoteString(v, i)
+				if !ok {
+					return nil, false
+				}
+				i = next
+				continue
+			}
+			i++
+		}
+	}
+	rest := strings.TrimSpace(v[i+1:])
+	if rest != "" && rest[0] != ';' {
+		return nil, false
+	}
+	return s, true
+}
@@ -0,0 +1,130 @@
+package rfc9111
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseNoVarySearchHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		want    *NoVarySearch
+		wantOK  bool
+	}{
+		{"params", []string{`params=("utm_source" "fbclid")`}, &NoVarySearch{Params: []string{"utm_source", "fbclid"}}, true},
+		{"all params", []string{"params"}, &NoVarySearch{AllParams: true}, true},
+		{"except", []string{`params, except=("id")`}, &NoVarySearch{AllParams: true, Except: []string{"id"}}, true},
+		{"key-order", []string{"key-order"}, &NoVarySearch{KeyOrder: true}, true},
+		{"multiple field lines", []string{"key-order=?1", `params=("a";x=1 "b");y`}, &NoVarySearch{KeyOrder: true, Params: []string{"a", "b"}}, true},
+		{"false", []string{"key-order=?0, params=?0"}, &NoVarySearch{}, true},
+		{"percent-encoded name", []string{`params=("a%20b")`}, &NoVarySearch{Params: []string{"a b"}}, true},
+		{"unknown key is ignored", []string{"foo=1, key-order"}, &NoVarySearch{KeyOrder: true}, true},
+		{"except without params", []string{`except=("id")`}, nil, false},
+		{"params of token", []string{"params=(a)"}, nil, false},
+		{"key-order of string", []string{`key-order="1"`}, nil, false},
+		{"empty", []string{""}, nil, false},
+		{"invalid key", []string{"Params"}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseNoVarySearchHeader(tt.headers)
+			if ok != tt.wantOK {
+				t.Errorf("got %v want %v", ok, tt.wantOK)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestNoVarySearchKey(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		nvs   string
+		want  string
+	}{
+		{"no field", "b=2&utm_source=x&a=1", "", "b=2&utm_source=x&a=1"},
+		{"params", "b=2&utm_source=x&a=1&fbclid=y", `params=("utm_source" "fbclid")`, "b=2&a=1"},
+		{"key-order", "b=2&a=1&a=0", "key-order", "a=1&a=0&b=2"},
+		{"except", "b=2&utm_source=x&id=1", `params, except=("id")`, "id=1"},
+		{"encoding", "q=a+b&r=%41", "key-order", "q=a+b&r=A"},
+		{"invalid field", "b=2&utm_source=x", `except=("id")`, "b=2&utm_source=x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &url.URL{Path: "/", RawQuery: tt.query}
+			h := http.Header{}
+			if tt.nvs != "" {
+				h.Set("No-Vary-Search", tt.nvs)
+			}
+			if got := NoVarySearchKey(u, h); got != tt.want {
+				t.Errorf("got %q want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShared_HandleNoVarySearch(t *testing.T) {
+	pathKey := func(req *http.Request) string {
+		return req.Method + " " + req.URL.Path
+	}
+	now := time.Date(2024, 12, 13, 14, 15, 16, 00, time.UTC)
+	tests := []struct {
+		name          string
+		query         string
+		cachedQuery   string
+		nvs           string
+		keyFunc       func(req *http.Request) string
+		wantCacheUsed bool
+	}{
+		{"same query", "a=1", "a=1", "", nil, true},
+		{"different query", "a=1&utm_source=x", "a=1", "", nil, false},
+		{"ignored params", "a=1&utm_source=x", "fbclid=y&a=1", `params=("utm_source" "fbclid")`, nil, true},
+		{"not ignored params", "a=2&utm_source=x", "a=1", `params=("utm_source" "fbclid")`, nil, false},
+		{"key-order", "b=2&a=1", "a=1&b=2", "key-order", nil, true},
+		{"order matters", "b=2&a=1", "a=1&b=2", `params=("utm_source")`, nil, false},
+		{"except", "id=1&b=2", "id=1&c=3", `params, except=("id")`, nil, true},
+		{"key without query", "a=2", "a=1", "", pathKey, true},
+		{"key without query and ignored params", "a=1&utm_source=x", "a=1", `params=("utm_source")`, pathKey, true},
+		{"key without query and not ignored params", "a=2&utm_source=x", "a=1", `params=("utm_source")`, pathKey, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewShared()
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &http.Request{Host: "example.com", URL: &url.URL{Path: "/path", RawQuery: tt.query}, Method: http.MethodGet, Header: http.Header{}}
+			if tt.keyFunc != nil {
+				req = req.WithContext(ContextWithKeyFunc(context.Background(), tt.keyFunc))
+			}
+			cachedReq := &http.Request{Host: "example.com", URL: &url.URL{Path: "/path", RawQuery: tt.cachedQuery}, Method: http.MethodGet, Header: http.Header{}}
+			cachedRes := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Date": []string{now.Add(-10 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=60"}},
+				Body:       http.NoBody,
+			}
+			if tt.nvs != "" {
+				cachedRes.Header.Set("No-Vary-Search", tt.nvs)
+			}
+			do := func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+			}
+			cacheUsed, _, err := s.Handle(req, cachedReq, cachedRes, do, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cacheUsed != tt.wantCacheUsed {
+				t.Errorf("got %v want %v", cacheUsed, tt.wantCacheUsed)
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package rfc9111
+
+import (
+	"net/http"
+	"time"
+)
+
+// Private is a private cache that implements RFC 9111 (e.g. per-user caches and client-side caching).
+// Unlike Shared, it stores responses with the private response directive and responses to requests with the Authorization header field, and ignores the s-maxage and proxy-revalidate response directives.
+type Private struct {
+	s *Shared
+}
+
+// NewPrivate returns a new Private cache handler.
+// It accepts the same options as NewShared.
+func NewPrivate(opts ...SharedOption) (*Private, error) {
+	s, err := NewShared(opts...)
+	if err != nil {
+		return nil, err
+	}
+	s.private = true
+	return &Private{s: s}, nil
+}
+
+// Storable returns true if the response is storable in the cache.
+func (p *Private) Storable(req *http.Request, res *http.Response, now time.Time) (bool, time.Time) {
+	return p.s.Storable(req, res, now)
+}
+
+// StoredHeader returns a copy of the header fields of the response to be stored (see Shared.StoredHeader).
+func (p *Private) StoredHeader(res *http.Response) http.Header {
+	return p.s.StoredHeader(res)
+}
+
+func (p *Private) Handle(req *http.Request, cachedReq *http.Request, cachedRes *http.Response, do func(*http.Request) (*http.Response, error), now time.Time) (useCached bool, r *http.Response, _ error) {
+	return p.s.Handle(req, cachedReq, cachedRes, do, now)
+}
+
+// NormalizeVaryField returns the normalized value of the request header field nominated by the Vary header field (see Shared.NormalizeVaryField).
+func (p *Private) NormalizeVaryField(name string, values []string) (string, bool) {
+	return p.s.NormalizeVaryField(name, values)
+}
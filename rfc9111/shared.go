@@ -1,22 +1,29 @@
 package rfc9111
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"net/http"
-	"strings"
 	"time"
 )
 
 // Shared is a shared cache that implements RFC 9111.
-// The following features are not implemented
-// - Private cache.
-// - Request directives.
 type Shared struct {
+	// private is true when the cache is used as a private cache (see Private).
+	private                           bool
 	understoodMethods                 []string
 	understoodStatusCodes             []int
 	heuristicallyCacheableStatusCodes []int
 	heuristicExpirationRatio          float64
 	storeRequestWithSetCookieHeader   bool
 	extendedRules                     []ExtendedRule
+	ignoredRequestDirectives          []string
+	requestDirectivesModifier         func(req *http.Request, d *RequestDirectives)
+	targetedFields                    []string
+	stripTargetedFields               bool
+	extensions                        map[string]DirectiveExtension
+	varyNormalizers                   map[string]VaryNormalizer
 }
 
 // ExtendedRule is an extended rule.
@@ -28,7 +35,7 @@ type ExtendedRule interface { //nostyle:ifacenames
 	Cacheable(req *http.Request, res *http.Response) (ok bool, age time.Duration)
 }
 
-// SharedOption is an option for Shared.
+// SharedOption is an option for Shared and Private.
 type SharedOption func(*Shared) error
 
 // UnderstoodMethods sets the understood methods.
@@ -67,6 +74,7 @@ func HeuristicExpirationRatio(ratio float64) SharedOption {
 }
 
 // StoreRequestWithSetCookieHeader enables storing request with Set-Cookie header.
+// Private always stores responses with Set-Cookie header.
 func StoreRequestWithSetCookieHeader() SharedOption {
 	return func(s *Shared) error {
 		s.storeRequestWithSetCookieHeader = true
@@ -82,6 +90,47 @@ func ExtendedRules(rules []ExtendedRule) SharedOption {
 	}
 }
 
+// IgnoreRequestDirectives sets the request directives to be ignored (e.g. "no-cache", "max-age" and "min-fresh") so that clients cannot bypass the cache.
+// Ignoring "no-cache" also ignores Pragma: no-cache.
+func IgnoreRequestDirectives(directives []string) SharedOption {
+	return func(s *Shared) error {
+		for _, d := range directives {
+			if !contains(d, requestDirectiveNames) {
+				return fmt.Errorf("%w: %s", ErrUnknownRequestDirective, d)
+			}
+		}
+		s.ignoredRequestDirectives = directives
+		return nil
+	}
+}
+
+// ModifyRequestDirectives sets the function to modify the request directives before they are applied (e.g. to limit max-age or max-stale).
+// The directives ignored by IgnoreRequestDirectives have already been removed.
+func ModifyRequestDirectives(fn func(req *http.Request, d *RequestDirectives)) SharedOption {
+	return func(s *Shared) error {
+		s.requestDirectivesModifier = fn
+		return nil
+	}
+}
+
+// TargetedCacheControl sets the names of the targeted cache control fields (e.g. "CDN-Cache-Control") in order of precedence (https://www.rfc-editor.org/rfc/rfc9213).
+// The first valid and non-empty field in the list is used instead of the Cache-Control and Expires header fields.
+func TargetedCacheControl(fields []string) SharedOption {
+	return func(s *Shared) error {
+		s.targetedFields = fields
+		return nil
+	}
+}
+
+// StripTargetedCacheControl enables to remove the targeted cache control fields set by TargetedCacheControl from the response returned by Handle.
+// The stored response keeps the fields.
+func StripTargetedCacheControl() SharedOption {
+	return func(s *Shared) error {
+		s.stripTargetedFields = true
+		return nil
+	}
+}
+
 // NewShared returns a new Shared cache handler.
 func NewShared(opts ...SharedOption) (*Shared, error) {
 	s := &Shared{
@@ -110,175 +159,301 @@ func NewShared(opts ...SharedOption) (*Shared, error) {
 }
 
 // Storable returns true if the response is storable in the cache.
+// The Decision is reported to the hook set by ContextWithDecisionHook.
 func (s *Shared) Storable(req *http.Request, res *http.Response, now time.Time) (bool, time.Time) {
+	ok, expires, d := s.storable(req, res, now)
+	reportDecision(req.Context(), d)
+	return ok, expires
+}
+
+// StoredHeader returns a copy of the header fields of the response to be stored once Storable returns true.
+// The header fields listed by the qualified form of the no-cache response directive are excluded, so that the stored response never carries them to other requests even after the validation (see https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.4).
+// If the cache is shared, the header fields listed by the qualified form of the private response directive are excluded too (see https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.7).
+func (s *Shared) StoredHeader(res *http.Response) http.Header {
+	h := res.Header.Clone()
+	if h == nil {
+		return http.Header{}
+	}
+	rescc := s.responseDirectives(res.Header)
+	if !s.private {
+		for _, n := range rescc.PrivateFields {
+			h.Del(n)
+		}
+	}
+	for _, n := range rescc.NoCacheFields {
+		h.Del(n)
+	}
+	return h
+}
+
+func (s *Shared) storable(req *http.Request, res *http.Response, now time.Time) (bool, time.Time, Decision) {
 	// 3. Storing Responses in Caches (https://www.rfc-editor.org/rfc/rfc9111#section-3)
 	// - the request method is understood by the cache;
 	if !contains(req.Method, s.understoodMethods) {
-		return s.storableWithExtendedRules(req, res, now)
+		return s.storableWithExtendedRules(req, res, now, ReasonMethodNotUnderstood)
 	}
 
 	// - the response status code is final (see https://www.rfc-editor.org/rfc/rfc9110#section-15);
 	if !isFinalStatusCode(res.StatusCode) {
-		return s.storableWithExtendedRules(req, res, now)
+		return s.storableWithExtendedRules(req, res, now, ReasonStatusNotFinal)
 	}
 
-	rescc := ParseResponseCacheControlHeader(res.Header.Values("Cache-Control"))
+	// A 304 response only updates the stored response (see https://www.rfc-editor.org/rfc/rfc9111#section-4.3.4), so it is never stored as a new response.
+	// Otherwise, the 304 response to the conditional request of a client would be served to clients that send unconditional requests.
+	if res.StatusCode == http.StatusNotModified {
+		return false, time.Time{}, newDecision(ReasonNotModified, 0)
+	}
+
+	rescc := s.responseDirectives(res.Header)
 
 	// - if the response status code is 206 or 304, or the must-understand cache directive (see https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.3) is present: the cache understands the response status code;
 	if (contains(res.StatusCode, []int{http.StatusPartialContent, http.StatusNotModified}) &&
 		!contains(res.StatusCode, s.understoodStatusCodes)) ||
 		(rescc.MustUnderstand && !contains(res.StatusCode, s.understoodStatusCodes)) {
-		return s.storableWithExtendedRules(req, res, now)
+		return s.storableWithExtendedRules(req, res, now, ReasonStatusNotUnderstood)
+	}
+
+	// The no-store request directive indicates that a cache MUST NOT store any part of either this request or any response to it (see https://www.rfc-editor.org/rfc/rfc9111#section-5.2.1.5).
+	if s.requestDirectives(req).NoStore {
+		return false, time.Time{}, newDecision(ReasonRequestNoStore, 0)
 	}
 
 	// - the no-store cache directive is not present in the response (see https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.5);
 	// However, if must-understand is present and the cache understands the status code, ignore no-store (see https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.3)
 	shouldIgnoreNoStore := rescc.MustUnderstand && contains(res.StatusCode, s.understoodStatusCodes)
 	if rescc.NoStore && !shouldIgnoreNoStore {
-		return false, time.Time{}
+		return false, time.Time{}, newDecision(ReasonNoStore, 0)
 	}
 
 	// - if the cache is shared: the private response directive is either not present or allows a shared cache to store a modified response; see https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.7);
-	if rescc.Private {
-		return false, time.Time{}
+	if rescc.Private && !s.private {
+		return false, time.Time{}, newDecision(ReasonPrivate, 0)
 	}
+	// The qualified form of the private response directive, with an argument that lists one or more field names, indicates that only the listed header fields are limited to a single user: a shared cache MUST NOT store the listed header fields if they are present in the original response but MAY store the remainder of the response message without those fields (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.7).
+	// The listed header fields are excluded by StoredHeader.
 
 	// - if the cache is shared: the Authorization header field is not present in the request (see https://www.rfc-editor.org/rfc/rfc9111#section-11.6.2 of [HTTP]) or a response directive is present that explicitly allows shared caching (see https://www.rfc-editor.org/rfc/rfc9111#section-3.5);
 	// In this specification, the following response directives have such an effect: must-revalidate (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.2), public (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.9), and s-maxage (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.10).
-	if req.Header.Get("Authorization") != "" && !rescc.MustRevalidate && !rescc.Public && rescc.SMaxAge == nil {
-		return false, time.Time{}
+	if !s.private && req.Header.Get("Authorization") != "" && !rescc.MustRevalidate && !rescc.Public && rescc.SMaxAge == nil {
+		return false, time.Time{}, newDecision(ReasonAuthorization, 0)
 	}
 
 	// In RFC 9111, Servers that wish to control caching of responses with Set-Cookie headers are encouraged to emit appropriate Cache-Control response header fields (see https://www.rfc-editor.org/rfc/rfc9111#section-7.3).
 	// But to beat on the safe side, this package does not store responses with Set-Cookie headers by default, similar to NGINX.
 	// THIS IS NOT RFC 9111.
-	if res.Header.Get("Set-Cookie") != "" && !s.storeRequestWithSetCookieHeader {
-		return false, time.Time{}
+	// However, private="Set-Cookie" and no-cache="Set-Cookie" are respected because the Set-Cookie header field is not stored (see StoredHeader).
+	if !s.private && res.Header.Get("Set-Cookie") != "" && !s.storeRequestWithSetCookieHeader && !contains("Set-Cookie", rescc.PrivateFields) && !contains("Set-Cookie", rescc.NoCacheFields) {
+		return false, time.Time{}, newDecision(ReasonSetCookie, 0)
 	}
 
 	// - the response contains at least one of the following:
 
 	//   * a public response directive (see https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.9);
 	if rescc.Public {
-		exp := CalclateExpires(rescc, res.Header, s.heuristicExpirationRatio, now)
-		return true, exp
+		exp, lifetime := s.freshness(rescc, res, now)
+		return true, exp, newDecision(ReasonPublic, lifetime)
 	}
 	//   * a private response directive, if the cache is not shared (see https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.7);
-	// THE CACHE IS SHARED
+	if (rescc.Private || len(rescc.PrivateFields) != 0) && s.private {
+		exp, lifetime := s.freshness(rescc, res, now)
+		return true, exp, newDecision(ReasonPrivateCache, lifetime)
+	}
 
 	//   * an Expires header field (see https://www.rfc-editor.org/rfc/rfc9111#section-5.3);
-	if res.Header.Get("Expires") != "" {
-		exp := CalclateExpires(rescc, res.Header, s.heuristicExpirationRatio, now)
-		return true, exp
+	if !rescc.targeted && res.Header.Get("Expires") != "" {
+		exp, lifetime := s.freshness(rescc, res, now)
+		return true, exp, newDecision(ReasonExpires, lifetime)
 	}
 	//   * a max-age response directive (see https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.1);
 	if rescc.MaxAge != nil {
-		exp := CalclateExpires(rescc, res.Header, s.heuristicExpirationRatio, now)
-		return true, exp
+		exp, lifetime := s.freshness(rescc, res, now)
+		return true, exp, newDecision(ReasonMaxAge, lifetime)
 	}
 	//   * if the cache is shared: an s-maxage response directive (see https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.10);
 	if rescc.SMaxAge != nil {
-		exp := CalclateExpires(rescc, res.Header, s.heuristicExpirationRatio, now)
-		return true, exp
+		exp, lifetime := s.freshness(rescc, res, now)
+		return true, exp, newDecision(ReasonSMaxAge, lifetime)
 	}
 	//   * a cache extension that allows it to be cached (see https://www.rfc-editor.org/rfc/rfc9111#section-5.2.3); or
-	// NOT IMPLEMENTED
+	if s.extensionStorable(rescc, res) {
+		exp, lifetime := s.freshness(rescc, res, now)
+		return true, exp, newDecision(ReasonExtension, lifetime)
+	}
 
 	//   * a status code that is defined as heuristically cacheable (see https://www.rfc-editor.org/rfc/rfc9111#section-4.2.2).
 	if contains(res.StatusCode, s.heuristicallyCacheableStatusCodes) {
-		exp := CalclateExpires(rescc, res.Header, s.heuristicExpirationRatio, now)
+		exp, lifetime := s.freshness(rescc, res, now)
 		// Only store if we can calculate an expiration time
 		if exp.Sub(time.Time{}) != 0 {
-			return true, exp
+			return true, exp, newDecision(ReasonHeuristic, lifetime)
 		}
 	}
 
-	return s.storableWithExtendedRules(req, res, now)
+	return s.storableWithExtendedRules(req, res, now, ReasonNoFreshnessInformation)
 }
 
 func (s *Shared) Handle(req *http.Request, cachedReq *http.Request, cachedRes *http.Response, do func(*http.Request) (*http.Response, error), now time.Time) (useCached bool, r *http.Response, _ error) {
+	status, _ := CacheStatusFromContext(req.Context())
+	// 5.2.1. Request Directives (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.1)
+	reqcc := s.requestDirectives(req)
+	var (
+		decision Decision
+		// noCacheFields are the header fields to be excluded from the stored response used without validation.
+		noCacheFields []string
+		// times are the times of the stored response if they are known (see ContextWithResponseTimes).
+		times *responseTimes
+	)
 	defer func() {
+		if decision.Reason == ReasonValidated {
+			// The stored response is freshened by the validation, so the times of the stored response are not used.
+			times = nil
+		}
 		// 5.1 Age (https://www.rfc-editor.org/rfc/rfc9111#section-5.1)
 		if r != nil {
-			setAgeHeader(useCached, r.Header, now)
+			setAgeHeader(useCached, r.Header, times, now)
+		}
+		// 4.3.2 Handling a Received Validation Request (https://www.rfc-editor.org/rfc/rfc9111#section-4.3.2)
+		// If the stored response satisfies the conditional header fields of the client, respond with 304 (Not Modified).
+		if useCached && r == cachedRes && decision.Reason != ReasonValidated {
+			for _, n := range noCacheFields {
+				r.Header.Del(n)
+			}
+		}
+		if useCached && r == cachedRes && preconditionsNotModified(req, cachedRes, now) {
+			r = notModifiedResponse(cachedRes)
 		}
+		if useCached && status != nil {
+			status.Expires, _ = s.storedFreshness(s.responseDirectives(cachedRes.Header), cachedRes, times, now)
+		}
+		if useCached && r == cachedRes && req.Method == http.MethodHead && cachedReq.Method == http.MethodGet {
+			// The server SHOULD send the same header fields in response to a HEAD request as it would have sent if the request method had been GET (https://www.rfc-editor.org/rfc/rfc9110#section-9.3.2).
+			r = headResponse(cachedRes)
+		}
+		if reqcc.OnlyIfCached && !useCached {
+			decision = newDecision(ReasonOnlyIfCached, decision.Lifetime)
+		}
+		if s.stripTargetedFields && r != nil {
+			for _, n := range s.targetedFields {
+				r.Header.Del(n)
+			}
+		}
+		reportDecision(req.Context(), decision)
 	}()
 
+	origin := do
+	// forward forwards the request to the origin and reports the reason to the CacheStatus (https://www.rfc-editor.org/rfc/rfc9211#section-2.2).
+	forward := func(reason ForwardReason, req *http.Request) (*http.Response, error) {
+		if reqcc.OnlyIfCached {
+			// The only-if-cached request directive indicates that the client only wishes to obtain a stored response. Caches that honor this request directive SHOULD, upon receiving it, respond with either a stored response consistent with the other constraints of the request or a 504 (Gateway Timeout) status code (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.1.7).
+			return gatewayTimeoutResponse(req), nil
+		}
+		res, err := origin(req)
+		if status != nil {
+			status.Forward = reason
+			if res != nil {
+				status.ForwardStatus = res.StatusCode
+			}
+		}
+		return res, err
+	}
+
 	if cachedReq == nil || cachedRes == nil {
-		res, err := do(req)
+		decision = newDecision(ReasonURIMiss, 0)
+		res, err := forward(ForwardURIMiss, req)
 		return false, res, err
 	}
+	times, _ = responseTimesFromContext(cachedReq.Context())
 
 	// 4. Constructing Responses from Caches
 	// When presented with a request, a cache MUST NOT reuse a stored response unless:
 
 	// - the presented target URI (https://www.rfc-editor.org/rfc/rfc9110#section-7.1 of [HTTP]) and that of the stored response match, and
-	if cachedReq.Host == "" || req.Host != cachedReq.Host || req.URL.Path != cachedReq.URL.Path || req.URL.RawQuery != cachedReq.URL.RawQuery {
-		// For SNI compatibility, also compare req.Host
-		res, err := do(req)
+	if !targetMatched(req, cachedReq, cachedRes) {
+		decision = newDecision(ReasonURIMiss, 0)
+		res, err := forward(ForwardURIMiss, req)
 		return false, res, err
 	}
 
 	// - the request method associated with the stored response allows it to be used for the presented request, and
-	if req.Method != cachedReq.Method { // FIXME: more strictly
-		res, err := do(req)
+	// The response to GET can be used for HEAD without the content (https://www.rfc-editor.org/rfc/rfc9110#section-9.3.2).
+	if req.Method != cachedReq.Method && (req.Method != http.MethodHead || cachedReq.Method != http.MethodGet) {
+		decision = newDecision(ReasonMethodMismatch, 0)
+		res, err := forward(ForwardMiss, req)
 		return false, res, err
 	}
 
 	// - request header fields nominated by the stored response (if any) match those presented (see https://www.rfc-editor.org/rfc/rfc9111#section-4.1)
-	if v := cachedRes.Header.Values("Vary"); len(v) != 0 {
-		vary := strings.Join(v, ",")
-		if strings.Contains(vary, "*") {
-			res, err := do(req)
-			return false, res, err
-		}
-		for _, h := range strings.Split(vary, ",") {
-			h = strings.TrimSpace(h)
-			if req.Header.Get(h) != cachedReq.Header.Get(h) { // FIXME: more strictly
-				res, err := do(req)
-				return false, res, err
-			}
-		}
+	if !s.varyMatched(cachedRes.Header, req, cachedReq) {
+		decision = newDecision(ReasonVaryMiss, 0)
+		res, err := forward(ForwardVaryMiss, req)
+		return false, res, err
 	}
 
-	rescc := ParseResponseCacheControlHeader(cachedRes.Header.Values("Cache-Control"))
+	rescc := s.responseDirectives(cachedRes.Header)
+	expires, lifetime := s.storedFreshness(rescc, cachedRes, times, now)
+	// The cache extension directive (e.g. immutable) can skip the revalidation requested by the client while the stored response is fresh.
+	skipRevalidation := expires.Sub(now) > 0 && s.skipRevalidation(rescc, req)
+	// The qualified form of the no-cache response directive, with an argument that lists one or more field names, indicates that a cache MAY use the response to satisfy a subsequent request, subject to any other restrictions on caching, if the listed header fields are excluded from the subsequent response or the subsequent response has been successfully revalidated with the origin server (updating or removing those fields).
+	noCacheFields = rescc.NoCacheFields
 
 	// - the stored response does not contain the no-cache directive (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.4), unless it is successfully validated (https://www.rfc-editor.org/rfc/rfc9111#section-4.3)
-	if rescc.NoCache {
+	// The no-cache request directive indicates that the client prefers that a stored response not be used to satisfy the request without successful validation on the origin server (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.1.4).
+	if rescc.NoCache || (reqcc.NoCache && !skipRevalidation) {
+		reason := ForwardStale
+		if reqcc.NoCache {
+			reason = ForwardRequest
+		}
 		// The no-cache response directive, in its unqualified form (without an argument), indicates that the response MUST NOT be used to satisfy any other request without forwarding it for validation and receiving a successful response; see https://www.rfc-editor.org/rfc/rfc9111#section-4.3.
 		if req.Method == http.MethodGet || req.Method == http.MethodHead {
-			if cachedRes.Header.Get("ETag") != "" {
-				req.Header.Set("If-None-Match", cachedRes.Header.Get("ETag"))
-			}
-			if cachedRes.Header.Get("Last-Modified") != "" {
-				req.Header.Set("If-Modified-Since", cachedRes.Header.Get("Last-Modified"))
-			}
-			res, err := do(req)
+			// The conditional header fields of the client are not forwarded so that the 304 response is for the cache.
+			res, err := forward(reason, revalidationRequest(req, cachedRes))
 			if err != nil {
+				decision = newDecision(ReasonNotValidated, lifetime)
 				return false, res, err
 			}
 			if res.StatusCode != http.StatusNotModified {
+				decision = newDecision(ReasonNotValidated, lifetime)
 				return false, res, nil
 			}
-			// The qualified form of the no-cache response directive, with an argument that lists one or more field names, indicates that a cache MAY use the response to satisfy a subsequent request, subject to any other restrictions on caching, if the listed header fields are excluded from the subsequent response or the subsequent response has been successfully revalidated with the origin server (updating or removing those fields).
+			closeBody(res)
+			if !freshenStored(cachedRes, res, noCacheFields) {
+				// The 304 response does not identify the stored response, so the request is forwarded without the validators of the stored response.
+				decision = newDecision(ReasonNotValidated, lifetime)
+				res, err := forward(reason, req)
+				return false, res, err
+			}
+			// The stored response is successfully validated, so it is used regardless of its freshness.
+			decision = newDecision(ReasonValidated, lifetime)
+			return true, cachedRes, nil
 		} else {
-			res, err := do(req)
+			decision = newDecision(ReasonNoCache, lifetime)
+			res, err := forward(reason, req)
 			return false, res, err
 		}
 	}
 
-	expires := CalclateExpires(rescc, cachedRes.Header, s.heuristicExpirationRatio, now)
-
 	// - the stored response is one of the following:
+	// The max-age request directive indicates that the client prefers a response whose age is less than or equal to the specified number of seconds (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.1.1).
+	acceptable := true
+	if reqcc.MaxAge != nil && !skipRevalidation {
+		if age, ok := calculateAge(cachedRes.Header, times, now); ok && age > int(*reqcc.MaxAge) {
+			acceptable = false
+		}
+	}
+	// The min-fresh request directive indicates that the client prefers a response whose freshness lifetime is no less than its current age plus the specified time in seconds (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.1.3).
+	if reqcc.MinFresh != nil && !skipRevalidation && expires.Sub(now) < time.Duration(*reqcc.MinFresh)*time.Second {
+		acceptable = false
+	}
+
 	//   * fresh (see https://www.rfc-editor.org/rfc/rfc9111#section-4.2), or
-	if expires.Sub(now) > 0 {
+	if acceptable && expires.Sub(now) > 0 {
+		decision = newDecision(ReasonFresh, lifetime)
 		return true, cachedRes, nil
 	}
 
 	//   * allowed to be served stale (see https://www.rfc-editor.org/rfc/rfc9111#section-4.2.4), or
-	if !rescc.NoCache && !rescc.MustRevalidate && rescc.SMaxAge == nil && !rescc.ProxyRevalidate {
+	if acceptable && !rescc.NoCache && !rescc.MustRevalidate && rescc.SMaxAge == nil && !rescc.ProxyRevalidate {
 		//     > A cache MUST NOT generate a stale response if it is prohibited by an explicit in-protocol directive (e.g., by a no-cache response directive, a must-revalidate response directive, or an applicable s-maxage or proxy-revalidate response directive; see https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2).
-		reqcc := ParseRequestCacheControlHeader(req.Header.Values("Cache-Control"))
 		//     > A cache MUST NOT generate a stale response unless it is disconnected or doing so is explicitly permitted by the client or origin server (e.g., by the max-stale request directive in https://www.rfc-editor.org/rfc/rfc9111#section-5.2.1, extension directives such as those defined in [RFC5861], or configuration in accordance with an out-of-band contract).
 
 		// stale-while-revalidate: https://www.rfc-editor.org/rfc/rfc5861
@@ -289,30 +464,30 @@ func (s *Shared) Handle(req *http.Request, cachedReq *http.Request, cachedRes *h
 			if age >= 0 && age < swr {
 				// Within stale-while-revalidate window, use cached response
 				// and trigger background revalidation
-				go func() {
-					// Background revalidation: do() will fetch from origin and update cache
-					_, _ = do(req) //nostyle:handlerrors
-				}()
+				// The conditional header fields of the client are not forwarded so that the full response is stored.
+				revalidateInBackground(unconditionalRequest(req), origin)
+				decision = newDecision(ReasonStaleWhileRevalidate, lifetime)
 				return true, cachedRes, nil
 			}
 		}
 
 		if reqcc.MaxStale != nil {
 			if expires.Add(time.Duration(*reqcc.MaxStale)*time.Second).Sub(now) > 0 {
+				decision = newDecision(ReasonMaxStale, lifetime)
 				return true, cachedRes, nil
 			}
 		}
 	}
 
 	//   * successfully validated (see https://www.rfc-editor.org/rfc/rfc9111#section-4.3).
+	reason := ForwardStale
+	if !acceptable && expires.Sub(now) > 0 {
+		// The stored response is fresh, but the client does not accept it.
+		reason = ForwardRequest
+	}
 	if req.Method == http.MethodGet || req.Method == http.MethodHead {
-		if cachedRes.Header.Get("ETag") != "" {
-			req.Header.Set("If-None-Match", cachedRes.Header.Get("ETag"))
-		}
-		if cachedRes.Header.Get("Last-Modified") != "" {
-			req.Header.Set("If-Modified-Since", cachedRes.Header.Get("Last-Modified"))
-		}
-		res, err := do(req)
+		// The conditional header fields of the client are not forwarded so that the 304 response is for the cache.
+		res, err := forward(reason, revalidationRequest(req, cachedRes))
 		if err != nil {
 			// stale-if-error: https://www.rfc-editor.org/rfc/rfc5861
 			// Permits serving stale response when error occurs
@@ -321,9 +496,11 @@ func (s *Shared) Handle(req *http.Request, cachedReq *http.Request, cachedRes *h
 				sie := time.Duration(*rescc.StaleIfError) * time.Second
 				if age >= 0 && age < sie {
 					// Within stale-if-error window, use cached response on error
+					decision = newDecision(ReasonStaleIfError, lifetime)
 					return true, cachedRes, nil
 				}
 			}
+			decision = newDecision(ReasonNotValidated, lifetime)
 			return false, res, err
 		}
 		// stale-if-error also applies to 5xx errors (500, 502, 503, 504)
@@ -335,16 +512,29 @@ func (s *Shared) Handle(req *http.Request, cachedReq *http.Request, cachedRes *h
 			sie := time.Duration(*rescc.StaleIfError) * time.Second
 			if age >= 0 && age < sie {
 				// Within stale-if-error window, use cached response on 5xx error
+				closeBody(res)
+				decision = newDecision(ReasonStaleIfError, lifetime)
 				return true, cachedRes, nil
 			}
 		}
 		if res.StatusCode == http.StatusNotModified {
+			closeBody(res)
+			// 4.3.4. Freshening Stored Responses upon Validation (https://www.rfc-editor.org/rfc/rfc9111#section-4.3.4)
+			// If the 304 response does not identify the stored response, the cache MUST NOT use it to update the stored response, so the request is forwarded without the validators of the stored response.
+			if !freshenStored(cachedRes, res, noCacheFields) {
+				decision = newDecision(ReasonNotValidated, lifetime)
+				res, err := forward(reason, req)
+				return false, res, err
+			}
+			decision = newDecision(ReasonValidated, lifetime)
 			return true, cachedRes, nil
 		}
+		decision = newDecision(ReasonNotValidated, lifetime)
 		return false, res, nil
 	}
 
-	res, err := do(req)
+	decision = newDecision(ReasonStale, lifetime)
+	res, err := forward(reason, req)
 	if err != nil {
 		// stale-if-error: https://www.rfc-editor.org/rfc/rfc5861
 		// Permits serving stale response when error occurs
@@ -353,6 +543,7 @@ func (s *Shared) Handle(req *http.Request, cachedReq *http.Request, cachedRes *h
 			sie := time.Duration(*rescc.StaleIfError) * time.Second
 			if age >= 0 && age < sie {
 				// Within stale-if-error window, use cached response on error
+				decision = newDecision(ReasonStaleIfError, lifetime)
 				return true, cachedRes, nil
 			}
 		}
@@ -367,16 +558,33 @@ func (s *Shared) Handle(req *http.Request, cachedReq *http.Request, cachedRes *h
 		sie := time.Duration(*rescc.StaleIfError) * time.Second
 		if age >= 0 && age < sie {
 			// Within stale-if-error window, use cached response on 5xx error
+			closeBody(res)
+			decision = newDecision(ReasonStaleIfError, lifetime)
 			return true, cachedRes, nil
 		}
 	}
 	return false, res, err
 }
 
+// freshenStored updates the header fields of the stored response with the 304 (Not Modified) response of the validation (see FreshenHeader).
+// The header fields listed by the qualified form of the no-cache response directive are replaced with those of the 304 response or removed, because the stored ones must not be used even after the validation.
+func freshenStored(cachedRes, notModified *http.Response, noCacheFields []string) bool {
+	if !FreshenHeader(cachedRes.Header, notModified.Header) {
+		return false
+	}
+	for _, n := range noCacheFields {
+		if len(notModified.Header.Values(n)) == 0 {
+			cachedRes.Header.Del(n)
+		}
+	}
+	return true
+}
+
 // storableWithExtendedRules returns true if the response is storable with extended rules.
-func (s *Shared) storableWithExtendedRules(req *http.Request, res *http.Response, now time.Time) (bool, time.Time) {
-	if res.Header.Get("Cache-Control") != "" {
-		return false, time.Time{}
+// storableWithExtendedRules applies the extended rules to the response that is not storable for the reason.
+func (s *Shared) storableWithExtendedRules(req *http.Request, res *http.Response, now time.Time, reason DecisionReason) (bool, time.Time, Decision) {
+	if res.Header.Get("Cache-Control") != "" || s.hasTargetedField(res.Header) {
+		return false, time.Time{}, newDecision(reason, 0)
 	}
 
 	for _, rule := range s.extendedRules {
@@ -386,32 +594,56 @@ func (s *Shared) storableWithExtendedRules(req *http.Request, res *http.Response
 			od := originDate(res.Header, now)
 			expires := od.Add(age) //nostyle:varnames
 			res.Header.Set("Expires", expires.UTC().Format(http.TimeFormat))
-			return true, expires
+			return true, expires, newDecision(ReasonExtendedRule, age)
 		}
 	}
-	return false, time.Time{}
+	return false, time.Time{}, newDecision(reason, 0)
+}
+
+// targetMatched returns true if the presented target URI and that of the stored response match.
+// If the function that returns the cache key is set in the context (see ContextWithKeyFunc), the cache keys are compared instead.
+func targetMatched(req, cachedReq *http.Request, cachedRes *http.Response) bool {
+	if fn, ok := keyFuncFromContext(req.Context()); ok {
+		r := cachedReq.Clone(cachedReq.Context())
+		r.Method = req.Method
+		// The cache key may ignore the query, so the query parameters that affect the stored response are also compared (see NoVarySearch).
+		return fn(req) == fn(r) && noVarySearchMatched(cachedRes.Header, req.URL, cachedReq.URL)
+	}
+	// For SNI compatibility, also compare req.Host
+	// The query parameters that do not affect the stored response are ignored (see NoVarySearch).
+	return cachedReq.Host != "" && req.Host == cachedReq.Host && req.URL.Path == cachedReq.URL.Path && queryMatched(cachedRes.Header, req.URL, cachedReq.URL)
 }
 
 func CalclateExpires(d *ResponseDirectives, resHeader http.Header, heuristicExpirationRatio float64, now time.Time) time.Time {
+	expires, _ := calculateFreshness(d, resHeader, heuristicExpirationRatio, now)
+	return expires
+}
+
+// calculateFreshness returns the expiration time and the freshness lifetime of the response.
+func calculateFreshness(d *ResponseDirectives, resHeader http.Header, heuristicExpirationRatio float64, now time.Time) (time.Time, time.Duration) {
 	// 	4.2.1. Calculating Freshness Lifetime
 	// A cache can calculate the freshness lifetime (denoted as freshness_lifetime) of a response by evaluating the following rules and using the first match:
 
 	// - If the cache is shared and the s-maxage response directive (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.10) is present, use its value
 	if d.SMaxAge != nil {
 		od := originDate(resHeader, now)
-		return od.Add(time.Duration(*d.SMaxAge) * time.Second)
+		lifetime := time.Duration(*d.SMaxAge) * time.Second
+		return od.Add(lifetime), lifetime
 	}
 	// - If the max-age response directive (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.1) is present, use its value
 	if d.MaxAge != nil {
 		od := originDate(resHeader, now)
-		return od.Add(time.Duration(*d.MaxAge) * time.Second)
+		lifetime := time.Duration(*d.MaxAge) * time.Second
+		return od.Add(lifetime), lifetime
 	}
-	if resHeader.Get("Expires") != "" {
+	// The Expires header field is ignored if the targeted cache control field is used (https://www.rfc-editor.org/rfc/rfc9213#section-2.2).
+	if !d.targeted && resHeader.Get("Expires") != "" {
 		// - If the Expires response header field (https://www.rfc-editor.org/rfc/rfc9111#section-5.3) is present, use its value minus the value of the Date response header field (using the time the message was received if it is not present, as per Section 6.6.1 of [HTTP])
 		et, err := http.ParseTime(resHeader.Get("Expires"))
 		if err == nil {
 			od := originDate(resHeader, now)
-			return now.Add(et.Sub(od))
+			lifetime := et.Sub(od)
+			return now.Add(lifetime), lifetime
 		}
 	}
 	// Otherwise, no explicit expiration time is present in the response. A heuristic freshness lifetime might be applicable; see https://www.rfc-editor.org/rfc/rfc9111#section-4.2.2.
@@ -420,12 +652,105 @@ func CalclateExpires(d *ResponseDirectives, resHeader http.Header, heuristicExpi
 		if err == nil {
 			// If the response has a Last-Modified header field (https://www.rfc-editor.org/rfc/rfc9110#section-8.8.2 of [HTTP]), caches are encouraged to use a heuristic expiration value that is no more than some fraction of the interval since that time. A typical setting of this fraction might be 10%.
 			od := originDate(resHeader, now)
-			return od.Add(time.Duration(float64(od.Sub(lt)) * heuristicExpirationRatio))
+			lifetime := time.Duration(float64(od.Sub(lt)) * heuristicExpirationRatio)
+			return od.Add(lifetime), lifetime
 		}
 	}
 
 	// Can't calculate expires
-	return time.Time{}
+	return time.Time{}, 0
+}
+
+// revalidateInBackground requests the origin in the background to update the cache.
+// If the Revalidator is set in the request context, it is used.
+func revalidateInBackground(req *http.Request, do func(*http.Request) (*http.Response, error)) {
+	if r, ok := revalidatorFromContext(req.Context()); ok {
+		r.Revalidate(req, do)
+		return
+	}
+	// The request context is cancelled when the response is written.
+	breq := req.Clone(context.WithoutCancel(req.Context()))
+	go func() {
+		// Background revalidation: do() will fetch from origin and update cache
+		res, err := do(breq)
+		if err == nil && res != nil && res.Body != nil {
+			// Read the body to the end so that the response is stored.
+			_, _ = io.Copy(io.Discard, res.Body) //nostyle:handlerrors
+			closeBody(res)
+		}
+	}()
+}
+
+// responseDirectives returns the response directives to be applied.
+// A private cache ignores the s-maxage and proxy-revalidate response directives that apply only to shared caches (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.8, https://www.rfc-editor.org/rfc/rfc9111#section-5.2.2.10).
+// The targeted cache control field set by TargetedCacheControl takes precedence over the Cache-Control header field (https://www.rfc-editor.org/rfc/rfc9213#section-2.2).
+func (s *Shared) responseDirectives(h http.Header) *ResponseDirectives {
+	d, ok := s.targetedDirectives(h)
+	if !ok {
+		d = ParseResponseCacheControlHeader(h.Values("Cache-Control"))
+	}
+	if s.private {
+		d.SMaxAge = nil
+		d.ProxyRevalidate = false
+	}
+	return d
+}
+
+// requestDirectives returns the request directives to be applied.
+// Pragma: no-cache is treated as Cache-Control: no-cache if the Cache-Control header field is not present (https://www.rfc-editor.org/rfc/rfc9111#section-5.4).
+func (s *Shared) requestDirectives(req *http.Request) *RequestDirectives {
+	d := ParseRequestCacheControlHeader(req.Header.Values("Cache-Control"))
+	if len(req.Header.Values("Cache-Control")) == 0 {
+		for _, dir := range ParseDirectives(req.Header.Values("Pragma")) {
+			if dir.Name == "no-cache" {
+				d.NoCache = true
+			}
+		}
+	}
+	for _, n := range s.ignoredRequestDirectives {
+		switch n {
+		case "max-age":
+			d.MaxAge = nil
+		case "max-stale":
+			d.MaxStale = nil
+		case "min-fresh":
+			d.MinFresh = nil
+		case "no-cache":
+			d.NoCache = false
+		case "no-store":
+			d.NoStore = false
+		case "no-transform":
+			d.NoTransform = false
+		case "only-if-cached":
+			d.OnlyIfCached = false
+		}
+	}
+	if s.requestDirectivesModifier != nil {
+		s.requestDirectivesModifier(req, d)
+	}
+	return d
+}
+
+// gatewayTimeoutResponse returns the 504 (Gateway Timeout) response generated by the cache.
+func gatewayTimeoutResponse(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:     http.StatusText(http.StatusGatewayTimeout),
+		StatusCode: http.StatusGatewayTimeout,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		Request:    req,
+	}
+}
+
+// closeBody closes the body of the origin response that is not used.
+func closeBody(res *http.Response) {
+	if res == nil || res.Body == nil {
+		return
+	}
+	_ = res.Body.Close() //nostyle:handlerrors
 }
 
 func isFinalStatusCode(status int) bool {
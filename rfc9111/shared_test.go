@@ -1,8 +1,12 @@
 package rfc9111
 
 import (
+	"context"
+	"errors"
+	"io"
 	"net/http"
 	"net/url"
+	"strings"
 	"testing"
 	"time"
 
@@ -540,6 +544,41 @@ func TestShared_Storable(t *testing.T) {
 			true,
 			time.Date(2024, 12, 13, 14, 15, 17, 600000000, time.UTC),
 		},
+		{
+			"GET 200 Cache-Control: max-age=15 Request Cache-Control: no-store -> No Store",
+			&http.Request{
+				Host:   "example.com",
+				Method: http.MethodGet,
+				Header: http.Header{
+					"Cache-Control": []string{"no-store"},
+				},
+			},
+			&http.Response{
+				StatusCode: http.StatusOK,
+				Header: http.Header{
+					"Cache-Control": []string{"max-age=15"},
+				},
+			},
+			nil,
+			false,
+			time.Time{},
+		},
+		{
+			"GET 304 Cache-Control: max-age=15 -> No Store",
+			&http.Request{
+				Host:   "example.com",
+				Method: http.MethodGet,
+			},
+			&http.Response{
+				StatusCode: http.StatusNotModified,
+				Header: http.Header{
+					"Cache-Control": []string{"max-age=15"},
+				},
+			},
+			nil,
+			false,
+			time.Time{},
+		},
 	}
 	for _, tt := range tests {
 		tt := tt
@@ -1360,6 +1399,96 @@ func TestShared_SharedOption(t *testing.T) {
 			true,
 			time.Date(2024, 12, 13, 14, 15, 21, 00, time.UTC),
 		},
+		{
+			"TargetedCacheControl CDN-Cache-Control: max-age=60 takes precedence over Cache-Control: no-store -> +60s",
+			[]SharedOption{
+				TargetedCacheControl([]string{"RC-Cache-Control", "CDN-Cache-Control"}),
+			},
+			&http.Request{
+				Method: http.MethodGet,
+			},
+			&http.Response{
+				StatusCode: http.StatusOK,
+				Header: http.Header{
+					"Cache-Control":     []string{"no-store"},
+					"Cdn-Cache-Control": []string{"max-age=60"},
+				},
+			},
+			true,
+			time.Date(2024, 12, 13, 14, 16, 16, 00, time.UTC),
+		},
+		{
+			"TargetedCacheControl the first field in the list takes precedence -> +30s",
+			[]SharedOption{
+				TargetedCacheControl([]string{"RC-Cache-Control", "CDN-Cache-Control"}),
+			},
+			&http.Request{
+				Method: http.MethodGet,
+			},
+			&http.Response{
+				StatusCode: http.StatusOK,
+				Header: http.Header{
+					"Rc-Cache-Control":  []string{"max-age=30"},
+					"Cdn-Cache-Control": []string{"max-age=60"},
+				},
+			},
+			true,
+			time.Date(2024, 12, 13, 14, 15, 46, 00, time.UTC),
+		},
+		{
+			"TargetedCacheControl invalid CDN-Cache-Control is ignored -> Cache-Control: max-age=10",
+			[]SharedOption{
+				TargetedCacheControl([]string{"CDN-Cache-Control"}),
+			},
+			&http.Request{
+				Method: http.MethodGet,
+			},
+			&http.Response{
+				StatusCode: http.StatusOK,
+				Header: http.Header{
+					"Cache-Control":     []string{"max-age=10"},
+					"Cdn-Cache-Control": []string{"max-age=60,"},
+				},
+			},
+			true,
+			time.Date(2024, 12, 13, 14, 15, 26, 00, time.UTC),
+		},
+		{
+			"TargetedCacheControl CDN-Cache-Control: no-store -> not storable",
+			[]SharedOption{
+				TargetedCacheControl([]string{"CDN-Cache-Control"}),
+			},
+			&http.Request{
+				Method: http.MethodGet,
+			},
+			&http.Response{
+				StatusCode: http.StatusOK,
+				Header: http.Header{
+					"Cache-Control":     []string{"public, max-age=60"},
+					"Cdn-Cache-Control": []string{"no-store"},
+				},
+			},
+			false,
+			time.Time{},
+		},
+		{
+			"TargetedCacheControl Expires is ignored -> not storable",
+			[]SharedOption{
+				TargetedCacheControl([]string{"CDN-Cache-Control"}),
+			},
+			&http.Request{
+				Method: http.MethodGet,
+			},
+			&http.Response{
+				StatusCode: http.StatusOK,
+				Header: http.Header{
+					"Expires":           []string{"Fri, 13 Dec 2024 14:16:16 GMT"},
+					"Cdn-Cache-Control": []string{"must-revalidate"},
+				},
+			},
+			false,
+			time.Time{},
+		},
 	}
 	for _, tt := range tests {
 		tt := tt
@@ -1379,3 +1508,1251 @@ func TestShared_SharedOption(t *testing.T) {
 		})
 	}
 }
+
+func TestShared_HandleConditionalRequest(t *testing.T) {
+	now := time.Date(2024, 12, 13, 14, 15, 16, 00, time.UTC)
+	before30sec := now.Add(-30 * time.Second)
+	endpoint, err := url.Parse("https://example.com/api/v1/path/to/resource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh := http.Header{
+		"Etag":          []string{`"abc123"`},
+		"Last-Modified": []string{before30sec.Format(http.TimeFormat)},
+		"Date":          []string{now.Format(http.TimeFormat)},
+		"Cache-Control": []string{"max-age=20"},
+	}
+	stale := http.Header{
+		"Etag":          []string{`"abc123"`},
+		"Last-Modified": []string{before30sec.Format(http.TimeFormat)},
+		"Date":          []string{before30sec.Format(http.TimeFormat)},
+		"Cache-Control": []string{"max-age=20"},
+	}
+
+	tests := []struct {
+		name            string
+		reqHeader       http.Header
+		cachedResHeader http.Header
+		originStatus    int
+		wantOriginReq   http.Header
+		wantCacheUsed   bool
+		wantStatus      int
+	}{
+		{
+			"Fresh, If-None-Match matched -> 304",
+			http.Header{"If-None-Match": []string{`"xyz", "abc123"`}},
+			fresh,
+			0,
+			nil,
+			true,
+			http.StatusNotModified,
+		},
+		{
+			"Fresh, If-None-Match weakly matched -> 304",
+			http.Header{"If-None-Match": []string{`W/"abc123"`}},
+			fresh,
+			0,
+			nil,
+			true,
+			http.StatusNotModified,
+		},
+		{
+			"Fresh, If-None-Match: * -> 304",
+			http.Header{"If-None-Match": []string{"*"}},
+			fresh,
+			0,
+			nil,
+			true,
+			http.StatusNotModified,
+		},
+		{
+			"Fresh, If-None-Match not matched -> 200",
+			http.Header{"If-None-Match": []string{`"xyz"`}},
+			fresh,
+			0,
+			nil,
+			true,
+			http.StatusOK,
+		},
+		{
+			"Fresh, If-Modified-Since not before Last-Modified -> 304",
+			http.Header{"If-Modified-Since": []string{before30sec.Format(http.TimeFormat)}},
+			fresh,
+			0,
+			nil,
+			true,
+			http.StatusNotModified,
+		},
+		{
+			"Fresh, If-Modified-Since before Last-Modified -> 200",
+			http.Header{"If-Modified-Since": []string{before30sec.Add(-time.Second).Format(http.TimeFormat)}},
+			fresh,
+			0,
+			nil,
+			true,
+			http.StatusOK,
+		},
+		{
+			"Fresh, If-Modified-Since is ignored with If-None-Match -> 200",
+			http.Header{
+				"If-None-Match":     []string{`"xyz"`},
+				"If-Modified-Since": []string{now.Format(http.TimeFormat)},
+			},
+			fresh,
+			0,
+			nil,
+			true,
+			http.StatusOK,
+		},
+		{
+			"Stale, unconditional request, origin 304 -> 200",
+			http.Header{},
+			stale,
+			http.StatusNotModified,
+			http.Header{
+				"If-None-Match":     []string{`"abc123"`},
+				"If-Modified-Since": []string{before30sec.Format(http.TimeFormat)},
+			},
+			true,
+			http.StatusOK,
+		},
+		{
+			"Stale, If-None-Match not matched, origin 304 -> 200",
+			http.Header{"If-None-Match": []string{`"xyz"`}},
+			stale,
+			http.StatusNotModified,
+			http.Header{
+				"If-None-Match":     []string{`"abc123"`},
+				"If-Modified-Since": []string{before30sec.Format(http.TimeFormat)},
+			},
+			true,
+			http.StatusOK,
+		},
+		{
+			"Stale, If-None-Match matched, origin 304 -> 304",
+			http.Header{"If-None-Match": []string{`"abc123"`}},
+			stale,
+			http.StatusNotModified,
+			http.Header{
+				"If-None-Match":     []string{`"abc123"`},
+				"If-Modified-Since": []string{before30sec.Format(http.TimeFormat)},
+			},
+			true,
+			http.StatusNotModified,
+		},
+		{
+			"Stale, If-None-Match not matched, origin 200 -> 200",
+			http.Header{"If-None-Match": []string{`"xyz"`}},
+			stale,
+			http.StatusOK,
+			http.Header{
+				"If-None-Match":     []string{`"abc123"`},
+				"If-Modified-Since": []string{before30sec.Format(http.TimeFormat)},
+			},
+			false,
+			http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Host:   endpoint.Host,
+				URL:    endpoint,
+				Method: http.MethodGet,
+				Header: tt.reqHeader.Clone(),
+			}
+			cachedReq := &http.Request{
+				Host:   endpoint.Host,
+				URL:    endpoint,
+				Method: http.MethodGet,
+			}
+			cachedRes := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     tt.cachedResHeader.Clone(),
+			}
+			var gotOriginReq http.Header
+			do := func(req *http.Request) (*http.Response, error) {
+				if tt.originStatus == 0 {
+					t.Error("the origin should not be requested")
+				}
+				gotOriginReq = req.Header
+				return &http.Response{
+					StatusCode: tt.originStatus,
+					Header:     http.Header{},
+				}, nil
+			}
+			s, err := NewShared()
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotCacheUsed, gotRes, err := s.Handle(req, cachedReq, cachedRes, do, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotCacheUsed != tt.wantCacheUsed {
+				t.Errorf("Shared.Handle() gotCacheUsed = %v, want %v", gotCacheUsed, tt.wantCacheUsed)
+			}
+			if gotRes.StatusCode != tt.wantStatus {
+				t.Errorf("Shared.Handle() got status code = %v, want %v", gotRes.StatusCode, tt.wantStatus)
+			}
+			if gotRes.StatusCode == http.StatusNotModified && gotRes.Header.Get("ETag") != `"abc123"` {
+				t.Errorf("Shared.Handle() got ETag = %v, want %v", gotRes.Header.Get("ETag"), `"abc123"`)
+			}
+			if diff := cmp.Diff(gotOriginReq, tt.wantOriginReq); diff != "" {
+				t.Errorf("the origin request header:\n%s", diff)
+			}
+			if diff := cmp.Diff(req.Header, tt.reqHeader); diff != "" {
+				t.Errorf("the client request header is modified:\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestShared_HandleNotModifiedMismatch(t *testing.T) {
+	now := time.Date(2024, 12, 13, 14, 15, 16, 00, time.UTC)
+	before30sec := now.Add(-30 * time.Second)
+	endpoint, err := url.Parse("https://example.com/api/v1/path/to/resource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name            string
+		cacheControl    string
+		notModified     http.Header
+		wantCacheUsed   bool
+		wantStatus      int
+		wantOriginCalls int
+		wantDecision    DecisionReason
+	}{
+		{"stale, ETag matched", "max-age=20", http.Header{"Etag": []string{`"v1"`}, "Cache-Control": []string{"max-age=60"}}, true, http.StatusOK, 1, ReasonValidated},
+		{"stale, ETag not matched", "max-age=20", http.Header{"Etag": []string{`"v2"`}, "Cache-Control": []string{"max-age=60"}}, false, http.StatusOK, 2, ReasonNotValidated},
+		{"no-cache, ETag not matched", "no-cache", http.Header{"Etag": []string{`"v2"`}, "Cache-Control": []string{"max-age=60"}}, false, http.StatusOK, 2, ReasonNotValidated},
+		{"stale, Last-Modified not matched", "max-age=20", http.Header{"Last-Modified": []string{now.Format(http.TimeFormat)}}, false, http.StatusOK, 2, ReasonNotValidated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Host:   endpoint.Host,
+				URL:    endpoint,
+				Method: http.MethodGet,
+				Header: http.Header{},
+			}
+			cachedReq := &http.Request{
+				Host:   endpoint.Host,
+				URL:    endpoint,
+				Method: http.MethodGet,
+			}
+			cachedHeader := http.Header{
+				"Etag":          []string{`"v1"`},
+				"Last-Modified": []string{before30sec.Format(http.TimeFormat)},
+				"Date":          []string{before30sec.Format(http.TimeFormat)},
+				"Cache-Control": []string{tt.cacheControl},
+			}
+			cachedRes := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     cachedHeader.Clone(),
+			}
+			var originReqs []http.Header
+			do := func(req *http.Request) (*http.Response, error) {
+				originReqs = append(originReqs, req.Header.Clone())
+				if len(originReqs) == 1 {
+					return &http.Response{StatusCode: http.StatusNotModified, Header: tt.notModified.Clone(), Body: http.NoBody}, nil
+				}
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+			}
+			var got []Decision
+			ctx := ContextWithDecisionHook(context.Background(), func(d Decision) {
+				got = append(got, d)
+			})
+			s, err := NewShared()
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotCacheUsed, gotRes, err := s.Handle(req.WithContext(ctx), cachedReq, cachedRes, do, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotCacheUsed != tt.wantCacheUsed {
+				t.Errorf("got %v want %v", gotCacheUsed, tt.wantCacheUsed)
+			}
+			if gotRes.StatusCode != tt.wantStatus {
+				t.Errorf("got %v want %v", gotRes.StatusCode, tt.wantStatus)
+			}
+			if len(originReqs) != tt.wantOriginCalls {
+				t.Fatalf("got %d origin requests want %d", len(originReqs), tt.wantOriginCalls)
+			}
+			if len(got) != 1 || got[0].Reason != tt.wantDecision {
+				t.Errorf("got %v want %v", got, tt.wantDecision)
+			}
+			if tt.wantCacheUsed {
+				return
+			}
+			// The request is retried without the validators of the stored response, and the stored response is not updated.
+			if v := originReqs[1].Get("If-None-Match"); v != "" {
+				t.Errorf("got If-None-Match %q in the retried request", v)
+			}
+			if v := originReqs[1].Get("If-Modified-Since"); v != "" {
+				t.Errorf("got If-Modified-Since %q in the retried request", v)
+			}
+			if diff := cmp.Diff(cachedHeader, cachedRes.Header); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestShared_HandleRequestDirectives(t *testing.T) {
+	now := time.Date(2024, 12, 13, 14, 15, 16, 00, time.UTC)
+	before10sec := now.Add(-10 * time.Second)
+	before30sec := now.Add(-30 * time.Second)
+	endpoint, err := url.Parse("https://example.com/api/v1/path/to/resource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fresh is 10 seconds old and expires in 10 seconds.
+	fresh := http.Header{
+		"Etag":          []string{`"abc123"`},
+		"Date":          []string{before10sec.Format(http.TimeFormat)},
+		"Cache-Control": []string{"max-age=20"},
+	}
+	stale := http.Header{
+		"Etag":          []string{`"abc123"`},
+		"Date":          []string{before30sec.Format(http.TimeFormat)},
+		"Cache-Control": []string{"max-age=20"},
+	}
+
+	tests := []struct {
+		name             string
+		opts             []SharedOption
+		reqHeader        http.Header
+		cachedResHeader  http.Header
+		wantOriginCalled bool
+		wantCacheUsed    bool
+		wantStatus       int
+	}{
+		{
+			"max-age=60 -> use cached response",
+			nil,
+			http.Header{"Cache-Control": []string{"max-age=60"}},
+			fresh,
+			false,
+			true,
+			http.StatusOK,
+		},
+		{
+			"max-age=5 -> validate",
+			nil,
+			http.Header{"Cache-Control": []string{"max-age=5"}},
+			fresh,
+			true,
+			true,
+			http.StatusOK,
+		},
+		{
+			"min-fresh=5 -> use cached response",
+			nil,
+			http.Header{"Cache-Control": []string{"min-fresh=5"}},
+			fresh,
+			false,
+			true,
+			http.StatusOK,
+		},
+		{
+			"min-fresh=20 -> validate",
+			nil,
+			http.Header{"Cache-Control": []string{"min-fresh=20"}},
+			fresh,
+			true,
+			true,
+			http.StatusOK,
+		},
+		{
+			"no-cache -> validate",
+			nil,
+			http.Header{"Cache-Control": []string{"no-cache"}},
+			fresh,
+			true,
+			true,
+			http.StatusOK,
+		},
+		{
+			"Pragma: no-cache -> validate",
+			nil,
+			http.Header{"Pragma": []string{"no-cache"}},
+			fresh,
+			true,
+			true,
+			http.StatusOK,
+		},
+		{
+			"Pragma: no-cache is ignored with Cache-Control -> use cached response",
+			nil,
+			http.Header{"Pragma": []string{"no-cache"}, "Cache-Control": []string{"max-age=60"}},
+			fresh,
+			false,
+			true,
+			http.StatusOK,
+		},
+		{
+			"only-if-cached -> use cached response",
+			nil,
+			http.Header{"Cache-Control": []string{"only-if-cached"}},
+			fresh,
+			false,
+			true,
+			http.StatusOK,
+		},
+		{
+			"only-if-cached stale -> 504",
+			nil,
+			http.Header{"Cache-Control": []string{"only-if-cached"}},
+			stale,
+			false,
+			false,
+			http.StatusGatewayTimeout,
+		},
+		{
+			"only-if-cached no cached response -> 504",
+			nil,
+			http.Header{"Cache-Control": []string{"only-if-cached"}},
+			nil,
+			false,
+			false,
+			http.StatusGatewayTimeout,
+		},
+		{
+			"IgnoreRequestDirectives no-cache -> use cached response",
+			[]SharedOption{IgnoreRequestDirectives([]string{"no-cache"})},
+			http.Header{"Cache-Control": []string{"no-cache"}, "Pragma": []string{"no-cache"}},
+			fresh,
+			false,
+			true,
+			http.StatusOK,
+		},
+		{
+			"ModifyRequestDirectives limits max-age -> use cached response",
+			[]SharedOption{ModifyRequestDirectives(func(req *http.Request, d *RequestDirectives) {
+				if d.MaxAge != nil && *d.MaxAge < 30 {
+					v := uint32(30)
+					d.MaxAge = &v
+				}
+			})},
+			http.Header{"Cache-Control": []string{"max-age=0"}},
+			fresh,
+			false,
+			true,
+			http.StatusOK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &http.Request{
+				Host:   endpoint.Host,
+				URL:    endpoint,
+				Method: http.MethodGet,
+				Header: tt.reqHeader,
+			}
+			var (
+				cachedReq *http.Request
+				cachedRes *http.Response
+			)
+			if tt.cachedResHeader != nil {
+				cachedReq = &http.Request{
+					Host:   endpoint.Host,
+					URL:    endpoint,
+					Method: http.MethodGet,
+				}
+				cachedRes = &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     tt.cachedResHeader.Clone(),
+				}
+			}
+			var gotOriginCalled bool
+			do := func(req *http.Request) (*http.Response, error) {
+				gotOriginCalled = true
+				if req.Header.Get("If-None-Match") != "" {
+					return &http.Response{
+						StatusCode: http.StatusNotModified,
+						Header:     http.Header{},
+					}, nil
+				}
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{},
+				}, nil
+			}
+			s, err := NewShared(tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			gotCacheUsed, gotRes, err := s.Handle(req, cachedReq, cachedRes, do, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotOriginCalled != tt.wantOriginCalled {
+				t.Errorf("the origin called = %v, want %v", gotOriginCalled, tt.wantOriginCalled)
+			}
+			if gotCacheUsed != tt.wantCacheUsed {
+				t.Errorf("Shared.Handle() gotCacheUsed = %v, want %v", gotCacheUsed, tt.wantCacheUsed)
+			}
+			if gotRes.StatusCode != tt.wantStatus {
+				t.Errorf("Shared.Handle() got status code = %v, want %v", gotRes.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestIgnoreRequestDirectives(t *testing.T) {
+	if _, err := NewShared(IgnoreRequestDirectives([]string{"no-cache", "max-age"})); err != nil {
+		t.Error(err)
+	}
+	if _, err := NewShared(IgnoreRequestDirectives([]string{"public"})); !errors.Is(err, ErrUnknownRequestDirective) {
+		t.Errorf("got %v want %v", err, ErrUnknownRequestDirective)
+	}
+}
+
+func TestShared_HandleCacheStatus(t *testing.T) {
+	now := time.Date(2024, 12, 13, 14, 15, 16, 00, time.UTC)
+	endpoint, err := url.Parse("https://example.com/api/v1/path/to/resource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fresh is 10 seconds old and expires in 10 seconds.
+	fresh := http.Header{
+		"Etag":          []string{`"abc123"`},
+		"Date":          []string{now.Add(-10 * time.Second).Format(http.TimeFormat)},
+		"Cache-Control": []string{"max-age=20"},
+	}
+	stale := http.Header{
+		"Etag":          []string{`"abc123"`},
+		"Date":          []string{now.Add(-30 * time.Second).Format(http.TimeFormat)},
+		"Cache-Control": []string{"max-age=20"},
+	}
+	vary := http.Header{
+		"Date":          []string{now.Add(-10 * time.Second).Format(http.TimeFormat)},
+		"Cache-Control": []string{"max-age=20"},
+		"Vary":          []string{"Accept-Language"},
+	}
+
+	tests := []struct {
+		name            string
+		reqHeader       http.Header
+		cachedMethod    string
+		cachedResHeader http.Header
+		want            CacheStatus
+	}{
+		{
+			"no stored response -> uri-miss",
+			http.Header{},
+			"",
+			nil,
+			CacheStatus{Forward: ForwardURIMiss, ForwardStatus: http.StatusOK},
+		},
+		{
+			"fresh -> hit",
+			http.Header{},
+			http.MethodGet,
+			fresh,
+			CacheStatus{Expires: now.Add(10 * time.Second)},
+		},
+		{
+			"stale -> stale",
+			http.Header{},
+			http.MethodGet,
+			stale,
+			CacheStatus{Forward: ForwardStale, ForwardStatus: http.StatusNotModified, Expires: now.Add(20 * time.Second)},
+		},
+		{
+			"no-cache request -> request",
+			http.Header{"Cache-Control": []string{"no-cache"}},
+			http.MethodGet,
+			fresh,
+			CacheStatus{Forward: ForwardRequest, ForwardStatus: http.StatusNotModified, Expires: now.Add(20 * time.Second)},
+		},
+		{
+			"max-age request -> request",
+			http.Header{"Cache-Control": []string{"max-age=5"}},
+			http.MethodGet,
+			fresh,
+			CacheStatus{Forward: ForwardRequest, ForwardStatus: http.StatusNotModified, Expires: now.Add(20 * time.Second)},
+		},
+		{
+			"method mismatch -> miss",
+			http.Header{},
+			http.MethodHead,
+			fresh,
+			CacheStatus{Forward: ForwardMiss, ForwardStatus: http.StatusOK},
+		},
+		{
+			"vary mismatch -> vary-miss",
+			http.Header{"Accept-Language": []string{"ja"}},
+			http.MethodGet,
+			vary,
+			CacheStatus{Forward: ForwardVaryMiss, ForwardStatus: http.StatusOK},
+		},
+		{
+			"only-if-cached -> not forwarded",
+			http.Header{"Cache-Control": []string{"only-if-cached"}},
+			"",
+			nil,
+			CacheStatus{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cs := &CacheStatus{}
+			req := (&http.Request{
+				Host:   endpoint.Host,
+				URL:    endpoint,
+				Method: http.MethodGet,
+				Header: tt.reqHeader,
+			}).WithContext(ContextWithCacheStatus(context.Background(), cs))
+			var (
+				cachedReq *http.Request
+				cachedRes *http.Response
+			)
+			if tt.cachedResHeader != nil {
+				cachedReq = &http.Request{
+					Host:   endpoint.Host,
+					URL:    endpoint,
+					Method: tt.cachedMethod,
+					Header: http.Header{"Accept-Language": []string{"en"}},
+				}
+				cachedRes = &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     tt.cachedResHeader.Clone(),
+				}
+			}
+			do := func(req *http.Request) (*http.Response, error) {
+				if req.Header.Get("If-None-Match") != "" {
+					return &http.Response{
+						StatusCode: http.StatusNotModified,
+						Header: http.Header{
+							"Date":          []string{now.Format(http.TimeFormat)},
+							"Cache-Control": []string{"max-age=20"},
+						},
+						Body: http.NoBody,
+					}, nil
+				}
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{},
+					Body:       http.NoBody,
+				}, nil
+			}
+			s, err := NewShared()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := s.Handle(req, cachedReq, cachedRes, do, now); err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, *cs); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestShared_Decision(t *testing.T) {
+	now := time.Date(2024, 12, 13, 14, 15, 16, 00, time.UTC)
+	endpoint, err := url.Parse("https://example.com/api/v1/path/to/resource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Run("Storable", func(t *testing.T) {
+		tests := []struct {
+			name      string
+			reqHeader http.Header
+			res       *http.Response
+			want      Decision
+		}{
+			{
+				"max-age",
+				http.Header{},
+				&http.Response{StatusCode: http.StatusOK, Header: http.Header{"Cache-Control": []string{"max-age=60"}}},
+				Decision{Reason: ReasonMaxAge, Section: "RFC 9111 Section 5.2.2.1", Lifetime: 60 * time.Second},
+			},
+			{
+				"private",
+				http.Header{},
+				&http.Response{StatusCode: http.StatusOK, Header: http.Header{"Cache-Control": []string{"private, max-age=60"}}},
+				Decision{Reason: ReasonPrivate, Section: "RFC 9111 Section 5.2.2.7"},
+			},
+			{
+				"Authorization",
+				http.Header{"Authorization": []string{"Bearer token"}},
+				&http.Response{StatusCode: http.StatusOK, Header: http.Header{"Cache-Control": []string{"max-age=60"}}},
+				Decision{Reason: ReasonAuthorization, Section: "RFC 9111 Section 3.5"},
+			},
+			{
+				"Set-Cookie",
+				http.Header{},
+				&http.Response{StatusCode: http.StatusOK, Header: http.Header{"Cache-Control": []string{"max-age=60"}, "Set-Cookie": []string{"k=v"}}},
+				Decision{Reason: ReasonSetCookie},
+			},
+			{
+				"status code not understood",
+				http.Header{},
+				&http.Response{StatusCode: http.StatusPartialContent, Header: http.Header{"Cache-Control": []string{"max-age=60"}}},
+				Decision{Reason: ReasonStatusNotUnderstood, Section: "RFC 9111 Section 3"},
+			},
+			{
+				"no freshness information",
+				http.Header{},
+				&http.Response{StatusCode: http.StatusCreated, Header: http.Header{}},
+				Decision{Reason: ReasonNoFreshnessInformation, Section: "RFC 9111 Section 3"},
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				var got []Decision
+				req := (&http.Request{
+					Host:   endpoint.Host,
+					URL:    endpoint,
+					Method: http.MethodGet,
+					Header: tt.reqHeader,
+				}).WithContext(ContextWithDecisionHook(context.Background(), func(d Decision) {
+					got = append(got, d)
+				}))
+				s, err := NewShared()
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, _ = s.Storable(req, tt.res, now)
+				if diff := cmp.Diff([]Decision{tt.want}, got); diff != "" {
+					t.Error(diff)
+				}
+			})
+		}
+	})
+
+	t.Run("Handle", func(t *testing.T) {
+		tests := []struct {
+			name            string
+			reqHeader       http.Header
+			cachedResHeader http.Header
+			want            Decision
+		}{
+			{
+				"no stored response",
+				http.Header{},
+				nil,
+				Decision{Reason: ReasonURIMiss, Section: "RFC 9111 Section 4"},
+			},
+			{
+				"fresh",
+				http.Header{},
+				http.Header{"Date": []string{now.Add(-10 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=20"}},
+				Decision{Reason: ReasonFresh, Section: "RFC 9111 Section 4.2", Lifetime: 20 * time.Second},
+			},
+			{
+				"stale and validated",
+				http.Header{},
+				http.Header{"Etag": []string{`"abc123"`}, "Date": []string{now.Add(-30 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=20"}},
+				Decision{Reason: ReasonValidated, Section: "RFC 9111 Section 4.3.3", Lifetime: 20 * time.Second},
+			},
+			{
+				"stale and not validated",
+				http.Header{},
+				http.Header{"Date": []string{now.Add(-30 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=20"}},
+				Decision{Reason: ReasonNotValidated, Section: "RFC 9111 Section 4.3.3", Lifetime: 20 * time.Second},
+			},
+			{
+				"stale-while-revalidate",
+				http.Header{},
+				http.Header{"Date": []string{now.Add(-30 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=20, stale-while-revalidate=60"}},
+				Decision{Reason: ReasonStaleWhileRevalidate, Section: "RFC 5861 Section 3", Lifetime: 20 * time.Second},
+			},
+			{
+				"only-if-cached",
+				http.Header{"Cache-Control": []string{"only-if-cached"}},
+				http.Header{"Date": []string{now.Add(-30 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=20"}},
+				Decision{Reason: ReasonOnlyIfCached, Section: "RFC 9111 Section 5.2.1.7", Lifetime: 20 * time.Second},
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				var got []Decision
+				ctx := ContextWithDecisionHook(context.Background(), func(d Decision) {
+					got = append(got, d)
+				})
+				ctx = ContextWithRevalidator(ctx, &testRevalidator{})
+				req := (&http.Request{
+					Host:   endpoint.Host,
+					URL:    endpoint,
+					Method: http.MethodGet,
+					Header: tt.reqHeader,
+				}).WithContext(ctx)
+				var (
+					cachedReq *http.Request
+					cachedRes *http.Response
+				)
+				if tt.cachedResHeader != nil {
+					cachedReq = &http.Request{
+						Host:   endpoint.Host,
+						URL:    endpoint,
+						Method: http.MethodGet,
+					}
+					cachedRes = &http.Response{
+						StatusCode: http.StatusOK,
+						Header:     tt.cachedResHeader.Clone(),
+					}
+				}
+				do := func(req *http.Request) (*http.Response, error) {
+					if req.Header.Get("If-None-Match") != "" {
+						return &http.Response{
+							StatusCode: http.StatusNotModified,
+							Header:     http.Header{},
+							Body:       http.NoBody,
+						}, nil
+					}
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Header:     http.Header{},
+						Body:       http.NoBody,
+					}, nil
+				}
+				s, err := NewShared()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, _, err := s.Handle(req, cachedReq, cachedRes, do, now); err != nil {
+					t.Fatal(err)
+				}
+				if diff := cmp.Diff([]Decision{tt.want}, got); diff != "" {
+					t.Error(diff)
+				}
+			})
+		}
+	})
+}
+
+func TestShared_QualifiedDirectives(t *testing.T) {
+	now := time.Date(2024, 12, 13, 14, 15, 16, 00, time.UTC)
+	endpoint, err := url.Parse("https://example.com/api/v1/path/to/resource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{
+		Host:   endpoint.Host,
+		URL:    endpoint,
+		Method: http.MethodGet,
+		Header: http.Header{},
+	}
+
+	t.Run("Storable", func(t *testing.T) {
+		tests := []struct {
+			name             string
+			private          bool
+			header           http.Header
+			wantOK           bool
+			wantStoredHeader http.Header
+		}{
+			{
+				`private="Set-Cookie" -> stored without Set-Cookie`,
+				false,
+				http.Header{"Cache-Control": []string{`private="Set-Cookie", max-age=60`}, "Set-Cookie": []string{"k=v"}, "X-Foo": []string{"bar"}},
+				true,
+				http.Header{"Cache-Control": []string{`private="Set-Cookie", max-age=60`}, "X-Foo": []string{"bar"}},
+			},
+			{
+				`no-cache="Set-Cookie" -> stored without Set-Cookie`,
+				false,
+				http.Header{"Cache-Control": []string{`no-cache="Set-Cookie", max-age=60`}, "Set-Cookie": []string{"k=v"}, "X-Foo": []string{"bar"}},
+				true,
+				http.Header{"Cache-Control": []string{`no-cache="Set-Cookie", max-age=60`}, "X-Foo": []string{"bar"}},
+			},
+			{
+				`private="X-User" with Set-Cookie -> not storable`,
+				false,
+				http.Header{"Cache-Control": []string{`private="X-User", max-age=60`}, "Set-Cookie": []string{"k=v"}, "X-User": []string{"alice"}},
+				false,
+				http.Header{"Cache-Control": []string{`private="X-User", max-age=60`}, "Set-Cookie": []string{"k=v"}},
+			},
+			{
+				`private="X-User" in private cache -> stored with X-User`,
+				true,
+				http.Header{"Cache-Control": []string{`private="X-User", max-age=60`}, "X-User": []string{"alice"}},
+				true,
+				http.Header{"Cache-Control": []string{`private="X-User", max-age=60`}, "X-User": []string{"alice"}},
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				s, err := NewShared()
+				if err != nil {
+					t.Fatal(err)
+				}
+				s.private = tt.private
+				res := &http.Response{StatusCode: http.StatusOK, Header: tt.header.Clone()}
+				ok, _ := s.Storable(req, res, now)
+				if ok != tt.wantOK {
+					t.Errorf("got %v want %v", ok, tt.wantOK)
+				}
+				if diff := cmp.Diff(tt.wantStoredHeader, s.StoredHeader(res)); diff != "" {
+					t.Error(diff)
+				}
+				// Neither Storable nor StoredHeader modifies the response.
+				if diff := cmp.Diff(tt.header, res.Header); diff != "" {
+					t.Error(diff)
+				}
+			})
+		}
+	})
+
+	t.Run("Handle", func(t *testing.T) {
+		tests := []struct {
+			name              string
+			cachedResHeader   http.Header
+			notModifiedHeader http.Header
+			wantOriginCalled  bool
+			wantXUser         string
+		}{
+			{
+				`no-cache="X-User" fresh -> used without X-User`,
+				http.Header{"Date": []string{now.Add(-10 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{`no-cache="X-User", max-age=20`}, "X-User": []string{"alice"}, "Etag": []string{`"abc123"`}},
+				nil,
+				false,
+				"",
+			},
+			{
+				`no-cache="X-User" stale -> validated with X-User of the 304 response`,
+				http.Header{"Date": []string{now.Add(-30 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{`no-cache="X-User", max-age=20`}, "X-User": []string{"alice"}, "Etag": []string{`"abc123"`}},
+				http.Header{"X-User": []string{"bob"}},
+				true,
+				"bob",
+			},
+			{
+				`no-cache="X-User" stale -> validated without X-User`,
+				http.Header{"Date": []string{now.Add(-30 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{`no-cache="X-User", max-age=20`}, "X-User": []string{"alice"}, "Etag": []string{`"abc123"`}},
+				http.Header{},
+				true,
+				"",
+			},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				s, err := NewShared()
+				if err != nil {
+					t.Fatal(err)
+				}
+				cachedRes := &http.Response{StatusCode: http.StatusOK, Header: tt.cachedResHeader.Clone()}
+				var gotOriginCalled bool
+				do := func(req *http.Request) (*http.Response, error) {
+					gotOriginCalled = true
+					return &http.Response{StatusCode: http.StatusNotModified, Header: tt.notModifiedHeader.Clone(), Body: http.NoBody}, nil
+				}
+				cacheUsed, res, err := s.Handle(req, req, cachedRes, do, now)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !cacheUsed {
+					t.Error("the stored response should be used")
+				}
+				if gotOriginCalled != tt.wantOriginCalled {
+					t.Errorf("the origin called = %v, want %v", gotOriginCalled, tt.wantOriginCalled)
+				}
+				if got := res.Header.Get("X-User"); got != tt.wantXUser {
+					t.Errorf("got %q want %q", got, tt.wantXUser)
+				}
+			})
+		}
+	})
+
+	t.Run("Storable and validated", func(t *testing.T) {
+		s, err := NewShared()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The response to user A is stored and becomes stale.
+		stored := &http.Response{StatusCode: http.StatusOK, Header: http.Header{
+			"Date":          []string{now.Add(-30 * time.Second).Format(http.TimeFormat)},
+			"Cache-Control": []string{`no-cache="Set-Cookie", max-age=20`},
+			"Set-Cookie":    []string{"user=a"},
+			"Etag":          []string{`"abc123"`},
+		}}
+		if ok, _ := s.Storable(req, stored, now.Add(-30*time.Second)); !ok {
+			t.Fatal("the response should be storable")
+		}
+		// The stored response is validated by the request of user B.
+		do := func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: http.StatusNotModified, Header: http.Header{"Etag": []string{`"abc123"`}}, Body: http.NoBody}, nil
+		}
+		cacheUsed, res, err := s.Handle(req, req, stored, do, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !cacheUsed {
+			t.Error("the stored response should be used")
+		}
+		if got := res.Header.Values("Set-Cookie"); len(got) != 0 {
+			t.Errorf("got %v want no Set-Cookie", got)
+		}
+	})
+}
+
+func TestShared_HandleHead(t *testing.T) {
+	now := time.Date(2024, 12, 13, 14, 15, 16, 00, time.UTC)
+	endpoint, err := url.Parse("https://example.com/api/v1/path/to/resource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name             string
+		method           string
+		cachedMethod     string
+		cachedResHeader  http.Header
+		wantCacheUsed    bool
+		wantOriginMethod string
+		wantBody         string
+	}{
+		{
+			"HEAD with fresh GET -> used without body",
+			http.MethodHead,
+			http.MethodGet,
+			http.Header{"Date": []string{now.Add(-10 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=60"}, "Etag": []string{`"v1"`}},
+			true,
+			"",
+			"",
+		},
+		{
+			"HEAD with stale GET -> validated with HEAD",
+			http.MethodHead,
+			http.MethodGet,
+			http.Header{"Date": []string{now.Add(-120 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=60"}, "Etag": []string{`"v1"`}},
+			true,
+			http.MethodHead,
+			"",
+		},
+		{
+			"GET with fresh GET -> used with body",
+			http.MethodGet,
+			http.MethodGet,
+			http.Header{"Date": []string{now.Add(-10 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=60"}, "Etag": []string{`"v1"`}},
+			true,
+			"",
+			"hello",
+		},
+		{
+			"GET with fresh HEAD -> not used",
+			http.MethodGet,
+			http.MethodHead,
+			http.Header{"Date": []string{now.Add(-10 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=60"}, "Etag": []string{`"v1"`}},
+			false,
+			http.MethodGet,
+			"",
+		},
+		{
+			"HEAD with fresh POST -> not used",
+			http.MethodHead,
+			http.MethodPost,
+			http.Header{"Date": []string{now.Add(-10 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=60"}, "Content-Location": []string{endpoint.String()}},
+			false,
+			http.MethodHead,
+			"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewShared()
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &http.Request{Host: endpoint.Host, URL: endpoint, Method: tt.method, Header: http.Header{}}
+			cachedReq := &http.Request{Host: endpoint.Host, URL: endpoint, Method: tt.cachedMethod, Header: http.Header{}}
+			cachedRes := &http.Response{StatusCode: http.StatusOK, Header: tt.cachedResHeader.Clone(), Body: io.NopCloser(strings.NewReader("hello"))}
+			var gotOriginMethod string
+			do := func(req *http.Request) (*http.Response, error) {
+				gotOriginMethod = req.Method
+				if req.Header.Get("If-None-Match") == `"v1"` {
+					return &http.Response{StatusCode: http.StatusNotModified, Header: http.Header{"Etag": []string{`"v1"`}}, Body: http.NoBody}, nil
+				}
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+			}
+			cacheUsed, res, err := s.Handle(req, cachedReq, cachedRes, do, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cacheUsed != tt.wantCacheUsed {
+				t.Errorf("got %v want %v", cacheUsed, tt.wantCacheUsed)
+			}
+			if gotOriginMethod != tt.wantOriginMethod {
+				t.Errorf("got %q want %q", gotOriginMethod, tt.wantOriginMethod)
+			}
+			if res.Header.Get("Etag") != `"v1"` && tt.wantCacheUsed {
+				t.Errorf("the header of the stored response should be used: %v", res.Header)
+			}
+			b, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != tt.wantBody {
+				t.Errorf("got %q want %q", string(b), tt.wantBody)
+			}
+		})
+	}
+}
+
+type testRevalidator struct {
+	reqs []*http.Request
+}
+
+func (r *testRevalidator) Revalidate(req *http.Request, do func(*http.Request) (*http.Response, error)) {
+	r.reqs = append(r.reqs, req)
+}
+
+func TestShared_HandleWithRevalidator(t *testing.T) {
+	now := time.Date(2024, 12, 13, 14, 15, 16, 00, time.UTC)
+	before30sec := now.Add(-30 * time.Second)
+	endpoint, err := url.Parse("https://example.com/api/v1/path/to/resource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &testRevalidator{}
+	req := (&http.Request{
+		Host:   endpoint.Host,
+		URL:    endpoint,
+		Method: http.MethodGet,
+		Header: http.Header{},
+	}).WithContext(ContextWithRevalidator(context.Background(), r))
+	cachedReq := &http.Request{
+		Host:   endpoint.Host,
+		URL:    endpoint,
+		Method: http.MethodGet,
+	}
+	cachedRes := &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Date":          []string{before30sec.Format(http.TimeFormat)},
+			"Cache-Control": []string{"max-age=20, stale-while-revalidate=30"},
+		},
+	}
+	do := func(req *http.Request) (*http.Response, error) {
+		t.Error("the origin should not be requested in the foreground")
+		return nil, http.ErrHandlerTimeout
+	}
+	s, err := NewShared()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotCacheUsed, _, err := s.Handle(req, cachedReq, cachedRes, do, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gotCacheUsed {
+		t.Error("Shared.Handle() gotCacheUsed = false, want true")
+	}
+	if len(r.reqs) != 1 {
+		t.Errorf("Revalidator.Revalidate() called %d times, want 1", len(r.reqs))
+	}
+}
+
+func TestShared_HandleKeyFunc(t *testing.T) {
+	now := time.Date(2024, 12, 13, 14, 15, 16, 00, time.UTC)
+	// The key ignores the query.
+	keyFunc := func(req *http.Request) string {
+		return req.Method + " " + req.Host + req.URL.Path
+	}
+	tests := []struct {
+		name          string
+		target        string
+		cachedTarget  string
+		method        string
+		keyFunc       func(req *http.Request) string
+		wantCacheUsed bool
+	}{
+		{"different query", "https://example.com/a?utm_source=x", "https://example.com/a", http.MethodGet, nil, false},
+		{"same key", "https://example.com/a?utm_source=x", "https://example.com/a", http.MethodGet, keyFunc, true},
+		{"different key", "https://example.com/b", "https://example.com/a", http.MethodGet, keyFunc, false},
+		{"HEAD for stored GET", "https://example.com/a?utm_source=x", "https://example.com/a", http.MethodHead, keyFunc, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewShared()
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(tt.target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cu, err := url.Parse(tt.cachedTarget)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			if tt.keyFunc != nil {
+				ctx = ContextWithKeyFunc(ctx, tt.keyFunc)
+			}
+			req := (&http.Request{Host: u.Host, URL: u, Method: tt.method, Header: http.Header{}}).WithContext(ctx)
+			cachedReq := &http.Request{Host: cu.Host, URL: cu, Method: http.MethodGet, Header: http.Header{}}
+			cachedRes := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Date": []string{now.Add(-10 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=60"}},
+				Body:       http.NoBody,
+			}
+			do := func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+			}
+			cacheUsed, _, err := s.Handle(req, cachedReq, cachedRes, do, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cacheUsed != tt.wantCacheUsed {
+				t.Errorf("got %v want %v", cacheUsed, tt.wantCacheUsed)
+			}
+		})
+	}
+}
+
+func TestShared_HandleResponseTimes(t *testing.T) {
+	now := time.Date(2024, 12, 13, 14, 15, 16, 00, time.UTC)
+	endpoint, err := url.Parse("https://example.com/api/v1/path/to/resource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name          string
+		cacheControl  string
+		times         *responseTimes
+		wantCacheUsed bool
+		wantAge       string
+	}{
+		// The clock of the origin is 40 seconds ahead, so the Date header field is 10 seconds ago although the response was received 50 seconds ago.
+		{"approximated age", "max-age=30", nil, true, "10"},
+		{"exact age", "max-age=30", &responseTimes{request: now.Add(-51 * time.Second), response: now.Add(-50 * time.Second)}, false, ""},
+		{"exact age of fresh response", "max-age=60", &responseTimes{request: now.Add(-51 * time.Second), response: now.Add(-50 * time.Second)}, true, "51"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewShared()
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &http.Request{Host: endpoint.Host, URL: endpoint, Method: http.MethodGet, Header: http.Header{}}
+			cachedReq := &http.Request{Host: endpoint.Host, URL: endpoint, Method: http.MethodGet, Header: http.Header{}}
+			if tt.times != nil {
+				cachedReq = cachedReq.WithContext(ContextWithResponseTimes(context.Background(), tt.times.request, tt.times.response))
+			}
+			cachedRes := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Date": []string{now.Add(-10 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{tt.cacheControl}},
+				Body:       http.NoBody,
+			}
+			do := func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+			}
+			cacheUsed, res, err := s.Handle(req, cachedReq, cachedRes, do, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cacheUsed != tt.wantCacheUsed {
+				t.Errorf("got %v want %v", cacheUsed, tt.wantCacheUsed)
+			}
+			if got := res.Header.Get("Age"); got != tt.wantAge {
+				t.Errorf("got %q want %q", got, tt.wantAge)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package rfc9111
+
+import (
+	"context"
+	"time"
+)
+
+// ForwardReason is the reason why the request was forwarded to the origin (https://www.rfc-editor.org/rfc/rfc9211#section-2.2).
+type ForwardReason string
+
+const (
+	// ForwardBypass means that the cache was configured to not handle the request.
+	ForwardBypass ForwardReason = "bypass"
+	// ForwardURIMiss means that the cache did not contain any responses that matched the request URI.
+	ForwardURIMiss ForwardReason = "uri-miss"
+	// ForwardVaryMiss means that the cache contained a response that matched the request URI, but it could not select a response based upon the request header fields nominated by Vary.
+	ForwardVaryMiss ForwardReason = "vary-miss"
+	// ForwardMiss means that the cache did not contain any responses that could be used to satisfy the request (e.g. the request method does not match).
+	ForwardMiss ForwardReason = "miss"
+	// ForwardRequest means that the cache was able to select a fresh response, but client request header fields (e.g. Cache-Control: no-cache) caused the request to be forwarded.
+	ForwardRequest ForwardReason = "request"
+	// ForwardStale means that the cache was able to select a response, but it was stale or had to be validated (e.g. Cache-Control: no-cache).
+	ForwardStale ForwardReason = "stale"
+)
+
+// CacheStatus is the status of the cache for a request (https://www.rfc-editor.org/rfc/rfc9211).
+// Shared.Handle reports the status to the CacheStatus set in the request context by ContextWithCacheStatus.
+type CacheStatus struct {
+	// Forward is the reason why the request was forwarded to the origin.
+	// It is empty if the request was not forwarded.
+	Forward ForwardReason
+	// ForwardStatus is the status code of the response from the origin.
+	// It is 0 if the request was not forwarded or no response was received.
+	ForwardStatus int
+	// Expires is the expiration time of the response. It is zero if it is unknown.
+	Expires time.Time
+	// Stored reports whether the response from the origin was stored.
+	Stored bool
+	// Collapsed reports whether the request was collapsed with another request.
+	Collapsed bool
+}
+
+type cacheStatusKey struct{}
+
+// ContextWithCacheStatus returns a copy of ctx in which the CacheStatus is set.
+// Shared.Handle reports the status of the cache for the request to cs.
+func ContextWithCacheStatus(ctx context.Context, cs *CacheStatus) context.Context {
+	return context.WithValue(ctx, cacheStatusKey{}, cs)
+}
+
+// CacheStatusFromContext returns the CacheStatus set in ctx.
+func CacheStatusFromContext(ctx context.Context) (*CacheStatus, bool) {
+	cs, ok := ctx.Value(cacheStatusKey{}).(*CacheStatus)
+	return cs, ok && cs != nil
+}
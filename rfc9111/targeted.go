@@ -0,0 +1,165 @@
+package rfc9111
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// sfKeyRe is the pattern of the key of Dictionary and Parameters (https://www.rfc-editor.org/rfc/rfc9651#section-3.1.2).
+	sfKeyRe = regexp.MustCompile(`^[a-z*][a-z0-9_\-.*]*$`)
+	// sfBareItemRe is the pattern of Integer, Decimal, String, Token, Byte Sequence and Boolean (https://www.rfc-editor.org/rfc/rfc9651#section-3.3).
+	sfBareItemRe = regexp.MustCompile(`^(-?[0-9]{1,15}|-?[0-9]{1,12}\.[0-9]{1,3}|"([\x20\x21\x23-\x5b\x5d-\x7e]|\\["\\])*"|[A-Za-z*][A-Za-z0-9!#$%&'*+\-.^_` + "`" + `|~:/]*|:[A-Za-z0-9+/=]*:|\?[01])$`)
+)
+
+// ParseTargetedCacheControlHeader parses the targeted cache control field (e.g. CDN-Cache-Control) of a response (https://www.rfc-editor.org/rfc/rfc9213).
+// The field is a Dictionary Structured Field (https://www.rfc-editor.org/rfc/rfc9651#section-3.2).
+// It returns false if the field is not valid or empty.
+func ParseTargetedCacheControlHeader(headers []string) (*ResponseDirectives, bool) {
+	d := &ResponseDirectives{targeted: true}
+	members := 0
+	for _, h := range headers {
+		for _, m := range splitSFList(h) {
+			m = strings.TrimSpace(m)
+			if m == "" {
+				// Empty members are not allowed, but an empty field line is ignored.
+				if strings.TrimSpace(h) == "" {
+					continue
+				}
+				return nil, false
+			}
+			// Parameters are ignored.
+			params := splitSFParams(m)
+			for _, p := range params[1:] {
+				k, v, ok := strings.Cut(strings.TrimSpace(p), "=")
+				if !sfKeyRe.MatchString(k) || (ok && !sfBareItemRe.MatchString(v)) {
+					return nil, false
+				}
+			}
+			k, v, ok := strings.Cut(strings.TrimSpace(params[0]), "=")
+			if !sfKeyRe.MatchString(k) || (ok && !sfBareItemRe.MatchString(v)) {
+				return nil, false
+			}
+			members++
+			if !ok {
+				v = "?1"
+			}
+			applyTargetedDirective(d, k, v)
+		}
+	}
+	if members == 0 {
+		return nil, false
+	}
+	return d, true
+}
+
+// applyTargetedDirective applies the directive of the targeted cache control field.
+// A directive with the Boolean value false is the same as the absence of the directive (https://www.rfc-editor.org/rfc/rfc9213#section-2.1).
+// A directive with an unexpected type of value is ignored.
+func applyTargetedDirective(d *ResponseDirectives, k, v string) {
+	switch k {
+	case "max-age":
+		d.MaxAge = sfSeconds(v)
+	case "s-maxage":
+		d.SMaxAge = sfSeconds(v)
+	case "stale-while-revalidate":
+		d.StaleWhileRevalidate = sfSeconds(v)
+	case "stale-if-error":
+		d.StaleIfError = sfSeconds(v)
+	case "must-revalidate":
+		d.MustRevalidate = v == "?1"
+	case "must-understand":
+		d.MustUnderstand = v == "?1"
+	case "no-cache":
+		d.NoCache = v == "?1"
+		if strings.HasPrefix(v, `"`) {
+			d.NoCacheFields = parseFieldNames(v)
+		}
+	case "no-store":
+		d.NoStore = v == "?1"
+	case "no-transform":
+		d.NoTransform = v == "?1"
+	case "private":
+		d.Private = v == "?1"
+		if strings.HasPrefix(v, `"`) {
+			d.PrivateFields = parseFieldNames(v)
+		}
+	case "proxy-revalidate":
+		d.ProxyRevalidate = v == "?1"
+	case "public":
+		d.Public = v == "?1"
+	default:
+		// A cache MUST ignore unrecognized cache directives. (https://www.rfc-editor.org/rfc/rfc9111#section-5.2.3)
+		// They are kept so that they can be passed to the extensions.
+		dir := Directive{Name: k}
+		if v != "?1" {
+			dir.Value, dir.HasValue = v, true
+			if strings.HasPrefix(v, `"`) {
+				dir.Value, _, _ = unquoteString(v, 0)
+			}
+		}
+		d.Extensions = append(d.Extensions, dir)
+	}
+}
+
+// sfSeconds returns the non-negative Integer value as seconds.
+func sfSeconds(v string) *uint32 {
+	u64, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return nil
+	}
+	u32 := uint32(u64)
+	return &u32
+}
+
+// splitSFList splits the members of List or Dictionary by commas that are not in String.
+func splitSFList(v string) []string {
+	return splitOutsideString(v, ',')
+}
+
+// splitSFParams splits the item and its Parameters by semicolons that are not in String.
+func splitSFParams(v string) []string {
+	return splitOutsideString(v, ';')
+}
+
+func splitOutsideString(v string, sep byte) []string {
+	var (
+		s      []string
+		quoted bool
+		start  int
+	)
+	for i := 0; i < len(v); i++ {
+		switch {
+		case quoted && v[i] == '\\':
+			i++
+		case v[i] == '"':
+			quoted = !quoted
+		case !quoted && v[i] == sep:
+			s = append(s, v[start:i])
+			start = i + 1
+		}
+	}
+	return append(s, v[start:])
+}
+
+// targetedDirectives returns the directives of the first valid and non-empty targeted cache control field in the target list (https://www.rfc-editor.org/rfc/rfc9213#section-2.2).
+func (s *Shared) targetedDirectives(h http.Header) (*ResponseDirectives, bool) {
+	for _, n := range s.targetedFields {
+		v := h.Values(n)
+		if len(v) == 0 {
+			continue
+		}
+		if d, ok := ParseTargetedCacheControlHeader(v); ok {
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+// hasTargetedField returns true if the response has one of the targeted cache control fields in the target list.
+func (s *Shared) hasTargetedField(h http.Header) bool {
+	_, ok := s.targetedDirectives(h)
+	return ok
+}
@@ -0,0 +1,77 @@
+package rfc9111
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func TestParseTargetedCacheControlHeader(t *testing.T) {
+	u32 := func(v uint32) *uint32 { return &v }
+	tests := []struct {
+		name    string
+		headers []string
+		want    *ResponseDirectives
+		wantOK  bool
+	}{
+		{"max-age", []string{"max-age=60"}, &ResponseDirectives{MaxAge: u32(60)}, true},
+		{"multiple directives", []string{"max-age=60, must-revalidate", "stale-if-error=30"}, &ResponseDirectives{MaxAge: u32(60), MustRevalidate: true, StaleIfError: u32(30)}, true},
+		{"boolean", []string{"no-store=?1, public=?0"}, &ResponseDirectives{NoStore: true}, true},
+		{"parameters and unknown directives", []string{`max-age=60;a=1, foo="bar, baz"`}, &ResponseDirectives{MaxAge: u32(60), Extensions: []Directive{{Name: "foo", Value: "bar, baz", HasValue: true}}}, true},
+		{"unknown boolean directive", []string{"max-age=60, immutable"}, &ResponseDirectives{MaxAge: u32(60), Extensions: []Directive{{Name: "immutable"}}}, true},
+		{"value of unexpected type is ignored", []string{`max-age="60", s-maxage=-1`}, &ResponseDirectives{}, true},
+		{"empty", []string{""}, nil, false},
+		{"trailing comma", []string{"max-age=60,"}, nil, false},
+		{"invalid key", []string{"Max-Age=60"}, nil, false},
+		{"invalid value", []string{"max-age=6 0"}, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ParseTargetedCacheControlHeader(tt.headers)
+			if ok != tt.wantOK {
+				t.Errorf("got %v want %v", ok, tt.wantOK)
+			}
+			if diff := cmp.Diff(tt.want, got, cmpopts.IgnoreUnexported(ResponseDirectives{})); diff != "" {
+				t.Error(diff)
+			}
+		})
+	}
+}
+
+func TestStripTargetedCacheControl(t *testing.T) {
+	now := time.Date(2024, 12, 13, 14, 15, 16, 00, time.UTC)
+	s, err := NewShared(TargetedCacheControl([]string{"CDN-Cache-Control"}), StripTargetedCacheControl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &http.Request{Method: http.MethodGet, Host: "example.com", URL: &url.URL{Path: "/"}}
+	cachedRes := &http.Response{
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"Date":              []string{now.Format(http.TimeFormat)},
+			"Cache-Control":     []string{"no-cache"},
+			"Cdn-Cache-Control": []string{"max-age=60"},
+		},
+	}
+	do := func(req *http.Request) (*http.Response, error) {
+		t.Error("the origin should not be requested")
+		return nil, nil
+	}
+	cacheUsed, res, err := s.Handle(req, req, cachedRes, do, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cacheUsed {
+		t.Error("the stored response should be used")
+	}
+	if got := res.Header.Get("CDN-Cache-Control"); got != "" {
+		t.Errorf("got %q want empty", got)
+	}
+	if got := res.Header.Get("Cache-Control"); got != "no-cache" {
+		t.Errorf("got %q want %q", got, "no-cache")
+	}
+}
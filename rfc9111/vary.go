@@ -0,0 +1,219 @@
+package rfc9111
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// VaryNormalizer normalizes the values of the request header field nominated by the Vary header field (https://www.rfc-editor.org/rfc/rfc9111#section-4.1).
+// values are all the field lines of the field (nil if the field is absent).
+// Two requests match for the field if the normalized values are the same.
+type VaryNormalizer func(values []string) string
+
+// VaryNormalizers sets the normalizers of the request header fields nominated by the Vary header field.
+// The key is the field name (case-insensitive).
+// The fields without the normalizer are compared after combining the field lines and normalizing the whitespace.
+func VaryNormalizers(normalizers map[string]VaryNormalizer) SharedOption {
+	return func(s *Shared) error {
+		s.varyNormalizers = map[string]VaryNormalizer{}
+		for k, n := range normalizers {
+			s.varyNormalizers[http.CanonicalHeaderKey(k)] = n
+		}
+		return nil
+	}
+}
+
+// varyMatched returns true if the request header fields nominated by the Vary header field of the stored response match those of the stored request (https://www.rfc-editor.org/rfc/rfc9111#section-4.1).
+func (s *Shared) varyMatched(resHeader http.Header, req, cachedReq *http.Request) bool {
+	for _, v := range resHeader.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			// A stored response with a Vary header field value containing a member "*" always fails to match.
+			if name == "*" {
+				return false
+			}
+			if !s.fieldMatched(http.CanonicalHeaderKey(name), req.Header, cachedReq.Header) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// fieldMatched returns true if the field of h1 can be transformed to that of h2 by the normalization.
+func (s *Shared) fieldMatched(name string, h1, h2 http.Header) bool {
+	v1, ok1 := s.NormalizeVaryField(name, h1.Values(name))
+	v2, ok2 := s.NormalizeVaryField(name, h2.Values(name))
+	return ok1 == ok2 && v1 == v2
+}
+
+// NormalizeVaryField returns the normalized value of the request header field nominated by the Vary header field.
+// Two requests match for the field if the results are the same (https://www.rfc-editor.org/rfc/rfc9111#section-4.1).
+// values are all the field lines of the field (nil if the field is absent).
+// The normalizer of the field is used if it is set (see VaryNormalizers).
+// Otherwise, ok is false if the field is absent and the field lines are normalized with NormalizeFieldValues.
+func (s *Shared) NormalizeVaryField(name string, values []string) (v string, ok bool) {
+	if n, ok := s.varyNormalizers[http.CanonicalHeaderKey(name)]; ok {
+		return n(values), true
+	}
+	// If (after any normalization that might take place) a header field is absent from a request, it can only match another request if it is also absent there.
+	if len(values) == 0 {
+		return "", false
+	}
+	return NormalizeFieldValues(values), true
+}
+
+// NormalizeFieldValues combines the field lines into one value and normalizes the whitespace (https://www.rfc-editor.org/rfc/rfc9111#section-4.1).
+//   - adding or removing whitespace, where allowed in the header field's syntax;
+//   - combining multiple header field lines with the same field name (see https://www.rfc-editor.org/rfc/rfc9110#section-5.3).
+//
+// The whitespace in quoted strings is kept.
+func NormalizeFieldValues(values []string) string {
+	var members []string
+	for _, v := range values {
+		for _, m := range splitOutsideString(v, ',') {
+			m = collapseWhitespace(m)
+			if m == "" {
+				// A recipient MUST parse and ignore a reasonable number of empty list elements (https://www.rfc-editor.org/rfc/rfc9110#section-5.6.1).
+				continue
+			}
+			members = append(members, m)
+		}
+	}
+	return strings.Join(members, ", ")
+}
+
+// collapseWhitespace trims the whitespace and replaces each run of whitespace outside quoted strings with a single space.
+func collapseWhitespace(v string) string {
+	var (
+		b      strings.Builder
+		quoted bool
+		space  bool
+	)
+	v = strings.Trim(v, " \t")
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(v):
+			b.WriteByte(c)
+			i++
+			c = v[i]
+		case c == '"':
+			quoted = !quoted
+		case !quoted && (c == ' ' || c == '\t'):
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// AcceptEncodingNormalizer returns the normalizer of the Accept-Encoding header field that maps it to the first content coding in codings acceptable to the client (e.g. "br", "gzip").
+// If none of them is acceptable, it is mapped to "identity" (https://www.rfc-editor.org/rfc/rfc9110#section-12.5.3).
+// The origin must select the content coding in the same way.
+func AcceptEncodingNormalizer(codings ...string) VaryNormalizer {
+	return func(values []string) string {
+		prefs := parseQualityValues(values)
+		for _, c := range codings {
+			if q, ok := qualityOf(prefs, strings.ToLower(c), func(p, c string) bool {
+				return p == c || (c == "gzip" && p == "x-gzip") || p == "*"
+			}); ok && q > 0 {
+				return c
+			}
+		}
+		return "identity"
+	}
+}
+
+// AcceptLanguageNormalizer returns the normalizer of the Accept-Language header field that maps it to the language tag in langs most preferred by the client (https://www.rfc-editor.org/rfc/rfc9110#section-12.5.4).
+// The language ranges are matched by the basic filtering (https://www.rfc-editor.org/rfc/rfc4647#section-3.3.1).
+// If none of them is acceptable, it is mapped to the first language tag in langs (the default language).
+// The origin must select the language in the same way.
+func AcceptLanguageNormalizer(langs ...string) VaryNormalizer {
+	return func(values []string) string {
+		if len(langs) == 0 {
+			return ""
+		}
+		prefs := parseQualityValues(values)
+		best, bestQ := langs[0], 0.0
+		for _, l := range langs {
+			q, ok := qualityOf(prefs, strings.ToLower(l), func(p, l string) bool {
+				return p == "*" || p == l || strings.HasPrefix(l, p+"-")
+			})
+			if ok && q > bestQ {
+				best, bestQ = l, q
+			}
+		}
+		return best
+	}
+}
+
+// qualityValue is a member of the field with the quality value (https://www.rfc-editor.org/rfc/rfc9110#section-12.4.2).
+type qualityValue struct {
+	value string
+	q     float64
+}
+
+// parseQualityValues parses the members of the field with the quality values (e.g. Accept-Encoding).
+// The values are lowercased.
+func parseQualityValues(values []string) []qualityValue {
+	var qvs []qualityValue
+	for _, v := range values {
+		for _, m := range strings.Split(v, ",") {
+			value, params, _ := strings.Cut(m, ";")
+			value = strings.ToLower(strings.TrimSpace(value))
+			if value == "" {
+				continue
+			}
+			qv := qualityValue{value: value, q: 1}
+			for _, p := range strings.Split(params, ";") {
+				k, v, ok := strings.Cut(p, "=")
+				if !ok || !strings.EqualFold(strings.TrimSpace(k), "q") {
+					continue
+				}
+				q, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+				if err != nil || q < 0 || q > 1 {
+					continue
+				}
+				qv.q = q
+			}
+			qvs = append(qvs, qv)
+		}
+	}
+	return qvs
+}
+
+// qualityOf returns the quality value of v in qvs.
+// The most specific member (not "*") that matches v takes precedence.
+func qualityOf(qvs []qualityValue, v string, match func(member, v string) bool) (float64, bool) {
+	var (
+		q        float64
+		found    bool
+		wildcard bool
+		specific int
+	)
+	for _, qv := range qvs {
+		if !match(qv.value, v) {
+			continue
+		}
+		if qv.value == "*" {
+			if !found {
+				q, found, wildcard = qv.q, true, true
+			}
+			continue
+		}
+		if wildcard || !found || len(qv.value) > specific {
+			q, found, wildcard, specific = qv.q, true, false, len(qv.value)
+		}
+	}
+	return q, found
+}
@@ -0,0 +1,197 @@
+package rfc9111
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestNormalizeFieldValues(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   string
+	}{
+		{nil, ""},
+		{[]string{"gzip"}, "gzip"},
+		{[]string{"gzip,br"}, "gzip, br"},
+		{[]string{"  gzip ,   br  "}, "gzip, br"},
+		{[]string{"gzip", "br"}, "gzip, br"},
+		{[]string{"gzip;  q=0.5, , br"}, "gzip; q=0.5, br"},
+		{[]string{`"a,  b" ,c`}, `"a,  b", c`},
+		{[]string{`"a\"  ,b"`}, `"a\"  ,b"`},
+		{[]string{"Mozilla/5.0   (X11;\tLinux)"}, "Mozilla/5.0 (X11; Linux)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := NormalizeFieldValues(tt.values); got != tt.want {
+				t.Errorf("got %q want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVaryNormalizer(t *testing.T) {
+	tests := []struct {
+		name       string
+		normalizer VaryNormalizer
+		values     []string
+		want       string
+	}{
+		{"br", AcceptEncodingNormalizer("br", "gzip"), []string{"gzip, deflate, br"}, "br"},
+		{"gzip", AcceptEncodingNormalizer("br", "gzip"), []string{"gzip, deflate"}, "gzip"},
+		{"x-gzip", AcceptEncodingNormalizer("br", "gzip"), []string{"x-gzip"}, "gzip"},
+		{"br not acceptable", AcceptEncodingNormalizer("br", "gzip"), []string{"br;q=0, gzip;q=0.5"}, "gzip"},
+		{"wildcard", AcceptEncodingNormalizer("br", "gzip"), []string{"*"}, "br"},
+		{"wildcard with exclusion", AcceptEncodingNormalizer("br", "gzip"), []string{"*, br;q=0"}, "gzip"},
+		{"multiple field lines", AcceptEncodingNormalizer("br", "gzip"), []string{"deflate", "GZIP"}, "gzip"},
+		{"absent encoding", AcceptEncodingNormalizer("br", "gzip"), nil, "identity"},
+		{"none acceptable", AcceptEncodingNormalizer("br", "gzip"), []string{"deflate"}, "identity"},
+		{"language", AcceptLanguageNormalizer("en", "ja"), []string{"ja-JP, ja;q=0.9, en;q=0.8"}, "ja"},
+		{"language quality", AcceptLanguageNormalizer("en", "ja"), []string{"ja;q=0.5, en"}, "en"},
+		{"language prefix", AcceptLanguageNormalizer("en", "ja-JP"), []string{"ja"}, "ja-JP"},
+		{"absent language", AcceptLanguageNormalizer("en", "ja"), nil, "en"},
+		{"none acceptable language", AcceptLanguageNormalizer("en", "ja"), []string{"fr"}, "en"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.normalizer(tt.values); got != tt.want {
+				t.Errorf("got %q want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestShared_NormalizeVaryField(t *testing.T) {
+	s, err := NewShared(VaryNormalizers(map[string]VaryNormalizer{"accept-encoding": AcceptEncodingNormalizer("br", "gzip")}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		field  string
+		values []string
+		want   string
+		wantOK bool
+	}{
+		{"absent", "Accept-Language", nil, "", false},
+		{"whitespace", "Accept-Language", []string{" ja ,  en "}, "ja, en", true},
+		{"multiple field lines", "Accept-Language", []string{"ja", "en"}, "ja, en", true},
+		{"normalizer", "Accept-Encoding", []string{"gzip, deflate"}, "gzip", true},
+		{"absent with normalizer", "accept-encoding", nil, "identity", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := s.NormalizeVaryField(tt.field, tt.values)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("got %q, %v want %q, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestShared_HandleVary(t *testing.T) {
+	now := time.Date(2024, 12, 13, 14, 15, 16, 00, time.UTC)
+	endpoint, err := url.Parse("https://example.com/api/v1/path/to/resource")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name            string
+		opts            []SharedOption
+		vary            string
+		reqHeader       http.Header
+		cachedReqHeader http.Header
+		wantCacheUsed   bool
+	}{
+		{
+			"same value",
+			nil,
+			"Accept-Encoding",
+			http.Header{"Accept-Encoding": []string{"gzip, br"}},
+			http.Header{"Accept-Encoding": []string{"gzip, br"}},
+			true,
+		},
+		{
+			"whitespace and multiple field lines",
+			nil,
+			"Accept-Encoding",
+			http.Header{"Accept-Encoding": []string{"gzip", "br"}},
+			http.Header{"Accept-Encoding": []string{"gzip ,br"}},
+			true,
+		},
+		{
+			"not the first value",
+			nil,
+			"Accept-Encoding",
+			http.Header{"Accept-Encoding": []string{"gzip", "br"}},
+			http.Header{"Accept-Encoding": []string{"gzip"}},
+			false,
+		},
+		{
+			"different order",
+			nil,
+			"Accept-Encoding",
+			http.Header{"Accept-Encoding": []string{"br, gzip"}},
+			http.Header{"Accept-Encoding": []string{"gzip, br"}},
+			false,
+		},
+		{
+			"absent and empty",
+			nil,
+			"Accept-Encoding",
+			http.Header{"Accept-Encoding": []string{""}},
+			http.Header{},
+			false,
+		},
+		{
+			"normalizer",
+			[]SharedOption{VaryNormalizers(map[string]VaryNormalizer{"accept-encoding": AcceptEncodingNormalizer("br", "gzip")})},
+			"accept-encoding",
+			http.Header{"Accept-Encoding": []string{"br, gzip, deflate"}},
+			http.Header{"Accept-Encoding": []string{"gzip, deflate, br, zstd"}},
+			true,
+		},
+		{
+			"normalizer with different buckets",
+			[]SharedOption{VaryNormalizers(map[string]VaryNormalizer{"Accept-Encoding": AcceptEncodingNormalizer("br", "gzip")})},
+			"Accept-Encoding",
+			http.Header{"Accept-Encoding": []string{"gzip, deflate"}},
+			http.Header{"Accept-Encoding": []string{"gzip, deflate, br"}},
+			false,
+		},
+		{
+			"wildcard",
+			nil,
+			"*",
+			http.Header{},
+			http.Header{},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewShared(tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := &http.Request{Host: endpoint.Host, URL: endpoint, Method: http.MethodGet, Header: tt.reqHeader}
+			cachedReq := &http.Request{Host: endpoint.Host, URL: endpoint, Method: http.MethodGet, Header: tt.cachedReqHeader}
+			cachedRes := &http.Response{
+				StatusCode: http.StatusOK,
+				Header:     http.Header{"Date": []string{now.Add(-10 * time.Second).Format(http.TimeFormat)}, "Cache-Control": []string{"max-age=60"}, "Vary": []string{tt.vary}},
+				Body:       http.NoBody,
+			}
+			do := func(req *http.Request) (*http.Response, error) {
+				return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}, nil
+			}
+			cacheUsed, _, err := s.Handle(req, cachedReq, cachedRes, do, now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cacheUsed != tt.wantCacheUsed {
+				t.Errorf("got %v want %v", cacheUsed, tt.wantCacheUsed)
+			}
+		})
+	}
+}
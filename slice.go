@@ -0,0 +1,363 @@
+package rc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/2manymws/rc/rfc9111"
+)
+
+// errSliceMismatch is the error for the slice that is not consistent with the other slices of the response (e.g. the ETag is changed).
+var errSliceMismatch = errors.New("slice mismatch")
+
+// errNotSlice is the error for the response to the slice request that is not a slice (e.g. the origin does not support Range requests).
+var errNotSlice = errors.New("not a slice")
+
+// SliceCacher is a Cacher that can store the slices of the response separately (see WithSlice).
+// The slices of a response should be invalidated with the response (see Invalidator).
+// They are invalidated too when a slice is not consistent with the other slices (e.g. the ETag is changed).
+type SliceCacher interface {
+	Cacher
+	// LoadSlice loads the request/response cache of the index-th slice of the response.
+	// The errors are the same as Load.
+	LoadSlice(req *http.Request, index int64) (cachedReq *http.Request, cachedRes *http.Response, err error)
+	// StoreSlice stores the response cache of the index-th slice of the response.
+	// res is the 200 response that has the Content-Range header field of the slice.
+	// The times of the exchange with the origin can be stored with the response (see ExchangeTimes).
+	StoreSlice(req *http.Request, res *http.Response, index int64, expires time.Time) error
+}
+
+type sliceIndexKey struct{}
+
+// withSliceIndex returns a copy of req for the index-th slice.
+// The Range header field of the slice is set, and the If-Range header field is removed.
+func withSliceIndex(req *http.Request, index, size int64) *http.Request {
+	req = req.Clone(context.WithValue(req.Context(), sliceIndexKey{}, index))
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", index*size, (index+1)*size-1))
+	req.Header.Del("If-Range")
+	return req
+}
+
+// sliceIndex returns the index of the slice of the request.
+func sliceIndex(req *http.Request) (int64, bool) {
+	v, ok := req.Context().Value(sliceIndexKey{}).(int64)
+	return v, ok
+}
+
+// isNotSlice returns true if res is the whole response to the slice request (200 without the Content-Range header field).
+// It is not stored, otherwise the whole response would be stored as each slice.
+func isNotSlice(reqc *http.Request, res *http.Response) bool {
+	if _, ok := sliceIndex(reqc); !ok {
+		return false
+	}
+	return res.StatusCode == http.StatusOK && res.Header.Get("Content-Range") == ""
+}
+
+// sliceHandler returns the handler that responds to the slice request with 200 (instead of 206) so that the slice is handled as a whole response.
+// The Content-Range header field is kept to identify the slice.
+func sliceHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.ServeHTTP(&sliceWriter{ResponseWriter: w}, req)
+	})
+}
+
+type sliceWriter struct {
+	http.ResponseWriter
+}
+
+func (w *sliceWriter) WriteHeader(statusCode int) {
+	if statusCode == http.StatusPartialContent {
+		statusCode = http.StatusOK
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *sliceWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// serveSlices serves the response of GET from the slices of the response.
+// Range requests are served from the slices needed for the ranges.
+func (m *cacheMw) serveSlices(w http.ResponseWriter, next http.Handler, req, reqc *http.Request, decisions *decisionRecorder, now time.Time) {
+	rr := newRangeRequest(reqc)
+	index := int64(0)
+	if rr != nil {
+		reqc = reqc.Clone(reqc.Context())
+		rr.strip(reqc)
+		rr.strip(req)
+		index = rr.firstPos() / m.sliceSize
+	}
+	b := &sliceBody{
+		m:    m,
+		h:    sliceHandler(next),
+		req:  req,
+		reqc: reqc,
+		size: m.sliceSize,
+		now:  now,
+	}
+	// The Cache-Status header field is of the first slice.
+	sreq, cs := m.withCacheStatus(req)
+	cacheUsed, hasStored, res, err := b.fetch(sreq, index)
+	if err == nil && rr != nil {
+		var whole *http.Response
+		whole, err = b.response(res, index)
+		if err == nil {
+			// If the response is not a slice, the rest of the origin response body is read so that it is stored.
+			res, err = rr.response(whole)
+		}
+	} else if err == nil {
+		res, err = b.response(res, index)
+	}
+	if err != nil {
+		m.logger.Error("failed to serve slices", slog.String("error", err.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)))
+		m.addCacheStatus(w.Header(), cs, false, hasStored, now)
+		m.setDecisionHeader(w.Header(), decisions)
+		if errors.Is(err, context.DeadlineExceeded) {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	m.writeResponse(w, reqc, res, cacheUsed, func(h http.Header) {
+		m.addCacheStatus(h, cs, cacheUsed, hasStored, now)
+		m.setDecisionHeader(h, decisions)
+	})
+}
+
+// sliceBody is the body of the whole response that reads the slices of the response in order.
+// The slices are loaded or requested when they are read.
+type sliceBody struct {
+	m    *cacheMw
+	h    http.Handler
+	req  *http.Request
+	reqc *http.Request
+	size int64
+	now  time.Time
+	// total is the size of the whole response body.
+	total int64
+	etag  string
+	pos   int64
+	// cur is the body of the slice being read and curPos is the position of it in the whole response body.
+	cur      io.ReadCloser
+	curIndex int64
+	curPos   int64
+}
+
+var _ io.ReadSeekCloser = (*sliceBody)(nil)
+
+// fetch loads the index-th slice or requests it from the origin (like Handler).
+func (b *sliceBody) fetch(req *http.Request, index int64) (bool, bool, *http.Response, error) {
+	m := b.m
+	sreq := withSliceIndex(req, index, b.size)
+	sreqc := withSliceIndex(b.reqc, index, b.size)
+	cachedReq, cachedRes, ok := m.load(sreqc)
+	if !ok {
+		// The slice is not cached.
+		rec := newRecorder(nil)
+		b.h.ServeHTTP(rec, sreq)
+		rec.finish()
+		return false, false, rec.Result(), nil
+	}
+	if cachedReq != nil && cachedReq.Body != nil {
+		_ = cachedReq.Body.Close() //nostyle:handlerrors
+	}
+	requester := m.handlerToRequester(b.h, nil, sreqc, b.now)
+	var (
+		storedHeader http.Header
+		notModified  http.Header
+	)
+	if cachedRes != nil {
+		storedHeader = cachedRes.Header.Clone()
+		requester = notModifiedRecorder(requester, &notModified)
+	}
+	sreq = sreq.WithContext(rfc9111.ContextWithRevalidator(sreq.Context(), m.revalidator))
+	cacheUsed, res, err := m.cacher.Handle(sreq, cachedReq, cachedRes, requester, b.now) //nostyle:handlerrors
+	if err != nil {
+		m.logger.Error("failed to handle cache", slog.String("error", err.Error()), slog.String("host", sreqc.Host), slog.String("method", sreqc.Method), slog.String("url", sreqc.URL.String()), slog.Any("headers", m.maskHeader(sreqc.Header)))
+	}
+	if res == nil {
+		if cachedRes != nil {
+			_ = cachedRes.Body.Close() //nostyle:handlerrors
+		}
+		if err == nil {
+			err = errNoResponse
+		}
+		return false, cachedRes != nil, nil, err
+	}
+	if cacheUsed && notModified != nil {
+		// The stored slice is freshened by the validation.
+		m.freshen(sreqc, cachedRes, storedHeader, notModified, res, b.now)
+	}
+	if cachedRes != nil && res != cachedRes {
+		_ = cachedRes.Body.Close() //nostyle:handlerrors
+	}
+	return cacheUsed, cachedRes != nil, res, nil
+}
+
+// response returns the whole response from the response of the index-th slice.
+// If the response is not a slice (e.g. the origin does not support Range requests), it is returned as it is.
+func (b *sliceBody) response(res *http.Response, index int64) (*http.Response, error) {
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Range") == "" {
+		return res, nil
+	}
+	start, _, total, ok := parseContentRange(res.Header.Get("Content-Range"))
+	if !ok || start != index*b.size {
+		_ = res.Body.Close() //nostyle:handlerrors
+		return nil, errSliceMismatch
+	}
+	b.total = total
+	b.etag = res.Header.Get("ETag")
+	b.cur, b.curIndex, b.curPos = res.Body, index, start
+
+	h := res.Header.Clone()
+	h.Del("Content-Range")
+	h.Set("Content-Length", strconv.FormatInt(total, 10))
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Proto:         res.Proto,
+		ProtoMajor:    res.ProtoMajor,
+		ProtoMinor:    res.ProtoMinor,
+		Header:        h,
+		Body:          b,
+		ContentLength: total,
+		Trailer:       res.Trailer,
+		Request:       res.Request,
+	}, nil
+}
+
+// open opens the index-th slice to read.
+// The slice must be consistent with the first slice (the size of the whole response and the ETag).
+func (b *sliceBody) open(index int64) error {
+	if b.cur != nil {
+		_ = b.cur.Close() //nostyle:handlerrors
+		b.cur = nil
+	}
+	_, _, res, err := b.fetch(b.req, index)
+	if err != nil {
+		return err
+	}
+	start, end, total, ok := parseContentRange(res.Header.Get("Content-Range"))
+	if res.StatusCode != http.StatusOK || !ok || start != index*b.size || end != min(start+b.size, b.total)-1 || total != b.total || res.Header.Get("ETag") != b.etag {
+		_ = res.Body.Close() //nostyle:handlerrors
+		b.m.logger.Error("slice mismatch", slog.String("host", b.reqc.Host), slog.String("method", b.reqc.Method), slog.String("url", b.reqc.URL.String()), slog.Any("headers", b.m.maskHeader(b.reqc.Header)), slog.Int("status", res.StatusCode), slog.Int64("index", index), slog.Any("response_headers", b.m.maskHeader(res.Header)))
+		b.invalidate()
+		return errSliceMismatch
+	}
+	b.cur, b.curIndex, b.curPos = res.Body, index, start
+	return nil
+}
+
+// invalidate invalidates the stored slices of the response because they are not consistent with each other (e.g. the response is changed on the origin).
+// Otherwise, the stale slices would be used until they expire.
+func (b *sliceBody) invalidate() {
+	m := b.m
+	if m.cacher.Invalidate == nil {
+		return
+	}
+	if err := m.cacher.Invalidate(b.reqc); err != nil {
+		m.logger.Error("failed to invalidate cache", slog.String("error", err.Error()), slog.String("host", b.reqc.Host), slog.String("method", b.reqc.Method), slog.String("url", b.reqc.URL.String()), slog.Any("headers", m.maskHeader(b.reqc.Header)))
+		return
+	}
+	m.logger.Debug("cache invalidated", slog.String("host", b.reqc.Host), slog.String("method", b.reqc.Method), slog.String("url", b.reqc.URL.String()), slog.Any("headers", m.maskHeader(b.reqc.Header)))
+}
+
+func (b *sliceBody) Read(p []byte) (int, error) {
+	if b.pos >= b.total {
+		return 0, io.EOF
+	}
+	index := b.pos / b.size
+	if b.cur == nil || b.curIndex != index || b.curPos > b.pos {
+		if err := b.open(index); err != nil {
+			return 0, err
+		}
+	}
+	if b.curPos < b.pos {
+		if _, err := io.CopyN(io.Discard, b.cur, b.pos-b.curPos); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		b.curPos = b.pos
+	}
+	end := min((index+1)*b.size, b.total)
+	if int64(len(p)) > end-b.pos {
+		p = p[:end-b.pos]
+	}
+	n, err := b.cur.Read(p)
+	b.pos += int64(n)
+	b.curPos += int64(n)
+	if b.pos == end {
+		_ = b.cur.Close() //nostyle:handlerrors
+		b.cur = nil
+		return n, nil
+	}
+	if errors.Is(err, io.EOF) {
+		return n, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Seek sets the position to read the whole response body.
+// The slices before the position are not read.
+func (b *sliceBody) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.pos
+	case io.SeekEnd:
+		offset += b.total
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	b.pos = offset
+	return b.pos, nil
+}
+
+func (b *sliceBody) Close() error {
+	if b.cur == nil {
+		return nil
+	}
+	err := b.cur.Close()
+	b.cur = nil
+	return err
+}
+
+// parseContentRange parses the value of the Content-Range header field of the byte range (https://www.rfc-editor.org/rfc/rfc9110#section-14.4).
+// The complete length must be known.
+func parseContentRange(v string) (start, end, total int64, ok bool) {
+	unit, resp, found := strings.Cut(v, " ")
+	if !found || !strings.EqualFold(unit, "bytes") {
+		return 0, 0, 0, false
+	}
+	r, l, found := strings.Cut(resp, "/")
+	if !found {
+		return 0, 0, 0, false
+	}
+	first, last, found := strings.Cut(r, "-")
+	if !found {
+		return 0, 0, 0, false
+	}
+	var err error
+	if start, err = strconv.ParseInt(first, 10, 64); err != nil || start < 0 {
+		return 0, 0, 0, false
+	}
+	if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+		return 0, 0, 0, false
+	}
+	if total, err = strconv.ParseInt(l, 10, 64); err != nil || total <= end {
+		return 0, 0, 0, false
+	}
+	return start, end, total, true
+}
@@ -0,0 +1,470 @@
+package rc
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errPassedThrough is the error to abandon storing the response passed through to the client.
+var errPassedThrough = errors.New("response passed through")
+
+// handlerPanicError is the error returned when reading the streamed response body if the handler panicked after the header was written.
+type handlerPanicError struct {
+	v any
+}
+
+func (e *handlerPanicError) Error() string {
+	return fmt.Sprintf("handler panicked: %v", e.v)
+}
+
+// streamRecorder is a http.ResponseWriter that streams the response body written by the handler through a pipe.
+// The header is committed when the handler writes the body, flushes or returns (like net/http).
+// When the handler flushes or hijacks, the response is never cached.
+type streamRecorder struct {
+	// cw is nil when the origin is requested in the background.
+	cw          *clientWriter
+	statusCode  int
+	header      http.Header
+	wroteHeader bool
+	// committed is the snapshot of the header when the status code is written.
+	committed http.Header
+	// ready is closed when the header is committed or the handler panicked before committing the header.
+	ready    chan struct{}
+	isReady  bool
+	panicked any
+	// trailer is filled when the handler returns (before the body reaches EOF).
+	trailer  http.Header
+	flushed  atomic.Bool
+	hijacked bool
+	pr       *io.PipeReader
+	pw       *io.PipeWriter
+}
+
+var (
+	_ http.ResponseWriter = (*streamRecorder)(nil)
+	_ http.Flusher        = (*streamRecorder)(nil)
+	_ http.Hijacker       = (*streamRecorder)(nil)
+	_ io.ReaderFrom       = (*streamRecorder)(nil)
+)
+
+func newStreamRecorder(cw *clientWriter) *streamRecorder {
+	pr, pw := io.Pipe()
+	return &streamRecorder{
+		cw:      cw,
+		header:  make(http.Header),
+		ready:   make(chan struct{}),
+		trailer: make(http.Header),
+		pr:      pr,
+		pw:      pw,
+	}
+}
+
+func (r *streamRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *streamRecorder) Write(b []byte) (int, error) {
+	if r.hijacked {
+		return 0, http.ErrHijacked
+	}
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	if !r.isReady {
+		sniffContentType(r.committed, r.statusCode, b)
+		r.commit()
+	}
+	return r.pw.Write(b)
+}
+
+func (r *streamRecorder) WriteHeader(statusCode int) {
+	if r.wroteHeader || r.hijacked {
+		return
+	}
+	if isInformational(statusCode) {
+		writeInformational(r.cw, r.header, statusCode)
+		return
+	}
+	r.statusCode = statusCode
+	r.wroteHeader = true
+	r.committed = r.header.Clone()
+}
+
+func (r *streamRecorder) ReadFrom(src io.Reader) (int64, error) {
+	// Write is used to sniff Content-Type.
+	return io.Copy(writerOnly{r}, src)
+}
+
+func (r *streamRecorder) Flush() {
+	_ = r.FlushError() //nostyle:handlerrors
+}
+
+// FlushError commits the header and marks the response as never cached.
+// The streamed response body is flushed to the client by the middleware.
+func (r *streamRecorder) FlushError() error {
+	if r.hijacked {
+		return http.ErrHijacked
+	}
+	if !r.wroteHeader {
+		r.WriteHeader(http.StatusOK)
+	}
+	r.flushed.Store(true)
+	if !r.isReady {
+		r.commit()
+	}
+	return nil
+}
+
+func (r *streamRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if r.cw == nil {
+		return nil, nil, http.ErrNotSupported
+	}
+	if r.isReady {
+		return nil, nil, errors.New("hijack after the response header is committed")
+	}
+	conn, brw, err := http.NewResponseController(r.cw.ResponseWriter).Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	r.hijacked = true
+	r.cw.written = true
+	r.commit()
+	return conn, brw, nil
+}
+
+// Unwrap returns the response writer of the client for http.ResponseController.
+func (r *streamRecorder) Unwrap() http.ResponseWriter {
+	if r.cw == nil {
+		return nil
+	}
+	return r.cw.ResponseWriter
+}
+
+func (r *streamRecorder) commit() {
+	r.isReady = true
+	close(r.ready)
+}
+
+// serve serves the handler and closes the pipe when the handler returns.
+func (r *streamRecorder) serve(h http.Handler, req *http.Request) {
+	defer func() {
+		if v := recover(); v != nil {
+			if !r.isReady {
+				// Re-panic in the goroutine of the middleware.
+				r.panicked = v
+				r.commit()
+			}
+			_ = r.pw.CloseWithError(&handlerPanicError{v: v}) //nostyle:handlerrors
+			return
+		}
+		if !r.hijacked {
+			if !r.wroteHeader {
+				r.WriteHeader(http.StatusOK)
+			}
+			if !r.isReady {
+				r.commit()
+			}
+			for k, v := range trailers(r.header, r.committed) {
+				r.trailer[k] = v
+			}
+		}
+		_ = r.pw.Close() //nostyle:handlerrors
+	}()
+	h.ServeHTTP(r, req)
+}
+
+// cacheable reports whether the response can be cached (not flushed or hijacked).
+func (r *streamRecorder) cacheable() bool {
+	return !r.flushed.Load() && !r.hijacked
+}
+
+// Result waits for the header to be committed and returns the response whose body is streamed.
+// The trailer of the response is filled when the body reaches EOF.
+func (r *streamRecorder) Result() *http.Response {
+	<-r.ready
+	if r.panicked != nil {
+		panic(r.panicked) //nostyle:dontpanic
+	}
+	if r.hijacked {
+		return &http.Response{
+			Header: http.Header{},
+			Body:   http.NoBody,
+		}
+	}
+	cl := int64(-1)
+	if v := r.committed.Get("Content-Length"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			cl = n
+		}
+	}
+	return &http.Response{
+		Status:        http.StatusText(r.statusCode),
+		StatusCode:    r.statusCode,
+		Header:        headerWithoutTrailers(r.committed),
+		Body:          r.pr,
+		ContentLength: cl,
+		Trailer:       r.trailer,
+	}
+}
+
+// writerOnly hides the io.ReaderFrom of the writer.
+type writerOnly struct {
+	io.Writer
+}
+
+// flushWriter is a writer that flushes the response writer after each write.
+type flushWriter struct {
+	w  io.Writer
+	rc *http.ResponseController
+}
+
+func (f *flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if err != nil {
+		return n, err
+	}
+	if err := f.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return n, err
+	}
+	return n, nil
+}
+
+// storeSink is the destination of the response body to be stored.
+type storeSink interface {
+	io.WriteCloser
+	// CloseWithError abandons storing.
+	CloseWithError(err error) error
+}
+
+var (
+	_ storeSink = (*io.PipeWriter)(nil)
+	_ storeSink = (*bufferSink)(nil)
+)
+
+// bufferSink buffers the response body and stores it when the body is read to the end.
+type bufferSink struct {
+	buf   bytes.Buffer
+	store func(b []byte)
+}
+
+func (s *bufferSink) Write(b []byte) (int, error) {
+	return s.buf.Write(b)
+}
+
+func (s *bufferSink) Close() error {
+	s.store(s.buf.Bytes())
+	return nil
+}
+
+func (s *bufferSink) CloseWithError(err error) error {
+	s.buf.Reset()
+	return nil
+}
+
+// teeBody is the response body that writes to the store sink what is read from the origin.
+type teeBody struct {
+	body    io.ReadCloser
+	sink    storeSink
+	n       int64
+	maxSize int64
+	// cacheable reports whether the response can still be cached (e.g. the handler has not flushed).
+	cacheable func() bool
+}
+
+// uncacheableBody is a response body whose cacheability can change while it is read.
+type uncacheableBody interface {
+	uncacheable() bool
+}
+
+var _ uncacheableBody = (*teeBody)(nil)
+
+func (t *teeBody) uncacheable() bool {
+	return !t.cacheable()
+}
+
+// storingBody is a response body that stores the response as cache while it is read.
+// The storing is completed only when the body is read to the end.
+type storingBody interface {
+	storing() bool
+}
+
+var (
+	_ storingBody = (*teeBody)(nil)
+	_ storingBody = (*captureBody)(nil)
+)
+
+func (t *teeBody) storing() bool {
+	return t.sink != nil
+}
+
+// isStoring reports whether body is being stored as cache while it is read.
+func isStoring(body io.Reader) bool {
+	sb, ok := body.(storingBody)
+	return ok && sb.storing()
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.body.Read(p)
+	if t.sink != nil && !t.cacheable() {
+		// Abandon storing the response passed through.
+		_ = t.sink.CloseWithError(errPassedThrough) //nostyle:handlerrors
+		t.sink = nil
+	}
+	if n > 0 && t.sink != nil {
+		t.n += int64(n)
+		if t.maxSize > 0 && t.n > t.maxSize {
+			// Abandon storing mid-stream.
+			_ = t.sink.CloseWithError(ErrObjectTooLarge) //nostyle:handlerrors
+			t.sink = nil
+		} else if _, werr := t.sink.Write(p[:n]); werr != nil {
+			// The sink stopped reading.
+			t.sink = nil
+		}
+	}
+	if err != nil && t.sink != nil {
+		if err == io.EOF { //nolint:errorlint
+			_ = t.sink.Close() //nostyle:handlerrors
+		} else {
+			_ = t.sink.CloseWithError(err) //nostyle:handlerrors
+		}
+		t.sink = nil
+	}
+	return n, err
+}
+
+func (t *teeBody) Close() error {
+	if t.sink != nil {
+		// The body was not read to the end (e.g. the client disconnected).
+		_ = t.sink.CloseWithError(io.ErrUnexpectedEOF) //nostyle:handlerrors
+		t.sink = nil
+	}
+	return t.body.Close()
+}
+
+// requestOriginStream requests the origin (next handler) and returns the response as soon as the header is written.
+// The response body is streamed and stored as cache at the same time if it is storable.
+func (m *cacheMw) requestOriginStream(h http.Handler, cw *clientWriter, req, reqc *http.Request, now time.Time) (*http.Response, bool) {
+	rec := newStreamRecorder(cw)
+	go rec.serve(h, req)
+	res := rec.Result()
+	responseTime := time.Now()
+	if !rec.cacheable() {
+		return res, false
+	}
+	resc := &http.Response{
+		Status:        res.Status,
+		StatusCode:    res.StatusCode,
+		Header:        res.Header.Clone(),
+		Body:          http.NoBody,
+		ContentLength: res.ContentLength,
+		Trailer:       res.Trailer,
+	}
+
+	ok, expires := m.cacher.Storable(reqc, resc, now)
+	if !ok {
+		m.logger.Debug("cache not storable", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode), slog.Any("response_headers", m.maskHeader(resc.Header)))
+		return res, false
+	}
+	if isNotSlice(reqc, resc) {
+		m.logger.Debug("cache not storable", slog.String("error", errNotSlice.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode))
+		return res, false
+	}
+	if m.maxObjectSize > 0 && res.ContentLength > m.maxObjectSize {
+		m.logger.Debug("cache not storable", slog.String("error", ErrObjectTooLarge.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode), slog.Int64("content_length", res.ContentLength))
+		return res, false
+	}
+
+	resc.Header = m.cacher.StoredHeader(resc)
+	res.Body = &teeBody{
+		body:      res.Body,
+		sink:      m.storeSink(withExchangeTimes(reqc, now, responseTime), resc, expires),
+		maxSize:   m.maxObjectSize,
+		cacheable: rec.cacheable,
+	}
+	recordStored(req, expires)
+	return res, true
+}
+
+// storeSink returns the sink to store the response body as cache.
+func (m *cacheMw) storeSink(reqc *http.Request, resc *http.Response, expires time.Time) storeSink {
+	_, isVariant := m.storesVariant(reqc, resc)
+	if _, ok := sliceIndex(reqc); ok || isVariant || m.cacher.StoreStream == nil {
+		// The slices and the variants are stored by the SliceCacher and the VariantCacher.
+		return &bufferSink{
+			store: func(b []byte) {
+				resc.Body = io.NopCloser(bytes.NewReader(b))
+				resc.ContentLength = int64(len(b))
+				go m.store(reqc, resc, expires)
+			},
+		}
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		defer pr.Close()
+		if err := m.cacher.StoreStream(reqc, resc, pr, expires); err != nil {
+			m.logger.Debug("cache not stored", slog.String("error", err.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", resc.StatusCode))
+			return
+		}
+		m.logger.Debug("cache stored", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", resc.StatusCode))
+	}()
+	return pw
+}
+
+// captureBody is the response body that captures what is read for the waiters of the coalesced request.
+type captureBody struct {
+	body    io.ReadCloser
+	buf     bytes.Buffer
+	maxSize int64
+	// done is called once when the body is read to the end (ok) or closed.
+	done     func(b []byte, ok bool)
+	finished bool
+	once     sync.Once
+}
+
+func (c *captureBody) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+	if n > 0 && !c.finished {
+		_, _ = c.buf.Write(p[:n]) //nostyle:handlerrors
+		if c.maxSize > 0 && int64(c.buf.Len()) > c.maxSize {
+			c.finish(false)
+		}
+	}
+	if err == io.EOF { //nolint:errorlint
+		ub, ok := c.body.(uncacheableBody)
+		c.finish(!ok || !ub.uncacheable())
+	} else if err != nil {
+		c.finish(false)
+	}
+	return n, err
+}
+
+func (c *captureBody) storing() bool {
+	return isStoring(c.body)
+}
+
+func (c *captureBody) Close() error {
+	c.finish(false)
+	return c.body.Close()
+}
+
+func (c *captureBody) finish(ok bool) {
+	c.once.Do(func() {
+		c.finished = true
+		if !ok {
+			c.buf = bytes.Buffer{}
+			c.done(nil, false)
+			return
+		}
+		c.done(c.buf.Bytes(), true)
+	})
+}
@@ -1,8 +1,11 @@
 package testutil
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha1" // #nosec G505
 	"encoding/hex"
+	"fmt"
 	"io"
 	"net/http"
 	"strings"
@@ -22,6 +25,7 @@ type Cacher interface {
 	Load(req *http.Request) (cachedReq *http.Request, cachedRes *http.Response, err error)
 	Store(req *http.Request, res *http.Response, expires time.Time) error
 	Hit() int
+	WaitStored(t testing.TB, n int)
 }
 
 type AllCache struct {
@@ -30,6 +34,7 @@ type AllCache struct {
 	dir string
 	hit int
 	mu  sync.Mutex
+	storeWaiter
 }
 
 type GetOnlyCache struct {
@@ -38,6 +43,49 @@ type GetOnlyCache struct {
 	dir string
 	hit int
 	mu  sync.Mutex
+	storeWaiter
+}
+
+// storeWaiter counts the stored responses so that the tests can wait for the responses stored in the background.
+type storeWaiter struct {
+	stored int
+	notify chan struct{}
+	mu     sync.Mutex
+}
+
+// done records that a response is stored.
+func (w *storeWaiter) done() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.stored++
+	if w.notify != nil {
+		close(w.notify)
+		w.notify = nil
+	}
+}
+
+// WaitStored waits until n responses (including slices and variants) are stored in total.
+func (w *storeWaiter) WaitStored(t testing.TB, n int) {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		w.mu.Lock()
+		stored := w.stored
+		if stored >= n {
+			w.mu.Unlock()
+			return
+		}
+		if w.notify == nil {
+			w.notify = make(chan struct{})
+		}
+		notify := w.notify
+		w.mu.Unlock()
+		select {
+		case <-notify:
+		case <-timeout:
+			t.Fatalf("timed out waiting for %d stored responses (%d stored)", n, stored)
+		}
+	}
 }
 
 func NewAllCache(t testing.TB) *AllCache {
@@ -77,6 +125,7 @@ func (c *AllCache) Store(req *http.Request, res *http.Response, expires time.Tim
 	c.mu.Lock()
 	c.m[key] = cc
 	c.mu.Unlock()
+	c.done()
 	return nil
 }
 
@@ -124,6 +173,7 @@ func (c *GetOnlyCache) Store(req *http.Request, res *http.Response, expires time
 	c.mu.Lock()
 	c.m[key] = cc
 	c.mu.Unlock()
+	c.done()
 	return nil
 }
 
@@ -132,10 +182,369 @@ func (c *GetOnlyCache) Hit() int {
 	return c.hit
 }
 
+func (c *AllCache) invalidate(req *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range invalidationKeys(req) {
+		delete(c.m, k)
+	}
+}
+
+func (c *GetOnlyCache) invalidate(req *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range invalidationKeys(req) {
+		delete(c.m, k)
+	}
+}
+
+// invalidationKeys returns the keys of the stored responses for the URI of req.
+func invalidationKeys(req *http.Request) []string {
+	var keys []string
+	for _, method := range []string{http.MethodGet, http.MethodHead} {
+		r := req.Clone(req.Context())
+		r.Method = method
+		keys = append(keys, reqToKey(r))
+	}
+	return keys
+}
+
 func reqToKey(req *http.Request) string {
 	const sep = "|"
-	seed := req.Method + sep + req.Host + sep + req.URL.Path + sep + req.URL.RawQuery
+	seed, ok := rc.CacheKey(req)
+	if !ok {
+		seed = req.Method + sep + req.Host + sep + req.URL.Path + sep + req.URL.RawQuery
+	}
 	sha1 := sha1.New() // #nosec G401
 	_, _ = io.WriteString(sha1, strings.ToLower(seed)) //nostyle:handlerrors
 	return hex.EncodeToString(sha1.Sum(nil))
 }
+
+type StreamingCache struct {
+	*AllCache
+	stored int
+}
+
+var _ rc.StreamingCacher = &StreamingCache{}
+
+func NewStreamingCache(t testing.TB) *StreamingCache {
+	t.Helper()
+	return &StreamingCache{
+		AllCache: NewAllCache(t),
+	}
+}
+
+func (c *StreamingCache) StoreStream(req *http.Request, res *http.Response, body io.Reader, expires time.Time) error {
+	c.t.Helper()
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	res.Body = io.NopCloser(bytes.NewReader(b))
+	res.ContentLength = int64(len(b))
+	c.mu.Lock()
+	c.stored++
+	c.mu.Unlock()
+	return c.AllCache.Store(req, res, expires)
+}
+
+func (c *StreamingCache) Stored() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stored
+}
+
+type SliceCache struct {
+	*AllCache
+	slices map[string]*cachedReqRes
+	stored []int64
+}
+
+var _ rc.SliceCacher = &SliceCache{}
+
+func NewSliceCache(t testing.TB) *SliceCache {
+	t.Helper()
+	return &SliceCache{
+		AllCache: NewAllCache(t),
+		slices:   map[string]*cachedReqRes{},
+	}
+}
+
+func (c *SliceCache) LoadSlice(req *http.Request, index int64) (*http.Request, *http.Response, error) {
+	c.t.Helper()
+	key := fmt.Sprintf("%s|%d", reqToKey(req), index)
+	c.mu.Lock()
+	cc, ok := c.slices[key]
+	c.mu.Unlock()
+	if !ok {
+		return nil, nil, rc.ErrCacheNotFound
+	}
+	cachedReq, cachedRes, err := decodeReqRes(c.t, cc)
+	if err != nil {
+		return nil, nil, err
+	}
+	cachedRes.Header.Set("X-Cache", "HIT")
+	c.mu.Lock()
+	c.hit++
+	c.mu.Unlock()
+	return cachedReq, cachedRes, nil
+}
+
+func (c *SliceCache) StoreSlice(req *http.Request, res *http.Response, index int64, expires time.Time) error {
+	c.t.Helper()
+	key := fmt.Sprintf("%s|%d", reqToKey(req), index)
+	cc, err := encodeReqRes(req, res)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.slices[key] = cc
+	c.stored = append(c.stored, index)
+	c.mu.Unlock()
+	c.done()
+	return nil
+}
+
+// Stored returns the indexes of the stored slices in the order of storing.
+func (c *SliceCache) Stored() []int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]int64(nil), c.stored...)
+}
+
+func (c *SliceCache) Hit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hit
+}
+
+func (c *SliceCache) invalidate(req *http.Request) {
+	c.AllCache.invalidate(req)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range invalidationKeys(req) {
+		for sk := range c.slices {
+			if strings.HasPrefix(sk, k+"|") {
+				delete(c.slices, sk)
+			}
+		}
+	}
+}
+
+type VariantCache struct {
+	*AllCache
+	variants map[string][]*variant
+}
+
+type variant struct {
+	key string
+	cc  *cachedReqRes
+}
+
+var _ rc.VariantCacher = &VariantCache{}
+
+func NewVariantCache(t testing.TB) *VariantCache {
+	t.Helper()
+	return &VariantCache{
+		AllCache: NewAllCache(t),
+		variants: map[string][]*variant{},
+	}
+}
+
+func (c *VariantCache) Variants(req *http.Request) ([]string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var keys []string
+	for _, v := range c.variants[reqToKey(req)] {
+		keys = append(keys, v.key)
+	}
+	return keys, nil
+}
+
+func (c *VariantCache) LoadVariant(req *http.Request, key string) (*http.Request, *http.Response, error) {
+	c.t.Helper()
+	c.mu.Lock()
+	var cc *cachedReqRes
+	for _, v := range c.variants[reqToKey(req)] {
+		if v.key == key {
+			cc = v.cc
+		}
+	}
+	c.mu.Unlock()
+	if cc == nil {
+		return nil, nil, rc.ErrCacheNotFound
+	}
+	cachedReq, cachedRes, err := decodeReqRes(c.t, cc)
+	if err != nil {
+		return nil, nil, err
+	}
+	cachedRes.Header.Set("X-Cache", "HIT")
+	c.mu.Lock()
+	c.hit++
+	c.mu.Unlock()
+	return cachedReq, cachedRes, nil
+}
+
+func (c *VariantCache) StoreVariant(req *http.Request, res *http.Response, key string, expires time.Time) error {
+	c.t.Helper()
+	cc, err := encodeReqRes(req, res)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	k := reqToKey(req)
+	c.variants[k] = append(deleteVariant(c.variants[k], key), &variant{key: key, cc: cc})
+	c.mu.Unlock()
+	c.done()
+	return nil
+}
+
+func (c *VariantCache) DeleteVariant(req *http.Request, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := reqToKey(req)
+	c.variants[k] = deleteVariant(c.variants[k], key)
+	return nil
+}
+
+func (c *VariantCache) Hit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hit
+}
+
+func (c *VariantCache) invalidate(req *http.Request) {
+	c.AllCache.invalidate(req)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, k := range invalidationKeys(req) {
+		delete(c.variants, k)
+	}
+}
+
+func deleteVariant(variants []*variant, key string) []*variant {
+	var vs []*variant
+	for _, v := range variants {
+		if v.key != key {
+			vs = append(vs, v)
+		}
+	}
+	return vs
+}
+
+type V2Cache struct {
+	t   testing.TB
+	m   map[string]*v2Entry
+	hit int
+	mu  sync.Mutex
+	storeWaiter
+}
+
+type v2Entry struct {
+	cc    *cachedReqRes
+	entry rc.Entry
+}
+
+var _ rc.CacherV2 = &V2Cache{}
+
+func NewV2Cache(t testing.TB) *V2Cache {
+	t.Helper()
+	return &V2Cache{
+		t: t,
+		m: map[string]*v2Entry{},
+	}
+}
+
+func (c *V2Cache) Load(ctx context.Context, key string, req *http.Request) (*rc.Entry, error) {
+	c.t.Helper()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	v, ok := c.m[key]
+	c.mu.Unlock()
+	if !ok {
+		return nil, rc.ErrCacheNotFound
+	}
+	cachedReq, cachedRes, err := decodeReqRes(c.t, v.cc)
+	if err != nil {
+		return nil, err
+	}
+	cachedRes.Header.Set("X-Cache", "HIT")
+	c.mu.Lock()
+	c.hit++
+	c.mu.Unlock()
+	e := v.entry
+	e.Request, e.Response = cachedReq, cachedRes
+	return &e, nil
+}
+
+func (c *V2Cache) Store(ctx context.Context, key string, e *rc.Entry) error {
+	c.t.Helper()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cc, err := encodeReqRes(e.Request, e.Response)
+	if err != nil {
+		return err
+	}
+	entry := *e
+	entry.Request, entry.Response = nil, nil
+	c.mu.Lock()
+	c.m[key] = &v2Entry{cc: cc, entry: entry}
+	c.mu.Unlock()
+	c.done()
+	return nil
+}
+
+// Entries returns the metadata of the stored entries (without the request and the response).
+func (c *V2Cache) Entries() []rc.Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var entries []rc.Entry
+	for _, v := range c.m {
+		entries = append(entries, v.entry)
+	}
+	return entries
+}
+
+func (c *V2Cache) Hit() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hit
+}
+
+type InvalidatableCache struct {
+	Cacher
+	invalidated []string
+	mu          sync.Mutex
+}
+
+var _ rc.Invalidator = &InvalidatableCache{}
+
+// NewInvalidatableCache returns the cache that invalidates the stored responses of c (AllCache or GetOnlyCache).
+func NewInvalidatableCache(t testing.TB, c Cacher) *InvalidatableCache {
+	t.Helper()
+	return &InvalidatableCache{
+		Cacher: c,
+	}
+}
+
+func (c *InvalidatableCache) Invalidate(req *http.Request) error {
+	v, ok := c.Cacher.(interface{ invalidate(req *http.Request) })
+	if !ok {
+		return fmt.Errorf("unsupported cacher: %T", c.Cacher)
+	}
+	v.invalidate(req)
+	c.mu.Lock()
+	c.invalidated = append(c.invalidated, req.URL.Path)
+	c.mu.Unlock()
+	return nil
+}
+
+// Invalidated returns the paths of the invalidated URIs.
+func (c *InvalidatableCache) Invalidated() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string(nil), c.invalidated...)
+}
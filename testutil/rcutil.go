@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"io"
 	"net/http"
+	"sync/atomic"
 	"testing"
 )
 
@@ -52,8 +53,9 @@ func decodeReqRes(t testing.TB, c *cachedReqRes) (*http.Request, *http.Response,
 }
 
 type closeChecker struct {
-	rc     io.ReadCloser
-	closed bool
+	rc io.ReadCloser
+	// closed is atomic because the body can be closed by the handler after the response is received.
+	closed atomic.Bool
 }
 
 func newCloseChecker(t testing.TB, rc io.ReadCloser) *closeChecker {
@@ -61,7 +63,7 @@ func newCloseChecker(t testing.TB, rc io.ReadCloser) *closeChecker {
 		rc: rc,
 	}
 	t.Cleanup(func() {
-		if !r.closed {
+		if !r.closed.Load() {
 			t.Errorf("closeChecker: not closed")
 		}
 	})
@@ -73,6 +75,6 @@ func (r *closeChecker) Read(p []byte) (n int, err error) {
 }
 
 func (r *closeChecker) Close() error {
-	r.closed = true
+	r.closed.Store(true)
 	return r.rc.Close()
 }
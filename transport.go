@@ -0,0 +1,222 @@
+package rc
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/2manymws/rc/rfc9111"
+)
+
+var errNoResponse = errors.New("no response")
+
+// transport is a http.RoundTripper that caches the responses of the base http.RoundTripper (client-side caching).
+type transport struct {
+	m    *cacheMw
+	base http.RoundTripper
+}
+
+var _ http.RoundTripper = (*transport)(nil)
+
+// NewTransport returns a new http.RoundTripper that caches the responses of base using the Cacher.
+// The Handler of the Cacher (rfc9111.Private by default because it is a client-side cache) is used with base as the origin requester.
+// If base is nil, http.DefaultTransport is used.
+// The response body is stored while it is read by the caller, so the response is stored only when the body is read to the end.
+func NewTransport(cacher Cacher, base http.RoundTripper, opts ...Option) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	p, err := rfc9111.NewPrivate()
+	if err != nil {
+		panic(err) //nostyle:dontpanic
+	}
+	m := newCacheMw(cacher, p, opts...)
+	if m.coalescer != nil {
+		// The response body is always streamed to the caller.
+		m.coalescer.capture = true
+		m.coalescer.maxBodySize = m.maxObjectSize
+	}
+	return &transport{
+		m:    m,
+		base: base,
+	}
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m := t.m
+	// rc does not support websocket.
+	if strings.ToLower(req.Header.Get("Connection")) == "upgrade" && strings.ToLower(req.Header.Get("Upgrade")) == "websocket" {
+		return t.base.RoundTrip(req)
+	}
+	now := time.Now()
+	// sent reports whether the request is sent to the origin (base), which closes the request body.
+	var sent atomic.Bool
+	defer func() {
+		// A RoundTripper must always close the body (https://pkg.go.dev/net/http#RoundTripper).
+		if !sent.Load() && req.Body != nil {
+			_ = req.Body.Close() //nostyle:handlerrors
+		}
+	}()
+
+	// A RoundTripper should not modify the request.
+	// oreq is the request to be sent to the origin, and reqc is the request to be used for caching.
+	oreq, reqc := m.duplicateRequest(req.Clone(req.Context()))
+	oreq, reqc, decisions := m.withDecisionHook(oreq, reqc)
+	oreq, reqc = m.withCacheKey(oreq, reqc)
+	var rr *rangeRequest
+	if m.rangeRequests {
+		if rr = newRangeRequest(reqc); rr != nil {
+			// The full response is loaded so that the Range request is served from it.
+			rr.strip(reqc)
+		}
+	}
+
+	cachedReq, cachedRes, ok := m.load(reqc)
+	if !ok {
+		// Skip caching
+		sent.Store(true)
+		res, err := t.base.RoundTrip(oreq)
+		if err != nil {
+			return nil, err
+		}
+		if m.cacher.Invalidate != nil && !isSafeMethod(reqc.Method) {
+			m.invalidate(reqc, res.StatusCode, res.Header)
+		}
+		m.addCacheStatus(res.Header, &rfc9111.CacheStatus{Forward: rfc9111.ForwardBypass}, false, false, now)
+		return res, nil
+	}
+	if cachedReq != nil && cachedReq.Body != nil {
+		_ = cachedReq.Body.Close() //nostyle:handlerrors
+	}
+	if rr != nil {
+		// The full response is requested from the origin so that it is stored.
+		rr.strip(oreq)
+	}
+
+	requester := t.requester(reqc, now, &sent)
+	if m.coalescer != nil && cachedRes == nil && (reqc.Method == http.MethodGet || reqc.Method == http.MethodHead) {
+		requester = t.coalescedRequester(reqc, now, &sent)
+	}
+	var (
+		storedHeader http.Header
+		notModified  http.Header
+	)
+	if cachedRes != nil {
+		storedHeader = cachedRes.Header.Clone()
+		requester = notModifiedRecorder(requester, &notModified)
+	}
+	// Stale responses are revalidated in the background by the revalidator.
+	oreq = oreq.WithContext(rfc9111.ContextWithRevalidator(oreq.Context(), m.revalidator))
+	oreq, cs := m.withCacheStatus(oreq)
+	cacheUsed, res, err := m.cacher.Handle(oreq, cachedReq, cachedRes, requester, now) //nostyle:handlerrors
+	if res == nil {
+		if cachedRes != nil {
+			_ = cachedRes.Body.Close() //nostyle:handlerrors
+		}
+		if err == nil {
+			err = errNoResponse
+		}
+		return nil, err
+	}
+	if err != nil {
+		m.logger.Error("failed to handle cache", slog.String("error", err.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)))
+	}
+	if m.cacher.Invalidate != nil && !isSafeMethod(reqc.Method) {
+		m.invalidate(reqc, res.StatusCode, res.Header)
+	}
+	if cacheUsed && notModified != nil {
+		// The stored response is freshened by the validation.
+		m.freshen(storedForHead(reqc, cachedReq), cachedRes, storedHeader, notModified, res, now)
+	}
+	if !cacheUsed && usesStoredGet(reqc, cachedReq) && res.StatusCode == http.StatusOK && varyMatched(m.cacher.NormalizeVaryField, storedHeader, reqc, cachedReq) {
+		// The stored response to GET is freshened or invalidated by the response to HEAD.
+		m.freshenWithHead(storedForHead(reqc, cachedReq), cachedRes, storedHeader, res, now)
+	}
+	if cachedRes != nil && res != cachedRes {
+		_ = cachedRes.Body.Close() //nostyle:handlerrors
+	}
+	if rr != nil {
+		// The rest of the origin response body is read on close so that it is stored.
+		res, err = rr.response(res)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if res.Proto == "" {
+		res.Proto, res.ProtoMajor, res.ProtoMinor = "HTTP/1.1", 1, 1
+	}
+	if res.Status == "" {
+		res.Status = fmt.Sprintf("%d %s", res.StatusCode, http.StatusText(res.StatusCode))
+	}
+	res.Request = req
+	m.addCacheStatus(res.Header, cs, cacheUsed, cachedRes != nil, now)
+	m.setDecisionHeader(res.Header, decisions)
+	if cacheUsed {
+		m.logger.Debug("cache used", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode))
+	}
+	return res, nil
+}
+
+func (t *transport) requester(reqc *http.Request, now time.Time, sent *atomic.Bool) func(*http.Request) (*http.Response, error) {
+	return func(req *http.Request) (*http.Response, error) {
+		sent.Store(true)
+		res, _, err := t.roundTripOrigin(req, reqc, now)
+		return res, err
+	}
+}
+
+// coalescedRequester returns the origin requester that collapses concurrent requests for the same resource into one.
+func (t *transport) coalescedRequester(reqc *http.Request, now time.Time, sent *atomic.Bool) func(*http.Request) (*http.Response, error) {
+	key := requestKey(reqc)
+	return func(req *http.Request) (*http.Response, error) {
+		called := false
+		res, err := t.m.coalescer.do(reqc, key, func() (*http.Response, bool, error) {
+			called = true
+			sent.Store(true)
+			return t.roundTripOrigin(req, reqc, now)
+		})
+		if err == nil && !called {
+			recordCollapsed(req)
+		}
+		return res, err
+	}
+}
+
+// roundTripOrigin sends the request to the origin (base) and stores the response as cache while its body is read if it is storable.
+func (t *transport) roundTripOrigin(req, reqc *http.Request, now time.Time) (*http.Response, bool, error) {
+	m := t.m
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, false, err
+	}
+	responseTime := time.Now()
+	resc := &http.Response{
+		Status:        res.Status,
+		StatusCode:    res.StatusCode,
+		Header:        res.Header.Clone(),
+		Body:          http.NoBody,
+		ContentLength: res.ContentLength,
+	}
+	ok, expires := m.cacher.Storable(reqc, resc, now)
+	if !ok {
+		m.logger.Debug("cache not storable", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode), slog.Any("response_headers", m.maskHeader(resc.Header)))
+		return res, false, nil
+	}
+	if m.maxObjectSize > 0 && res.ContentLength > m.maxObjectSize {
+		m.logger.Debug("cache not storable", slog.String("error", ErrObjectTooLarge.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.Int("status", res.StatusCode), slog.Int64("content_length", res.ContentLength))
+		return res, false, nil
+	}
+	resc.Header = m.cacher.StoredHeader(resc)
+	res.Body = &teeBody{
+		body:      res.Body,
+		sink:      m.storeSink(withExchangeTimes(reqc, now, responseTime), resc, expires),
+		maxSize:   m.maxObjectSize,
+		cacheable: func() bool { return true },
+	}
+	recordStored(req, expires)
+	return res, true, nil
+}
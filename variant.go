@@ -0,0 +1,183 @@
+package rc
+
+import (
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultMaxVariants is the default maximum number of the variants stored for a resource.
+const defaultMaxVariants = 16
+
+// VariantCacher is a Cacher that can store the responses selected by the Vary header field separately (https://www.rfc-editor.org/rfc/rfc9111#section-4.1).
+// The response whose Vary header field nominates the request header fields is stored as a variant of the resource of the request (e.g. the method and the target URI), and the variant matching the request is loaded.
+// The variants of a resource should be invalidated with the response (see Invalidator).
+type VariantCacher interface {
+	Cacher
+	// Variants returns the keys of the variants stored for the resource of req in the order of storing (the oldest first).
+	Variants(req *http.Request) ([]string, error)
+	// LoadVariant loads the request/response cache of the variant of the resource of req.
+	// The errors are the same as Load.
+	LoadVariant(req *http.Request, variant string) (cachedReq *http.Request, cachedRes *http.Response, err error)
+	// StoreVariant stores the response cache as the variant of the resource of req.
+	// If the variant is already stored, it is replaced and becomes the newest.
+	// The times of the exchange with the origin can be stored with the response (see ExchangeTimes).
+	StoreVariant(req *http.Request, res *http.Response, variant string, expires time.Time) error
+	// DeleteVariant deletes the variant of the resource of req.
+	DeleteVariant(req *http.Request, variant string) error
+}
+
+// variantKey returns the key of the variant of the response for req.
+// The key lists the request header fields nominated by the Vary header field of the response with the values of req normalized by normalize (see VaryNormalizingHandler).
+// e.g. "Accept-Encoding: gzip\nAccept-Language" (Accept-Language is absent)
+// It returns false if the response does not vary or always fails to match (Vary: *).
+func variantKey(normalize func(name string, values []string) (string, bool), resHeader http.Header, req *http.Request) (string, bool) {
+	var names []string
+	for _, v := range resHeader.Values("Vary") {
+		for _, n := range strings.Split(v, ",") {
+			n = strings.TrimSpace(n)
+			if n == "" {
+				continue
+			}
+			if n == "*" {
+				return "", false
+			}
+			n = http.CanonicalHeaderKey(n)
+			if !contains(names, n) {
+				names = append(names, n)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return "", false
+	}
+	return variantKeyOf(normalize, names, req), true
+}
+
+// variantKeyOf returns the key of the variant nominating names for req.
+func variantKeyOf(normalize func(name string, values []string) (string, bool), names []string, req *http.Request) string {
+	lines := make([]string, 0, len(names))
+	for _, n := range names {
+		v, ok := normalize(n, req.Header.Values(n))
+		if !ok {
+			// An absent field only matches an absent field.
+			lines = append(lines, n)
+			continue
+		}
+		lines = append(lines, n+": "+v)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// variantNames returns the request header field names nominated by the variant.
+func variantNames(variant string) []string {
+	var names []string
+	for _, l := range strings.Split(variant, "\n") {
+		n, _, _ := strings.Cut(l, ":")
+		names = append(names, n)
+	}
+	return names
+}
+
+// loadVariant loads the stored variant that matches the request.
+// The variants are checked from the newest so that the latest Vary header field of the resource takes precedence.
+func (m *cacheMw) loadVariant(reqc *http.Request) (*http.Request, *http.Response, bool) {
+	variants, err := m.cacher.Variants(reqc)
+	if err != nil {
+		m.logger.Error("failed to load variants", slog.String("error", err.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)))
+		return nil, nil, false
+	}
+	checked := map[string]struct{}{}
+	for i := len(variants) - 1; i >= 0; i-- {
+		key := variantKeyOf(m.cacher.NormalizeVaryField, variantNames(variants[i]), reqc)
+		if _, ok := checked[key]; ok {
+			continue
+		}
+		checked[key] = struct{}{}
+		if !contains(variants, key) {
+			continue
+		}
+		cachedReq, cachedRes, err := m.cacher.LoadVariant(reqc, key)
+		if err != nil {
+			m.logger.Debug("variant not loaded", slog.String("error", err.Error()), slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)))
+			continue
+		}
+		return cachedReq, cachedRes, true
+	}
+	return nil, nil, false
+}
+
+// storeVariant deletes the oldest variants to make room under the maximum number and stores the response as the variant.
+// The stores of the variants of a resource are serialized, otherwise the concurrent stores could exceed the maximum number.
+func (m *cacheMw) storeVariant(reqc *http.Request, resc *http.Response, variant string, expires time.Time) error {
+	if m.maxVariants > 0 {
+		unlock := m.variantLocks.lock(requestKey(reqc))
+		defer unlock()
+		variants, err := m.cacher.Variants(reqc)
+		if err != nil {
+			return err
+		}
+		// The variant already stored is replaced without adding a variant.
+		for !contains(variants, variant) && len(variants) >= m.maxVariants {
+			if err := m.cacher.DeleteVariant(reqc, variants[0]); err != nil {
+				return err
+			}
+			m.logger.Debug("variant deleted", slog.String("host", reqc.Host), slog.String("method", reqc.Method), slog.String("url", reqc.URL.String()), slog.Any("headers", m.maskHeader(reqc.Header)), slog.String("variant", variants[0]))
+			variants = variants[1:]
+		}
+	}
+	return m.cacher.StoreVariant(reqc, resc, variant, expires)
+}
+
+// storesVariant reports whether the response is stored as a variant.
+func (m *cacheMw) storesVariant(reqc *http.Request, resc *http.Response) (string, bool) {
+	if m.cacher.StoreVariant == nil {
+		return "", false
+	}
+	if _, ok := sliceIndex(reqc); ok {
+		return "", false
+	}
+	return variantKey(m.cacher.NormalizeVaryField, resc.Header, reqc)
+}
+
+// keyedMutex is the set of the mutexes for the keys.
+// The zero value is ready to use.
+type keyedMutex struct {
+	locks map[string]*keyedLock
+	mu    sync.Mutex
+}
+
+type keyedLock struct {
+	mu sync.Mutex
+	// n is the number of the holders and the waiters of the lock.
+	n int
+}
+
+// lock locks the mutex for the key and returns the function to unlock it.
+// The mutex is removed when it is unlocked by all of the holders and the waiters.
+func (k *keyedMutex) lock(key string) (unlock func()) {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = map[string]*keyedLock{}
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.n++
+	k.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		k.mu.Lock()
+		l.n--
+		if l.n == 0 {
+			delete(k.locks, key)
+		}
+		k.mu.Unlock()
+	}
+}